@@ -0,0 +1,303 @@
+// Package command defines the commands the HTTP service replicates through
+// the raft log for the store to apply, and their encoding in log entries.
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// Op is the type of a command. Its value is written in every log entry, so
+// ops are only ever added, never renumbered.
+type Op uint8
+
+const (
+	OpSet             Op = iota + 1 // Set a key.
+	OpCAS                           // Set a key if its preconditions hold.
+	OpDelete                        // Delete a key.
+	OpExpire                        // Drop a key whose TTL ran out.
+	OpTxn                           // Apply Ops atomically, if all compares hold.
+	OpBatch                         // Apply Ops independently.
+	OpCompare                       // Precondition of a txn.
+	OpSetNamespace                  // Create a namespace or change its quota.
+	OpDeleteNamespace               // Delete a namespace and all its keys.
+	OpAcquire                       // Acquire or extend the lease of a lock.
+	OpRenew                         // Extend the lease of a held lock.
+	OpRelease                       // Release a lock, or drop its lapsed lease.
+	OpIncr                          // Add Delta to the integer value of a key.
+	OpDecr                          // Subtract Delta from the integer value of a key.
+	OpCreateSession                 // Create a session.
+	OpRenewSession                  // Extend the lease of a session.
+	OpDestroySession                // End a session and delete its keys.
+	OpMergePatch                    // Apply the JSON merge patch in Value to the document of a key.
+	OpJSONPatch                     // Apply the JSON patch in Value to the document of a key.
+)
+
+var opNames = [...]string{
+	OpSet:     "set",
+	OpCAS:     "cas",
+	OpDelete:  "delete",
+	OpExpire:  "expire",
+	OpTxn:     "txn",
+	OpBatch:   "batch",
+	OpCompare: "compare",
+
+	OpSetNamespace:    "set_namespace",
+	OpDeleteNamespace: "delete_namespace",
+
+	OpAcquire: "acquire",
+	OpRenew:   "renew",
+	OpRelease: "release",
+
+	OpIncr: "incr",
+	OpDecr: "decr",
+
+	OpCreateSession:  "create_session",
+	OpRenewSession:   "renew_session",
+	OpDestroySession: "destroy_session",
+
+	OpMergePatch: "merge_patch",
+	OpJSONPatch:  "json_patch",
+}
+
+// Valid reports whether o is an op this version knows about.
+func (o Op) Valid() bool {
+	return o > 0 && int(o) < len(opNames)
+}
+
+func (o Op) String() string {
+	if !o.Valid() {
+		return fmt.Sprintf("op(%d)", uint8(o))
+	}
+	return opNames[o]
+}
+
+// ParseOp returns the op named s.
+func ParseOp(s string) (Op, error) {
+	for o, name := range opNames {
+		if name != "" && name == s {
+			return Op(o), nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q", ErrUnknownOp, s)
+}
+
+// MarshalText encodes o by name in JSON.
+func (o Op) MarshalText() ([]byte, error) {
+	if !o.Valid() {
+		return nil, fmt.Errorf("%w %d", ErrUnknownOp, uint8(o))
+	}
+	return []byte(opNames[o]), nil
+}
+
+func (o *Op) UnmarshalText(b []byte) error {
+	op, err := ParseOp(string(b))
+	if err != nil {
+		return err
+	}
+	*o = op
+	return nil
+}
+
+// Command is a mutation of the store, proposed by the leader.
+type Command struct {
+	Op        Op     `json:"op"`
+	Namespace string `json:"ns,omitempty"` // Of Key, the default one if empty.
+	Key       string `json:"key,omitempty"`
+	Value     []byte `json:"data,omitempty"` // Base64 in JSON.
+
+	// Text and PrevText hold Value and PrevValue as JSON strings in
+	// commands logged before values were bytes. Decode moves them.
+	Text     *string `json:"value,omitempty" codec:"-"`
+	PrevText *string `json:"prev_value,omitempty" codec:"-"`
+
+	// Expires is the deadline of a key set with a TTL, in Unix nanoseconds.
+	// It is computed by the leader from TTL when the command is proposed,
+	// so every node agrees on it. For OpExpire it is the deadline the
+	// leader saw expiring.
+	TTL     int64 `json:"ttl,omitempty"` // In seconds.
+	Expires int64 `json:"expires,omitempty"`
+
+	// Preconditions of an OpCAS command, at least one must be set, and
+	// optional ones of OpMergePatch and OpJSONPatch commands. PrevIndex is
+	// the modify index the key must have, 0 meaning that it must not exist;
+	// PrevValue the value it must hold.
+	PrevIndex *uint64 `json:"prev_index,omitempty"`
+	PrevValue *[]byte `json:"prev_data,omitempty"`
+
+	// Ops are the operations of an OpTxn command: OpSet, OpDelete and
+	// OpCompare, the latter carrying preconditions like OpCAS. For OpBatch
+	// they are independent commands of any other op.
+	Ops []*Command `json:"ops,omitempty"`
+
+	// Quota is the quota an OpSetNamespace command gives its namespace,
+	// none if nil.
+	Quota *Quota `json:"quota,omitempty"`
+
+	// Lock commands name the lock in Key. OpAcquire carries the Holder
+	// asking for it, OpRenew and OpRelease the fencing Token of the lease,
+	// and OpAcquire and OpRenew the deadline of the lease in Expires, as
+	// computed by the leader from TTL. An OpRelease with Expires is
+	// proposed by the leader for a lease it saw lapse at that deadline.
+	Holder string `json:"holder,omitempty"`
+	Token  uint64 `json:"token,omitempty"`
+
+	// Delta is what an OpIncr command adds to the value of its key, and an
+	// OpDecr command subtracts from it, 1 if zero. The command fails if
+	// the value would fall outside of [Min, Max], nil bounds not being
+	// checked.
+	Delta int64  `json:"delta,omitempty"`
+	Min   *int64 `json:"min,omitempty"`
+	Max   *int64 `json:"max,omitempty"`
+
+	// Session is the session the key of a set or cas command, or of a set
+	// operation of a txn, is attached to, none if zero, and the session
+	// OpRenewSession and OpDestroySession address. OpCreateSession
+	// and OpRenewSession carry the lease of the session in TTL and Expires,
+	// and OpCreateSession the raft server it is bound to in Node, if any.
+	// An OpDestroySession with Expires is proposed by the leader for a
+	// session it saw lapse at that deadline.
+	Session uint64 `json:"session,omitempty"`
+	Node    string `json:"node,omitempty"`
+
+	// Limits are those of the leader that proposed the command, which the
+	// command, and what it writes, are checked against when applied. It is
+	// not checked if nil.
+	Limits *Limits `json:"limits,omitempty"`
+}
+
+// Quota limits the keys a namespace holds, and their size in bytes, keys and
+// values included. Zero means no limit.
+type Quota struct {
+	MaxKeys  int64 `json:"max_keys,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// Encoding of a command in a log entry: a format byte, the op of the command
+// and the command itself in msgpack. Commands logged before the format byte
+// was introduced are JSON objects, whose first byte is always '{'.
+//
+// A node that reads a format or an op it does not know, written by a newer
+// version during a rolling upgrade, fails the entry with ErrUnknownOp or
+// ErrUnknownFormat instead of guessing at it. Fields it does not know are
+// ignored, so that optional fields can be added without either: a change
+// older versions cannot apply correctly takes a new op or format.
+const (
+	formatMsgpack = 1
+
+	headerSize = 2
+)
+
+var (
+	// ErrUnknownFormat is returned by Decode for a log entry encoded in a
+	// format this version does not know.
+	ErrUnknownFormat = errors.New("unknown command format")
+
+	// ErrUnknownOp is returned by Decode for a command, or an operation of
+	// it, whose op this version does not know.
+	ErrUnknownOp = errors.New("unknown command op")
+)
+
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// Encode returns the log entry data for c.
+func Encode(c *Command) ([]byte, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	var body []byte
+	if err := codec.NewEncoderBytes(&body, msgpackHandle).Encode(c); err != nil {
+		return nil, Errorf(CodeInvalid, "encode command: %w", err)
+	}
+	return append([]byte{formatMsgpack, byte(c.Op)}, body...), nil
+}
+
+// Decode returns the command in the log entry data b. Unknown formats and
+// ops, and trailing bytes, are errors, as an *Error whose code is
+// CodeUnsupported if the command may come from a newer version and
+// CodeInvalid otherwise. Unknown fields are ignored.
+func Decode(b []byte) (*Command, error) {
+	if len(b) > 0 && b[0] == '{' {
+		return decodeJSON(b)
+	}
+	if len(b) < headerSize {
+		return nil, Errorf(CodeInvalid, "decode command: %d bytes is too short", len(b))
+	}
+	if b[0] != formatMsgpack {
+		return nil, Errorf(CodeUnsupported, "%w %d", ErrUnknownFormat, b[0])
+	}
+	op := Op(b[1])
+	if !op.Valid() {
+		return nil, Errorf(CodeUnsupported, "%w %d", ErrUnknownOp, b[1])
+	}
+
+	var c Command
+	body := b[headerSize:]
+	d := codec.NewDecoderBytes(body, msgpackHandle)
+	if err := d.Decode(&c); err != nil {
+		return nil, Errorf(CodeInvalid, "decode %s command: %w", op, err)
+	}
+	if n := d.NumBytesRead(); n != len(body) {
+		return nil, Errorf(CodeInvalid, "decode %s command: %d trailing bytes", op, len(body)-n)
+	}
+	if c.Op != op {
+		return nil, Errorf(CodeInvalid, "decode command: %s command tagged %s", c.Op, op)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// decodeJSON decodes a command logged as JSON, moving legacy text values to
+// their byte fields.
+func decodeJSON(b []byte) (*Command, error) {
+	var c Command
+	if err := json.Unmarshal(b, &c); err != nil {
+		code := CodeInvalid
+		if errors.Is(err, ErrUnknownOp) {
+			code = CodeUnsupported
+		}
+		return nil, Errorf(code, "decode JSON command: %w", err)
+	}
+	c.upgrade()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// upgrade moves the values of a legacy command, and of its operations, to
+// their byte fields.
+func (c *Command) upgrade() {
+	if c.Text != nil && c.Value == nil {
+		c.Value = []byte(*c.Text)
+	}
+	if c.PrevText != nil && c.PrevValue == nil {
+		v := []byte(*c.PrevText)
+		c.PrevValue = &v
+	}
+	c.Text, c.PrevText = nil, nil
+	for _, op := range c.Ops {
+		op.upgrade()
+	}
+}
+
+// validate checks that c and its operations have known ops.
+func (c *Command) validate() error {
+	if !c.Op.Valid() {
+		return Errorf(CodeUnsupported, "%w %d", ErrUnknownOp, uint8(c.Op))
+	}
+	for _, op := range c.Ops {
+		if op == nil {
+			return Errorf(CodeInvalid, "%s command with a nil operation", c.Op)
+		}
+		if err := op.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package command
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// Test_EncodeDecode tests that commands survive encoding, nested operations
+// included.
+func Test_EncodeDecode(t *testing.T) {
+	zero := uint64(0)
+	prev := []byte{0, 0xff}
+	c := &Command{Op: OpTxn, Ops: []*Command{
+		{Op: OpCompare, Key: "a", PrevIndex: &zero, PrevValue: &prev},
+		{Op: OpSet, Key: "a", Value: []byte{1, 2, 3}, TTL: 10, Expires: 42},
+		{Op: OpDelete, Key: "b"},
+	}}
+	b, err := Encode(c)
+	if err != nil {
+		t.Fatalf("failed to encode command: %s", err)
+	}
+	if b[0] != formatMsgpack || Op(b[1]) != OpTxn {
+		t.Fatalf("wrong header: %v", b[:headerSize])
+	}
+	d, err := Decode(b)
+	if err != nil {
+		t.Fatalf("failed to decode command: %s", err)
+	}
+	if d.Op != OpTxn || len(d.Ops) != 3 {
+		t.Fatalf("wrong command decoded: %+v", d)
+	}
+	cmp, set := d.Ops[0], d.Ops[1]
+	if cmp.Op != OpCompare || *cmp.PrevIndex != 0 || !bytes.Equal(*cmp.PrevValue, prev) {
+		t.Fatalf("wrong compare decoded: %+v", cmp)
+	}
+	if set.Op != OpSet || !bytes.Equal(set.Value, []byte{1, 2, 3}) || set.TTL != 10 || set.Expires != 42 {
+		t.Fatalf("wrong set decoded: %+v", set)
+	}
+}
+
+// Test_DecodeJSON tests that commands logged as JSON, with byte or legacy
+// text values, are still decoded.
+func Test_DecodeJSON(t *testing.T) {
+	c, err := Decode([]byte(`{"op":"cas","key":"k","value":"v2","prev_value":"v1"}`))
+	if err != nil {
+		t.Fatalf("failed to decode legacy command: %s", err)
+	}
+	if c.Op != OpCAS || string(c.Value) != "v2" || string(*c.PrevValue) != "v1" || c.Text != nil {
+		t.Fatalf("wrong legacy command decoded: %+v", c)
+	}
+	c, err = Decode([]byte(`{"op":"set","key":"k","data":"AP8="}`))
+	if err != nil {
+		t.Fatalf("failed to decode JSON command: %s", err)
+	}
+	if !bytes.Equal(c.Value, []byte{0, 0xff}) {
+		t.Fatalf("wrong JSON value decoded: %q", c.Value)
+	}
+	if _, err := Decode([]byte(`{"op":"frobnicate","key":"k"}`)); !errors.Is(err, ErrUnknownOp) {
+		t.Fatalf("JSON command with unknown op returned %v", err)
+	}
+}
+
+// Test_DecodeStrict tests that formats and ops Decode does not know are
+// errors, and that fields it does not know are ignored.
+func Test_DecodeStrict(t *testing.T) {
+	b, err := Encode(&Command{Op: OpSet, Key: "k", Value: []byte("v")})
+	if err != nil {
+		t.Fatalf("failed to encode command: %s", err)
+	}
+	if _, err := Decode(append([]byte{2}, b[1:]...)); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("unknown format returned %v", err)
+	}
+	if _, err := Decode(append([]byte{formatMsgpack, 200}, b[2:]...)); !errors.Is(err, ErrUnknownOp) {
+		t.Fatalf("unknown op returned %v", err)
+	}
+	if _, err := Decode(append([]byte{formatMsgpack, byte(OpDelete)}, b[2:]...)); err == nil {
+		t.Fatalf("command tagged with another op was decoded")
+	}
+	if _, err := Decode(append(b, 0)); err == nil {
+		t.Fatalf("command with trailing bytes was decoded")
+	}
+	if _, err := Decode(b[:len(b)-1]); err == nil {
+		t.Fatalf("truncated command was decoded")
+	}
+	if _, err := Decode(nil); err == nil {
+		t.Fatalf("empty command was decoded")
+	}
+
+	// A field added by a newer version.
+	var body []byte
+	codec.NewEncoderBytes(&body, msgpackHandle).Encode(map[string]interface{}{"op": OpSet, "key": "k", "lease": 7})
+	if c, err := Decode(append([]byte{formatMsgpack, byte(OpSet)}, body...)); err != nil || c.Key != "k" {
+		t.Fatalf("command with unknown field decoded as %+v, %v", c, err)
+	}
+
+	// A nested op added by a newer version.
+	body = nil
+	codec.NewEncoderBytes(&body, msgpackHandle).Encode(map[string]interface{}{"op": OpBatch, "ops": []map[string]interface{}{{"op": 200}}})
+	if _, err := Decode(append([]byte{formatMsgpack, byte(OpBatch)}, body...)); !errors.Is(err, ErrUnknownOp) {
+		t.Fatalf("nested unknown op returned %v", err)
+	}
+	if _, err := Encode(&Command{Op: 200}); !errors.Is(err, ErrUnknownOp) {
+		t.Fatalf("encoding unknown op returned %v", err)
+	}
+}
+
+// Test_Limits tests that the keys and values of a command, nested operations
+// included, are checked against the limits.
+func Test_Limits(t *testing.T) {
+	l := Limits{MaxKeyBytes: 3, MaxValueBytes: 4}
+	if err := l.Check(&Command{Op: OpSet, Key: "abc", Value: []byte("1234")}); err != nil {
+		t.Fatalf("command within the limits rejected: %s", err)
+	}
+	for c, limit := range map[*Command]string{
+		{Op: OpSet, Key: "abcd"}:                      LimitKeySize,
+		{Op: OpSet, Key: "a", Value: []byte("12345")}: LimitValueSize,
+		{Op: OpTxn, Ops: []*Command{{Op: OpSet, Key: "a"}, {Op: OpDelete, Key: "abcd"}}}: LimitKeySize,
+	} {
+		var e *Error
+		if err := l.Check(c); !errors.As(err, &e) || e.Code != CodeQuota || e.Limit != limit {
+			t.Fatalf("command over the %s limit returned %v", limit, err)
+		}
+	}
+	if err := (Limits{}).Check(&Command{Op: OpSet, Key: "abcd", Value: make([]byte, 1<<20)}); err != nil {
+		t.Fatalf("command rejected without limits: %s", err)
+	}
+}
+
+// Test_Dump tests that commands survive a dump, and that a truncated dump is
+// told from a complete one.
+func Test_Dump(t *testing.T) {
+	var buf bytes.Buffer
+	dw, err := NewDumpWriter(&buf, 7, 2)
+	if err != nil {
+		t.Fatalf("failed to start dump: %s", err)
+	}
+	in := []*Command{
+		{Op: OpSetNamespace, Namespace: "a", Quota: &Quota{MaxKeys: 1}},
+		{Op: OpSet, Key: "k", Value: []byte{0, 0xff}},
+		{Op: OpSet, Namespace: "a", Key: "k", Value: []byte("v"), Expires: 1700000000000000000},
+	}
+	for _, c := range in {
+		if err := dw.Write(c); err != nil {
+			t.Fatalf("failed to dump command: %s", err)
+		}
+	}
+	if err := dw.Write(&Command{Op: OpDelete, Key: "k"}); err == nil {
+		t.Fatalf("delete command dumped")
+	}
+	if err := dw.Close(); err != nil {
+		t.Fatalf("failed to close dump: %s", err)
+	}
+	dump := buf.String()
+
+	dr, err := NewDumpReader(strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("failed to read dump header: %s", err)
+	}
+	if dr.Index != 7 || dr.Term != 2 {
+		t.Fatalf("wrong dump index and term: %d %d", dr.Index, dr.Term)
+	}
+	for i, want := range in {
+		c, err := dr.Next()
+		if err != nil {
+			t.Fatalf("failed to read command %d: %s", i, err)
+		}
+		if c.Op != want.Op || c.Namespace != want.Namespace || c.Key != want.Key || !bytes.Equal(c.Value, want.Value) || c.Expires != want.Expires {
+			t.Fatalf("wrong command %d read: %+v", i, c)
+		}
+		if want.Quota != nil && (c.Quota == nil || *c.Quota != *want.Quota) {
+			t.Fatalf("wrong quota read: %+v", c.Quota)
+		}
+	}
+	if _, err := dr.Next(); err != io.EOF {
+		t.Fatalf("end of dump returned %v", err)
+	}
+
+	lines := strings.SplitAfter(dump, "\n")
+	for name, s := range map[string]string{
+		"without trailer":  strings.Join(lines[:3], ""),
+		"with wrong count": strings.Join(append(lines[:2:2], lines[4:]...), ""),
+		"cut mid-line":     dump[:len(dump)-len(lines[4])-5],
+	} {
+		dr, err := NewDumpReader(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("failed to read header of dump %s: %s", name, err)
+		}
+		for err == nil {
+			_, err = dr.Next()
+		}
+		if !errors.Is(err, ErrDumpTruncated) {
+			t.Fatalf("dump %s returned %v", name, err)
+		}
+	}
+	if _, err := NewDumpReader(strings.NewReader(`{"dump":2}` + "\n")); ErrorCode(err) != CodeUnsupported {
+		t.Fatalf("dump of unknown format returned %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package command
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A dump is the whole content of a store as newline-delimited JSON: a header
+// line with the index and term of the state dumped, the commands that
+// recreate it, set_namespace for every namespace before set for every key,
+// and a trailer line with the number of commands, which tells a complete dump
+// from a truncated one. Values are base64, as in every JSON command.
+const dumpFormat = 1
+
+// ErrDumpTruncated is returned by DumpReader.Next for a dump that ends before
+// its trailer.
+var ErrDumpTruncated = errors.New("dump truncated")
+
+// dumpLine is a line of a dump: a command, the header or the trailer.
+type dumpLine struct {
+	*Command
+	Dump  int    `json:"dump,omitempty"` // Format, in the header only.
+	Index uint64 `json:"index,omitempty"`
+	Term  uint64 `json:"term,omitempty"`
+	End   bool   `json:"end,omitempty"`
+	Count int64  `json:"count,omitempty"` // Of commands, in the trailer only.
+}
+
+// DumpWriter writes a dump.
+type DumpWriter struct {
+	w     *bufio.Writer
+	enc   *json.Encoder
+	count int64
+}
+
+// NewDumpWriter writes the header of a dump of the state at index and term to
+// w, and returns a DumpWriter writing the rest.
+func NewDumpWriter(w io.Writer, index, term uint64) (*DumpWriter, error) {
+	bw := bufio.NewWriter(w)
+	d := &DumpWriter{w: bw, enc: json.NewEncoder(bw)}
+	if err := d.enc.Encode(&dumpLine{Dump: dumpFormat, Index: index, Term: term}); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Write writes c, a set or set_namespace command.
+func (d *DumpWriter) Write(c *Command) error {
+	if c.Op != OpSet && c.Op != OpSetNamespace {
+		return fmt.Errorf("%s command in dump", c.Op)
+	}
+	if err := d.enc.Encode(&dumpLine{Command: c}); err != nil {
+		return err
+	}
+	d.count++
+	return nil
+}
+
+// Close writes the trailer and flushes the dump. It does not close the
+// underlying writer.
+func (d *DumpWriter) Close() error {
+	if err := d.enc.Encode(&dumpLine{End: true, Count: d.count}); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// DumpReader reads a dump.
+type DumpReader struct {
+	dec   *json.Decoder
+	count int64
+	done  bool
+
+	// Index and Term are those of the state dumped.
+	Index uint64
+	Term  uint64
+}
+
+// NewDumpReader reads the header of the dump in r, and returns a DumpReader
+// reading its commands.
+func NewDumpReader(r io.Reader) (*DumpReader, error) {
+	d := &DumpReader{dec: json.NewDecoder(bufio.NewReader(r))}
+	var header dumpLine
+	if err := d.dec.Decode(&header); err != nil {
+		return nil, Errorf(CodeInvalid, "read dump header: %w", err)
+	}
+	if header.Command != nil || header.End {
+		return nil, Errorf(CodeInvalid, "dump without header")
+	}
+	if header.Dump != dumpFormat {
+		return nil, Errorf(CodeUnsupported, "unsupported dump format %d", header.Dump)
+	}
+	d.Index, d.Term = header.Index, header.Term
+	return d, nil
+}
+
+// Next returns the next command of the dump, io.EOF after the last one. A
+// dump that ends before its trailer, or whose trailer does not count the
+// commands read, fails with ErrDumpTruncated.
+func (d *DumpReader) Next() (*Command, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+	var line dumpLine
+	if err := d.dec.Decode(&line); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, Errorf(CodeInvalid, "%w after %d commands", ErrDumpTruncated, d.count)
+	} else if err != nil {
+		return nil, Errorf(CodeInvalid, "read dump: %w", err)
+	}
+	if line.End {
+		if line.Count != d.count {
+			return nil, Errorf(CodeInvalid, "%w: %d commands read, %d dumped", ErrDumpTruncated, d.count, line.Count)
+		}
+		d.done = true
+		return nil, io.EOF
+	}
+	c := line.Command
+	if c == nil || (c.Op != OpSet && c.Op != OpSetNamespace) {
+		return nil, Errorf(CodeInvalid, "unexpected line %d in dump", d.count+2)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	d.count++
+	return c, nil
+}
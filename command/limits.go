@@ -0,0 +1,62 @@
+package command
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+)
+
+// Limits bounds the size of what commands write, zero meaning no limit. The
+// leader checks commands against its limits before proposing them, and
+// carries them in Command.Limits, which every node checks the command
+// against again when applying it, so that all nodes decide alike whatever
+// their own configuration.
+type Limits struct {
+	MaxKeyBytes   int64 `json:"max_key_bytes,omitempty"`   // Of a key.
+	MaxValueBytes int64 `json:"max_value_bytes,omitempty"` // Of a value.
+	MaxStoreBytes int64 `json:"max_store_bytes,omitempty"` // Of all keys and values, of every namespace.
+}
+
+// The limits a CodeQuota error can be for, see Error.Limit.
+const (
+	LimitKeySize        = "key_size"
+	LimitValueSize      = "value_size"
+	LimitStoreSize      = "store_size"
+	LimitNamespaceKeys  = "namespace_keys"
+	LimitNamespaceBytes = "namespace_bytes"
+	LimitRequestSize    = "request_size"
+)
+
+// RejectedWrites counts the writes rejected for exceeding a limit, by limit.
+// It is published by expvar as rejected_writes.
+var RejectedWrites = expvar.NewMap("rejected_writes")
+
+// LimitError returns the CodeQuota error of a write to key exceeding limit.
+func LimitError(limit, key string, format string, a ...interface{}) *Error {
+	return &Error{Code: CodeQuota, Err: fmt.Errorf(format, a...), Key: key, Limit: limit}
+}
+
+// Check checks the keys and values c writes, its operations included,
+// against the key and value size limits.
+func (l Limits) Check(c *Command) error {
+	if l.MaxKeyBytes > 0 && int64(len(c.Key)) > l.MaxKeyBytes {
+		return LimitError(LimitKeySize, c.Key, "key of %d bytes exceeds the limit of %d", len(c.Key), l.MaxKeyBytes)
+	}
+	if l.MaxValueBytes > 0 && int64(len(c.Value)) > l.MaxValueBytes {
+		return LimitError(LimitValueSize, c.Key, "value of %d bytes exceeds the limit of %d", len(c.Value), l.MaxValueBytes)
+	}
+	for _, op := range c.Ops {
+		if err := l.Check(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountRejected counts err in RejectedWrites if it is a CodeQuota error.
+func CountRejected(err error) {
+	var e *Error
+	if errors.As(err, &e) && e.Code == CodeQuota && e.Limit != "" {
+		RejectedWrites.Add(e.Limit, 1)
+	}
+}
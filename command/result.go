@@ -0,0 +1,98 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Result is the response of the state machine to a command on a single key,
+// namespace or lock, returned through raft.ApplyFuture.Response().
+type Result struct {
+	Op        Op     `json:"op"`
+	Namespace string `json:"ns,omitempty"`
+	Key       string `json:"key"`
+	Index     uint64 `json:"index"` // Index of the log entry the command was applied at.
+
+	// Revision is the modify index of the key after the command, 0 if it
+	// does not exist. PrevRevision and PrevValue describe the key before
+	// the command, PrevRevision being 0 if it did not exist. Both
+	// revisions are equal when the command changed nothing.
+	Revision     uint64 `json:"revision,omitempty"`
+	PrevRevision uint64 `json:"prev_revision,omitempty"`
+	PrevValue    []byte `json:"prev_value,omitempty"`
+
+	// For a lock command, Revision is the fencing token of the lease after
+	// the command, 0 once released, and PrevRevision the one before it.
+	// Holder and Expires describe the lease after the command. For a
+	// session command, Session is the session and Expires its lease.
+	Holder  string `json:"holder,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+	Session uint64 `json:"session,omitempty"`
+
+	// Value is the value of the key after an incr or decr command.
+	Value []byte `json:"value,omitempty"`
+}
+
+// Deleted reports whether the command removed an existing key.
+func (r *Result) Deleted() bool {
+	return r.PrevRevision != 0 && r.Revision == 0
+}
+
+// Code classifies the errors a command can be rejected with.
+type Code string
+
+const (
+	CodeConflict    Code = "conflict"    // A precondition did not hold, or a lock is held by another holder.
+	CodeInvalid     Code = "invalid"     // The command is malformed.
+	CodeNotFound    Code = "not_found"   // The command addresses a namespace or session that does not exist.
+	CodeQuota       Code = "quota"       // The command would exceed a size limit or the quota of its namespace.
+	CodeUnsupported Code = "unsupported" // The command uses a format or op the node does not know.
+	CodeInternal    Code = "internal"    // The node failed to apply the command.
+)
+
+// Error is the response of the state machine to a command it rejected.
+type Error struct {
+	Code Code
+	Err  error
+
+	// Key is the key the command was rejected for, if any. For a
+	// conflict, Revision is its current modify index, 0 if it does not
+	// exist. For CodeQuota, Limit is the limit exceeded, see Limits.
+	Key      string
+	Revision uint64
+	Limit    string
+}
+
+// Errorf returns an *Error with code and a message formatted like
+// fmt.Errorf, %w included.
+func Errorf(code Code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+// ConflictError returns the error of a command whose precondition on key did
+// not hold, revision being the current modify index of the key.
+func ConflictError(key string, revision uint64) *Error {
+	return &Error{
+		Code:     CodeConflict,
+		Err:      fmt.Errorf("precondition failed for key %s at index %d", key, revision),
+		Key:      key,
+		Revision: revision,
+	}
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Conflict marks failed preconditions, see raftnode.IsConflict.
+func (e *Error) Conflict() bool { return e.Code == CodeConflict }
+
+// ErrorCode returns the code of the *Error err wraps, CodeInternal if it
+// wraps none.
+func ErrorCode(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
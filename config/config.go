@@ -16,6 +16,8 @@ type RaftConfig struct {
 	BootstrapExpect   int             `json:"bootstrap_expect"`
 	SingleNode        bool            `json:"single_node"`
 	Server            Server          `json:"server"`
+	Store             StoreConfig     `json:"store"`
+	Limits            LimitsConfig    `json:"limits"`
 }
 
 type Node struct {
@@ -28,6 +30,26 @@ type Server struct {
 	Address string `json:"address"`
 }
 
+// StoreConfig selects the key-value backend. Unless Inmem is set the store is
+// kept in a bbolt file at Path, which defaults to kv.db inside RaftDir.
+// SnapshotCompression is "none" (the default), "gzip" or "snappy".
+type StoreConfig struct {
+	Inmem               bool   `json:"inmem"`
+	Path                string `json:"path"`
+	SnapshotCompression string `json:"snapshot_compression"`
+}
+
+// LimitsConfig bounds what clients can write, zero meaning no limit: the size
+// of a key, of a value, of all keys and values together, and of the body of a
+// write request. The leader enforces them before proposing writes, and the
+// writes carry them so that every node enforces them alike when applying.
+type LimitsConfig struct {
+	MaxKeyBytes     int64 `json:"max_key_bytes"`
+	MaxValueBytes   int64 `json:"max_value_bytes"`
+	MaxStoreBytes   int64 `json:"max_store_bytes"`
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+}
+
 type SnapshotConfig struct {
 	Enabled           bool `json:"enabled"`
 	SnapshotIntervalSec int `json:"snapshot_interval_sec"`
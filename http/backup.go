@@ -0,0 +1,131 @@
+package httpd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/raftnode"
+)
+
+const (
+	// backupBarrierTimeout bounds how long a backup waits for the entries
+	// committed before it to be applied.
+	backupBarrierTimeout = 10 * time.Second
+
+	// restoreBatch and restoreBatchBytes bound the commands, and the bytes
+	// of their keys and values, a restore proposes per log entry.
+	restoreBatch      = 256
+	restoreBatchBytes = 1 << 20
+)
+
+// handleBackupRequest streams a dump of every namespace and key, see
+// command.DumpWriter, as of the last entry committed when the request
+// reached the leader or later. The index of the state dumped is in the dump
+// header, as it is only known once the dump starts.
+func (s *Service) handleBackupRequest(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.store.(raftnode.Dumper)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if s.raft.GetRaftState() != raft.Leader.String() {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.raft.GetRaft().Barrier(backupBarrierTimeout).Error(); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if _, err := d.Dump(w); err != nil {
+		// The status is sent already: the dump lacks its trailer, which
+		// the reader reports as a truncated dump.
+		log.Error("failed to dump store", "error", err)
+	}
+}
+
+// handleRestoreRequest loads the dump in the body into the store, through
+// raft, in batches of commands. Namespaces and keys of the dump are created
+// or overwritten, others are kept. A command that fails to decode, or that the
+// state machine rejects, stops the restore and is named by the error; the
+// batches applied until then stay applied.
+func (s *Service) handleRestoreRequest(w http.ResponseWriter, r *http.Request) {
+	if s.raft.GetRaftState() != raft.Leader.String() {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	dr, err := command.NewDumpReader(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := struct {
+		DumpIndex uint64 `json:"dump_index"`
+		Restored  int64  `json:"restored"`
+		Index     uint64 `json:"index,omitempty"`
+	}{DumpIndex: dr.Index}
+	var batch []*command.Command
+	n, size := 0, 0 // Commands proposed, bytes in batch.
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		v, err := s.apply(&command.Command{Op: command.OpBatch, Ops: batch})
+		if err != nil {
+			return err
+		}
+		// The commands of a batch are applied independently, those after
+		// a failed one included.
+		resps, ok := v.([]interface{})
+		if !ok {
+			resps = make([]interface{}, len(batch))
+		}
+		var first error
+		for i, v := range resps {
+			if err, ok := v.(error); ok {
+				if first == nil {
+					first = fmt.Errorf("restore command %d: %w", n+i+1, err)
+				}
+				continue
+			}
+			resp.Restored++
+			if res, ok := v.(*command.Result); ok {
+				resp.Index = res.Index
+			}
+		}
+		n += len(batch)
+		batch, size = batch[:0], 0
+		return first
+	}
+	for {
+		c, err := dr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = s.checkLimits(c)
+		}
+		if err != nil {
+			writeError(w, fmt.Errorf("restore command %d: %w", n+len(batch)+1, err))
+			return
+		}
+		batch = append(batch, c)
+		size += len(c.Key) + len(c.Value)
+		if len(batch) == restoreBatch || size >= restoreBatchBytes {
+			if err := flush(); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,111 @@
+package httpd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ifoxhz/raft-nginx/command"
+)
+
+// Client writes are group committed: every mutation is queued to a single
+// goroutine, which proposes a write at once when it is idle, and the writes
+// queued while a proposal is in flight as a single "batch" log entry once it
+// completes, handing each request the response to its own command.
+// Concurrent writers thus share raft round trips instead of paying one each,
+// and a lone writer never waits for others.
+const (
+	// maxGroupCommit is the most writes in one log entry.
+	maxGroupCommit = 256
+)
+
+var errServiceClosed = errors.New("service closed")
+
+// proposal is a client write waiting to be group committed.
+type proposal struct {
+	c    *command.Command
+	resp interface{}
+	err  error
+	done chan struct{}
+}
+
+// propose queues c for the next group commit and returns the state machine's
+// response to it, or the error it responded with, like apply. A command
+// exceeding the limits of the service is rejected without being proposed.
+func (s *Service) propose(c *command.Command) (interface{}, error) {
+	if err := s.checkLimits(c); err != nil {
+		return nil, err
+	}
+	p := &proposal{c: c, done: make(chan struct{})}
+	select {
+	case s.proposals <- p:
+	case <-s.done:
+		return nil, errServiceClosed
+	}
+	select {
+	case <-p.done:
+		return p.resp, p.err
+	case <-s.done:
+		return nil, errServiceClosed
+	}
+}
+
+// commitProposals runs for the lifetime of the service, collecting queued
+// proposals into batches and committing them one after the other. A batch
+// holds the proposals queued when the previous one completed, or the first
+// one to arrive after; it is proposed without waiting for more.
+func (s *Service) commitProposals() {
+	for {
+		var batch []*proposal
+		select {
+		case p := <-s.proposals:
+			batch = append(batch, p)
+		case <-s.done:
+			return
+		}
+	collect:
+		for len(batch) < maxGroupCommit {
+			select {
+			case p := <-s.proposals:
+				batch = append(batch, p)
+			default:
+				break collect
+			}
+		}
+		s.commit(batch)
+	}
+}
+
+// commit replicates batch as a single log entry and completes every proposal
+// with the response to its command. A lone proposal is replicated as is.
+func (s *Service) commit(batch []*proposal) {
+	defer func() {
+		for _, p := range batch {
+			close(p.done)
+		}
+	}()
+	if len(batch) == 1 {
+		batch[0].resp, batch[0].err = s.apply(batch[0].c)
+		return
+	}
+
+	ops := make([]*command.Command, len(batch))
+	for i, p := range batch {
+		ops[i] = p.c
+	}
+	resp, err := s.apply(&command.Command{Op: command.OpBatch, Ops: ops})
+	resps, ok := resp.([]interface{})
+	if err == nil && (!ok || len(resps) != len(batch)) {
+		err = fmt.Errorf("unexpected response to batch of %d commands: %T", len(batch), resp)
+	}
+	for i, p := range batch {
+		if err != nil {
+			p.err = err
+			continue
+		}
+		if e, ok := resps[i].(error); ok {
+			p.err = e
+			continue
+		}
+		p.resp = resps[i]
+	}
+}
@@ -0,0 +1,139 @@
+package httpd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+)
+
+// maxSequenceBlock is the most IDs a /seq request allocates at once.
+const maxSequenceBlock = 1 << 20
+
+func (s *Service) handleIncrRequest(w http.ResponseWriter, r *http.Request) {
+	s.handleCounterRequest(w, r, command.OpIncr)
+}
+
+func (s *Service) handleDecrRequest(w http.ResponseWriter, r *http.Request) {
+	s.handleCounterRequest(w, r, command.OpDecr)
+}
+
+// handleCounterRequest adds to (/incr) or subtracts from (/decr) the integer
+// value of a key, by the delta query parameter or 1, and returns its new
+// value. The key is created at 0 if it does not exist, with the ttl in
+// seconds if given; a key that exists keeps its TTL. With min and/or max the
+// write is rejected with 412 if the value would leave those bounds.
+func (s *Service) handleCounterRequest(w http.ResponseWriter, r *http.Request, op command.Op) {
+	if s.raft.GetRaftState() != raft.Leader.String() {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ns, _, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	c := &command.Command{Op: op, Namespace: ns, Key: pathKey(r), Delta: 1}
+	var err error
+	parse := func(name string) *int64 {
+		v := q.Get(name)
+		if v == "" || err != nil {
+			return nil
+		}
+		var n int64
+		n, err = strconv.ParseInt(v, 10, 64)
+		return &n
+	}
+	if d := parse("delta"); d != nil {
+		c.Delta = *d
+	}
+	c.Min, c.Max = parse("min"), parse("max")
+	ttl := parse("ttl")
+	if err != nil || c.Delta <= 0 || (ttl != nil && *ttl <= 0) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if ttl != nil {
+		c.TTL = *ttl
+		c.Expires = time.Now().Add(time.Duration(*ttl) * time.Second).UnixNano()
+	}
+
+	res, err := s.applyCommand(c)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if res == nil {
+		return
+	}
+	v, _ := strconv.ParseInt(string(res.Value), 10, 64)
+	writeJSON(w, http.StatusOK, struct {
+		Namespace string `json:"ns,omitempty"`
+		Key       string `json:"key"`
+		Value     int64  `json:"value"`
+		Index     uint64 `json:"index"`
+		Revision  uint64 `json:"revision,omitempty"`
+	}{res.Namespace, res.Key, v, res.Index, res.Revision})
+}
+
+// handleSequenceRequest allocates a block of count IDs (1 if not given) from
+// the sequence kept in a key, in a single log entry, and returns the first
+// and last of them. A new sequence starts at 1; the key holds the last ID
+// allocated, and reads like a counter.
+func (s *Service) handleSequenceRequest(w http.ResponseWriter, r *http.Request) {
+	if s.raft.GetRaftState() != raft.Leader.String() {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ns, _, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+	count := int64(1)
+	if n := r.URL.Query().Get("count"); n != "" {
+		var err error
+		if count, err = strconv.ParseInt(n, 10, 64); err != nil || count <= 0 || count > maxSequenceBlock {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	first, last, index, err := s.Allocate(ns, pathKey(r), count)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Namespace string `json:"ns,omitempty"`
+		Key       string `json:"key"`
+		First     int64  `json:"first"`
+		Last      int64  `json:"last"`
+		Index     uint64 `json:"index"`
+	}{ns, pathKey(r), first, last, index})
+}
+
+// Incr adds delta to the integer value of key of namespace ns, and returns
+// the result holding its new value.
+func (s *Service) Incr(ns, key string, delta int64) (*command.Result, error) {
+	return s.applyCommand(&command.Command{Op: command.OpIncr, Namespace: ns, Key: key, Delta: delta})
+}
+
+// Allocate allocates count IDs from the sequence in key of namespace ns, and
+// returns the first and last of them and the index of the log entry that
+// allocated them. The IDs of a sequence are unique, and increasing, as long
+// as nothing but Allocate writes its key.
+func (s *Service) Allocate(ns, key string, count int64) (first, last int64, index uint64, err error) {
+	res, err := s.Incr(ns, key, count)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if res == nil {
+		return 0, 0, 0, command.Errorf(command.CodeInternal, "allocation from sequence %s without result", key)
+	}
+	last, err = strconv.ParseInt(string(res.Value), 10, 64)
+	if err != nil {
+		return 0, 0, 0, command.Errorf(command.CodeInternal, "sequence %s holds %q", key, res.Value)
+	}
+	return last - count + 1, last, res.Index, nil
+}
@@ -0,0 +1,120 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/jsondoc"
+)
+
+// Media types of the patches a PATCH of a key accepts.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// handlePatchRequest applies the patch in the body to the JSON document in a
+// key, a JSON merge patch (RFC 7386) or a JSON patch (RFC 6902) as the
+// Content-Type says, and returns the patched document. The patch applies
+// with If-Match and prev_value like a conditional write. A key that does not
+// hold a JSON document, or an operation that fails, is answered with 400, a
+// test operation that does not hold with 412.
+func (s *Service) handlePatchRequest(w http.ResponseWriter, r *http.Request) {
+	if s.raft.GetRaftState() != raft.Leader.String() {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ns, _, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+	var op command.Op
+	switch t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t {
+	case mergePatchType:
+		op = command.OpMergePatch
+	case jsonPatchType:
+		op = command.OpJSONPatch
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	enc, err := valueEncoding(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	prevIndex, prevValue, err := preconditions(r, enc)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.limitBody(w, r)
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+	if !json.Valid(patch) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.Patch(ns, pathKey(r), op, patch, prevIndex, prevValue)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if res == nil {
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, res.Revision))
+	writeJSON(w, http.StatusOK, struct {
+		Op        string          `json:"op"`
+		Namespace string          `json:"ns,omitempty"`
+		Key       string          `json:"key"`
+		Index     uint64          `json:"index"`
+		Revision  uint64          `json:"revision"`
+		Value     json.RawMessage `json:"value"`
+	}{res.Op.String(), res.Namespace, res.Key, res.Index, res.Revision, res.Value})
+}
+
+// writeDocumentPath responds to a GET of key with the part of its document v
+// at path, as JSON.
+func writeDocumentPath(w http.ResponseWriter, v []byte, path string) {
+	if v == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	part, err := jsondoc.Get(v, path)
+	if errors.Is(err, jsondoc.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(part)
+}
+
+// Patch applies patch, a JSON merge patch if op is command.OpMergePatch or a
+// JSON patch if it is command.OpJSONPatch, to the document in key of
+// namespace ns, and returns the result holding the patched document. The
+// preconditions are those of CompareAndSet, and are not checked if nil.
+func (s *Service) Patch(ns, key string, op command.Op, patch []byte, prevIndex *uint64, prevValue *[]byte) (*command.Result, error) {
+	return s.applyCommand(&command.Command{
+		Op:        op,
+		Namespace: ns,
+		Key:       key,
+		Value:     patch,
+		PrevIndex: prevIndex,
+		PrevValue: prevValue,
+	})
+}
@@ -0,0 +1,215 @@
+package httpd
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/raftnode"
+)
+
+const (
+	// defaultLockTTL is the lease of a lock acquired or renewed without a
+	// ttl.
+	defaultLockTTL = 15 * time.Second
+
+	// lockRetryInterval is how often a blocking acquire checks whether the
+	// lock it waits for became free.
+	lockRetryInterval = 100 * time.Millisecond
+)
+
+// lease is a raftnode.Lease, or the result of a lock command, in a /lock
+// response. TTL is the seconds the lease has left, rounded up.
+type lease struct {
+	Name   string `json:"name"`
+	Holder string `json:"holder,omitempty"`
+	Token  uint64 `json:"token,omitempty"`
+	TTL    int64  `json:"ttl,omitempty"`
+	Index  uint64 `json:"index,omitempty"`
+}
+
+func newLease(name, holder string, token uint64, expires int64) lease {
+	l := lease{Name: name, Holder: holder, Token: token}
+	if token != 0 {
+		if d := time.Duration(expires - time.Now().UnixNano()); d > 0 {
+			l.TTL = int64((d + time.Second - 1) / time.Second)
+		}
+	}
+	return l
+}
+
+// handleLockRequest returns the holder of a lock (GET), acquires it (POST,
+// with holder and optionally ttl in seconds and wait, how long to wait for
+// the lock if it is held), renews its lease (PUT, with token and optionally
+// ttl) or releases it (DELETE, with token). Acquire and renew return the
+// fencing token of the lease. A lock held by another holder, or a token that
+// is not the current one, is answered with 412.
+func (s *Service) handleLockRequest(w http.ResponseWriter, r *http.Request) {
+	lk, ok := s.store.(raftnode.Locker)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	name := chi.URLParam(r, "name")
+	q := r.URL.Query()
+
+	if r.Method == "GET" {
+		l, ok := lk.Lock(name)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, newLease(name, l.Holder, l.Token, l.Expires))
+		return
+	}
+
+	if s.raft.GetRaftState() != raft.Leader.String() {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ttl := defaultLockTTL
+	if t := q.Get("ttl"); t != "" {
+		secs, err := strconv.ParseInt(t, 10, 64)
+		if err != nil || secs <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+	var token uint64
+	if r.Method != "POST" {
+		var err error
+		if token, err = strconv.ParseUint(q.Get("token"), 10, 64); err != nil || token == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var res *command.Result
+	var err error
+	switch r.Method {
+	case "POST":
+		holder := q.Get("holder")
+		if holder == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var wait time.Duration
+		if d := q.Get("wait"); d != "" {
+			if wait, err = time.ParseDuration(d); err != nil || wait < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if wait > maxWatchWait {
+			wait = maxWatchWait
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		res, err = s.acquire(ctx, lk, name, holder, ttl)
+	case "PUT":
+		res, err = s.Renew(name, token, ttl)
+	case "DELETE":
+		res, err = s.Release(name, token)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if res == nil {
+		return
+	}
+	out := newLease(name, res.Holder, res.Revision, res.Expires)
+	out.Index = res.Index
+	writeJSON(w, http.StatusOK, out)
+}
+
+// acquire acquires lock name for holder, waiting until ctx is done for the
+// lock to be free if it is held. It checks the local state for the lease to
+// be released or to lapse before trying again, and returns the conflict of
+// the last try if the lock is still held.
+func (s *Service) acquire(ctx context.Context, lk raftnode.Locker, name, holder string, ttl time.Duration) (*command.Result, error) {
+	for {
+		res, err := s.Acquire(name, holder, ttl)
+		if command.ErrorCode(err) != command.CodeConflict {
+			return res, err
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(lockRetryInterval):
+			}
+			l, held := lk.Lock(name)
+			if !held || l.Holder == holder || l.Expires <= time.Now().UnixNano() {
+				break
+			}
+		}
+	}
+}
+
+// Acquire acquires lock name for holder, with a lease of ttl, and returns the
+// lease, its fencing token in Revision. A holder acquiring a lock it holds
+// extends its lease. If another holder has the lock the error satisfies
+// raftnode.IsConflict.
+func (s *Service) Acquire(name, holder string, ttl time.Duration) (*command.Result, error) {
+	return s.applyCommand(&command.Command{
+		Op:      command.OpAcquire,
+		Key:     name,
+		Holder:  holder,
+		TTL:     int64(ttl / time.Second),
+		Expires: time.Now().Add(ttl).UnixNano(),
+	})
+}
+
+// Renew extends the lease of lock name, whose fencing token is token, to ttl
+// from now.
+func (s *Service) Renew(name string, token uint64, ttl time.Duration) (*command.Result, error) {
+	return s.applyCommand(&command.Command{
+		Op:      command.OpRenew,
+		Key:     name,
+		Token:   token,
+		TTL:     int64(ttl / time.Second),
+		Expires: time.Now().Add(ttl).UnixNano(),
+	})
+}
+
+// Release releases lock name, whose fencing token is token.
+func (s *Service) Release(name string, token uint64) (*command.Result, error) {
+	return s.applyCommand(&command.Command{Op: command.OpRelease, Key: name, Token: token})
+}
+
+// expireLocks runs for the lifetime of the service. While this node is the
+// leader it proposes a release command for every lease past its deadline.
+func (s *Service) expireLocks() {
+	lk, ok := s.store.(raftnode.Locker)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if s.raft.GetRaftState() != raft.Leader.String() {
+			continue
+		}
+		for _, l := range lk.ExpiredLocks(time.Now().UnixNano(), expiryBatch) {
+			c := &command.Command{Op: command.OpRelease, Key: l.Name, Token: l.Token, Expires: l.Expires}
+			if _, err := s.apply(c); err != nil {
+				log.Error("failed to release expired lock", "lock", l.Name, "error", err)
+				break
+			}
+		}
+	}
+}
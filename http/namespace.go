@@ -0,0 +1,72 @@
+package httpd
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/raftnode"
+)
+
+// handleNamespacesRequest lists the namespaces, the default one excepted,
+// with their quota and usage.
+func (s *Service) handleNamespacesRequest(w http.ResponseWriter, r *http.Request) {
+	nsr, ok := s.store.(raftnode.Namespacer)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Namespaces []raftnode.NamespaceInfo `json:"namespaces"`
+	}{nsr.Namespaces()})
+}
+
+// handleNamespaceRequest returns a namespace (GET), creates it or changes its
+// quota (PUT, with an optional {"max_keys": n, "max_bytes": n} body, zero
+// meaning no limit), or deletes it together with all its keys (DELETE).
+func (s *Service) handleNamespaceRequest(w http.ResponseWriter, r *http.Request) {
+	nsr, ok := s.store.(raftnode.Namespacer)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	name := chi.URLParam(r, "ns")
+
+	switch r.Method {
+	case "GET":
+		for _, info := range nsr.Namespaces() {
+			if info.Name == name {
+				writeJSON(w, http.StatusOK, info)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+
+	case "PUT", "DELETE":
+		if s.raft.GetRaftState() != raft.Leader.String() {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		c := &command.Command{Op: command.OpDeleteNamespace, Namespace: name}
+		if r.Method == "PUT" {
+			c = &command.Command{Op: command.OpSetNamespace, Namespace: name, Quota: &command.Quota{}}
+			s.limitBody(w, r)
+			if err := json.NewDecoder(r.Body).Decode(c.Quota); err != nil && err != io.EOF {
+				bodyError(w, err)
+				return
+			}
+		}
+		res, err := s.applyCommand(c)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, res, "text")
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
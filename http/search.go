@@ -0,0 +1,222 @@
+package httpd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ifoxhz/raft-nginx/raftnode"
+)
+
+const (
+	// defaultSearchTimeout and maxSearchTimeout bound how long a /search
+	// scans keys before returning what it found.
+	defaultSearchTimeout = 5 * time.Second
+	maxSearchTimeout     = time.Minute
+
+	// searchCheckInterval is the number of keys scanned between checks of
+	// the search deadline.
+	searchCheckInterval = 256
+)
+
+// search matches keys and values against the filters of a /search request.
+// Every filter set must hold for a key to match.
+type search struct {
+	glob  string         // Key glob.
+	keys  *regexp.Regexp // Key glob, compiled by globRegexp.
+	regex *regexp.Regexp // Key regular expression.
+	value *regexp.Regexp // Value regular expression.
+}
+
+func (sc *search) match(key string, value []byte) bool {
+	if sc.keys != nil && !sc.keys.MatchString(key) {
+		return false
+	}
+	if sc.regex != nil && !sc.regex.MatchString(key) {
+		return false
+	}
+	return sc.value == nil || sc.value.Match(value)
+}
+
+// prefix returns the prefix every key matching the glob starts with, so
+// that only those keys are scanned.
+func (sc *search) prefix() string {
+	if i := strings.IndexAny(sc.glob, `*?[\`); i >= 0 {
+		return sc.glob[:i]
+	}
+	return sc.glob
+}
+
+// errBadGlob is returned by globRegexp for malformed globs.
+var errBadGlob = errors.New("syntax error in glob")
+
+// globRegexp compiles a key glob, with the syntax of path.Match, except
+// that its wildcards also match /: * matches any sequence of characters,
+// ? any single character, [...] any character of the class, or not of the
+// class if it starts with ^, and \ escapes the next character.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		case '\\':
+			if i++; i == len(glob) {
+				return nil, errBadGlob
+			}
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case '[':
+			b.WriteByte('[')
+			if i+1 < len(glob) && glob[i+1] == '^' {
+				b.WriteByte('^')
+				i++
+			}
+			n := 0
+			for i++; i < len(glob) && glob[i] != ']'; i, n = i+1, n+1 {
+				switch glob[i] {
+				case '\\':
+					if i++; i == len(glob) {
+						return nil, errBadGlob
+					}
+					b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+				case '-':
+					b.WriteByte('-')
+				default:
+					b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+				}
+			}
+			if i == len(glob) || n == 0 {
+				return nil, errBadGlob
+			}
+			b.WriteByte(']')
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteByte('$')
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, errBadGlob
+	}
+	return re, nil
+}
+
+// handleSearchRequest searches the local state for the keys matching a glob
+// (glob, see globRegexp), a regular expression (regex) and/or
+// whose value matches a regular expression (value), among the keys with
+// prefix if given. It returns up to limit matches, in key order, with their
+// values. The search stops after timeout (5s by default, at most a minute).
+// truncated is set if the limit or the timeout stopped the search before
+// the last key, timed_out if the timeout did.
+func (s *Service) handleSearchRequest(w http.ResponseWriter, r *http.Request) {
+	_, rd, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+	rg, ok := rd.(raftnode.Ranger)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	q := r.URL.Query()
+	var sc search
+	var err error
+	if sc.glob = q.Get("glob"); sc.glob != "" {
+		if sc.keys, err = globRegexp(sc.glob); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if re := q.Get("regex"); re != "" {
+		if sc.regex, err = regexp.Compile(re); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if re := q.Get("value"); re != "" {
+		if sc.value, err = regexp.Compile(re); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if sc.glob == "" && sc.regex == nil && sc.value == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit := defaultListLimit
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	timeout := defaultSearchTimeout
+	if t := q.Get("timeout"); t != "" {
+		if timeout, err = time.ParseDuration(t); err != nil || timeout <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if timeout > maxSearchTimeout {
+		timeout = maxSearchTimeout
+	}
+	enc, err := valueEncoding(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The prefix of the glob narrows the scan further than the prefix
+	// parameter only if it starts with it.
+	prefix := q.Get("prefix")
+	if p := sc.prefix(); strings.HasPrefix(p, prefix) {
+		prefix = p
+	} else if !strings.HasPrefix(prefix, p) {
+		writeJSON(w, http.StatusOK, searchResult{KVs: []kv{}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	res := searchResult{KVs: []kv{}}
+	err = rg.Range(prefix, "", "", func(key string, value []byte) bool {
+		if res.Scanned%searchCheckInterval == 0 && ctx.Err() != nil {
+			res.Truncated, res.TimedOut = true, true
+			return false
+		}
+		res.Scanned++
+		if !sc.match(key, value) {
+			return true
+		}
+		if len(res.KVs) == limit {
+			res.Truncated = true
+			return false
+		}
+		res.KVs = append(res.KVs, kv{Key: key, Value: encodeValue(value, enc)})
+		return true
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// searchResult is the response to a /search. Scanned is the number of keys
+// the search went through.
+type searchResult struct {
+	KVs       []kv `json:"kvs"`
+	Scanned   int  `json:"scanned"`
+	Truncated bool `json:"truncated,omitempty"`
+	TimedOut  bool `json:"timed_out,omitempty"`
+}
@@ -3,11 +3,17 @@
 package httpd
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"strconv"
 	"os"
 	"fmt"
 	"time"
@@ -15,40 +21,114 @@ import (
 	"github.com/go-chi/chi/v5"
     "github.com/go-chi/chi/v5/middleware"
 	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
 	"github.com/ifoxhz/raft-nginx/helper"
+	"github.com/ifoxhz/raft-nginx/jsondoc"
 	"github.com/ifoxhz/raft-nginx/raftnode"
-	"github.com/ifoxhz/raft-nginx/store"
 )
 
 var log = helper.Logger.Named("service")  // 创建子Logger
 
-type command struct {
-	Op    string `json:"op,omitempty"`
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
+// txnOp is an operation of a /txn request, its values are encoded like the
+// values of the other JSON bodies.
+type txnOp struct {
+	Op        string  `json:"op"`
+	Key       string  `json:"key"`
+	Value     string  `json:"value,omitempty"`
+	TTL       int64   `json:"ttl,omitempty"`
+	Session   uint64  `json:"session,omitempty"`
+	PrevIndex *uint64 `json:"prev_index,omitempty"`
+	PrevValue *string `json:"prev_value,omitempty"`
 }
 
+// valueEncoding returns how values are represented in the JSON bodies of r
+// and of its response, from the encoding query parameter: "text" (the
+// default) for strings, which cannot carry bytes that are not valid UTF-8,
+// or "base64".
+func valueEncoding(r *http.Request) (string, error) {
+	switch enc := r.URL.Query().Get("encoding"); enc {
+	case "", "text":
+		return "text", nil
+	case "base64":
+		return enc, nil
+	default:
+		return "", fmt.Errorf("unsupported encoding: %s", enc)
+	}
+}
+
+func encodeValue(v []byte, enc string) string {
+	if enc == "base64" {
+		return base64.StdEncoding.EncodeToString(v)
+	}
+	return string(v)
+}
+
+func decodeValue(v, enc string) ([]byte, error) {
+	if enc == "base64" {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return []byte(v), nil
+}
+
+const (
+	// expiryInterval is how often the leader looks for expired keys, and
+	// expiryBatch the most keys it expires per round.
+	expiryInterval = time.Second
+	expiryBatch    = 1000
+
+	// defaultListLimit and maxListLimit bound the page size of /keys.
+	defaultListLimit = 100
+	maxListLimit     = 1000
+
+	// defaultWatchWait and maxWatchWait bound how long a long-polling
+	// /watch waits for events; watchKeepAlive is how often an idle event
+	// stream gets a comment line so proxies keep it open.
+	defaultWatchWait = 30 * time.Second
+	maxWatchWait     = 5 * time.Minute
+	watchKeepAlive   = 15 * time.Second
+)
+
 
 
 // Service provides HTTP service.
 type Service struct {
 	addr string
 	ln   net.Listener
-	store *store.Store
+	store raftnode.StateMachine
 	raft  *raftnode.RaftNode
 	router *chi.Mux
+	done   chan struct{}
+
+	// proposals queues client writes for group commit, see propose.
+	proposals chan *proposal
+
+	// limits bounds what client writes carry, maxRequestBytes the body of
+	// write requests; zero means no limit.
+	limits          command.Limits
+	maxRequestBytes int64
 }
 
-// New returns an uninitialized HTTP service.
-func New(addr string, store * store.Store ,raft *raftnode.RaftNode) *Service {
+// New returns an uninitialized HTTP service. Reads are served from store,
+// which must be the same StateMachine the raft node applies entries to.
+func New(addr string, store raftnode.StateMachine, raft *raftnode.RaftNode) *Service {
 	return &Service{
 		addr:  addr,
 		store: store,
 		raft:raft,
 		router :  chi.NewRouter(),
+		done:   make(chan struct{}),
+		proposals: make(chan *proposal, maxGroupCommit),
 	}
 }
 
+// SetLimits sets the limits client writes are checked against before being
+// proposed, and the most bytes the body of a write request may have. It must
+// be called before Start.
+func (s *Service) SetLimits(l command.Limits, maxRequestBytes int64) {
+	s.limits = l
+	s.maxRequestBytes = maxRequestBytes
+}
+
 // Start starts the service.
 func (s *Service) Start() error {
 	
@@ -64,6 +144,10 @@ func (s *Service) Start() error {
 
 	s.InitMulService()
 	s.InitRaftObserver()
+	go s.expireKeys()
+	go s.expireLocks()
+	go s.expireSessions()
+	go s.commitProposals()
 	// http.Handle("/", s.mux)
 	log.Info("starting HTTP server at ", "router", s.router)
 	go func() {
@@ -78,6 +162,7 @@ func (s *Service) Start() error {
 
 // Close closes the service.
 func (s *Service) Close() {
+	close(s.done)
 	s.ln.Close()
 	return
 }
@@ -86,10 +171,84 @@ func (s *Service) Close() {
 
 func (s *Service) InitMulService() {
 	s.router.Use(middleware.Logger)
-	s.router.Get("/key/{key}", s.handleKeyRequest)
-	s.router.Post("/key", s.handleKeyRequest)
+	s.keyRoutes(s.router)
+	s.router.Get("/ns", s.handleNamespacesRequest)
+	s.router.Route("/ns/{ns}", func(r chi.Router) {
+		r.Get("/", s.handleNamespaceRequest)
+		r.Put("/", s.handleNamespaceRequest)
+		r.Delete("/", s.handleNamespaceRequest)
+		s.keyRoutes(r)
+	})
+	s.router.Get("/lock/{name}", s.handleLockRequest)
+	s.router.Post("/lock/{name}", s.handleLockRequest)
+	s.router.Put("/lock/{name}", s.handleLockRequest)
+	s.router.Delete("/lock/{name}", s.handleLockRequest)
+	s.router.Get("/sessions", s.handleSessionsRequest)
+	s.router.Post("/session", s.handleSessionRequest)
+	s.router.Get("/session/{id}", s.handleSessionRequest)
+	s.router.Put("/session/{id}", s.handleSessionRequest)
+	s.router.Delete("/session/{id}", s.handleSessionRequest)
+	s.router.Get("/backup", s.handleBackupRequest)
+	s.router.Post("/restore", s.handleRestoreRequest)
 	s.router.Post("/join", s.handleJoin)
 	s.router.Get("/raft", s.handleRaftRequest)
+	s.router.Handle("/debug/vars", expvar.Handler())
+}
+
+// keyRoutes registers the routes on keys, which are served for the default
+// namespace at the root and for namespace {ns} under /ns/{ns}.
+func (s *Service) keyRoutes(r chi.Router) {
+	r.Get("/key/{key}", s.handleKeyRequest)
+	r.Get("/keys", s.handleListRequest)
+	r.Get("/search", s.handleSearchRequest)
+	r.Get("/watch", s.handleWatchRequest)
+	r.Post("/key", s.handleKeyRequest)
+	r.Post("/key/{key}", s.handleKeyRequest)
+	r.Delete("/key/{key}", s.handleKeyRequest)
+	r.Patch("/key/{key}", s.handlePatchRequest)
+	r.Get("/ttl/{key}", s.handleTTLRequest)
+	r.Post("/txn", s.handleTxnRequest)
+	r.Post("/rollback/{key}", s.handleRollbackRequest)
+	r.Post("/incr/{key}", s.handleIncrRequest)
+	r.Post("/decr/{key}", s.handleDecrRequest)
+	r.Post("/seq/{key}", s.handleSequenceRequest)
+}
+
+// reader returns the namespace of r, from its path, and the keys to serve it
+// from. It responds 404 if the namespace does not exist, and 501 if the store
+// has no namespaces but the default one.
+func (s *Service) reader(w http.ResponseWriter, r *http.Request) (string, raftnode.Reader, bool) {
+	ns := chi.URLParam(r, "ns")
+	if ns == "" {
+		return "", s.store, true
+	}
+	nsr, ok := s.store.(raftnode.Namespacer)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return "", nil, false
+	}
+	rd, err := nsr.Namespace(ns)
+	if errors.Is(err, raftnode.ErrNamespaceNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return "", nil, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return "", nil, false
+	}
+	return ns, rd, true
+}
+
+// pathKey returns the key in the path of r, unescaped.
+func pathKey(r *http.Request) string {
+	k := chi.URLParam(r, "key")
+	if r.URL.RawPath == "" {
+		return k
+	}
+	if u, err := url.PathUnescape(k); err == nil {
+		return u
+	}
+	return k
 }
 
 func (s *Service) InitRaftObserver( ) {
@@ -159,27 +318,75 @@ func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
-	getKey := func() string {
-		parts := strings.Split(r.URL.Path, "/")
-		if len(parts) != 3 {
-			return ""
-		}
-		return parts[2]
+	ns, rd, ok := s.reader(w, r)
+	if !ok {
+		return
 	}
+	getKey := func() string { return pathKey(r) }
 
 	switch r.Method {
 	case "GET":
 		k := getKey()
 		if k == "" {
 			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		enc, err := valueEncoding(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var index uint64
+		if q := r.URL.Query().Get("index"); q != "" {
+			var err error
+			if index, err = strconv.ParseUint(q, 10, 64); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		var v []byte
+		if vs, ok := rd.(raftnode.Versioned); ok {
+			var create, rev uint64
+			v, create, rev, err = vs.GetAt(k, index)
+			if err == nil && rev != 0 {
+				w.Header().Set("ETag", fmt.Sprintf(`"%d"`, rev))
+				w.Header().Set("X-Create-Index", strconv.FormatUint(create, 10))
+			}
+		} else if index != 0 {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		} else if rv, ok := rd.(raftnode.Revisioned); ok {
+			var rev uint64
+			v, rev, err = rv.GetRevision(k)
+			if err == nil && rev != 0 {
+				w.Header().Set("ETag", fmt.Sprintf(`"%d"`, rev))
+			}
+		} else {
+			v, err = rd.Get(k)
+		}
+		if errors.Is(err, raftnode.ErrCompacted) {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if errors.Is(err, raftnode.ErrNotApplied) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-		v, err := s.store.Get(k)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		b, err := json.Marshal(map[string]string{k: v})
+		if q := r.URL.Query(); q.Has("path") {
+			writeDocumentPath(w, v, q.Get("path"))
+			return
+		}
+		if strings.Contains(r.Header.Get("Accept"), "application/octet-stream") {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(v)
+			return
+		}
+		b, err := json.Marshal(map[string]string{k: encodeValue(v, enc)})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -193,17 +400,97 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return 
 		}
-		m := map[string]string{}
-		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		var ttl time.Duration
+		if t := r.URL.Query().Get("ttl"); t != "" {
+			secs, err := strconv.ParseInt(t, 10, 64)
+			if err != nil || secs <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ttl = time.Duration(secs) * time.Second
+		}
+		var session uint64
+		if id := r.URL.Query().Get("session"); id != "" {
+			var err error
+			if session, err = strconv.ParseUint(id, 10, 64); err != nil || session == 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		enc, err := valueEncoding(r)
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		for k, v := range m {
-			if err := s.Set(k, v); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+		prevIndex, prevValue, err := preconditions(r, enc)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.limitBody(w, r)
+		m := map[string][]byte{}
+		if k := getKey(); k != "" {
+			// The body is the value of the key in the path, as is.
+			v, err := io.ReadAll(r.Body)
+			if err != nil {
+				bodyError(w, err)
+				return
+			}
+			m[k] = v
+		} else {
+			var body map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				bodyError(w, err)
 				return
 			}
+			for k, v := range body {
+				if m[k], err = decodeValue(v, enc); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
 		}
+		if prevIndex != nil || prevValue != nil {
+			// A precondition applies to a single key.
+			if len(m) != 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var res *command.Result
+			for k, v := range m {
+				res, err = s.CompareAndSet(ns, k, v, ttl, session, prevIndex, prevValue)
+			}
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeResult(w, res, enc)
+			return
+		}
+		if len(m) == 1 {
+			var res *command.Result
+			for k, v := range m {
+				res, err = s.Set(ns, k, v, ttl, session)
+			}
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeResult(w, res, enc)
+			return
+		}
+		// Several keys are written in a single log entry, so they are
+		// applied together or not at all.
+		ops := make([]*command.Command, 0, len(m))
+		for k, v := range m {
+			ops = append(ops, &command.Command{Op: command.OpSet, Namespace: ns, Key: k, Value: v, TTL: int64(ttl / time.Second), Session: session})
+		}
+		resp, err := s.Txn(ops)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
 
 	case "DELETE":
 		log.Info("node at raft ", "state", s.raft.GetRaft().State())
@@ -217,10 +504,17 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := s.Delete(k); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		enc, err := valueEncoding(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		res, err := s.Delete(ns, k)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, res, enc)
 
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -228,20 +522,655 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// result is the response to a write of a single key, see command.Result.
+// The previous value is encoded as the encoding query parameter says.
+type result struct {
+	Op           string  `json:"op"`
+	Namespace    string  `json:"ns,omitempty"`
+	Key          string  `json:"key,omitempty"`
+	Index        uint64  `json:"index"`
+	Revision     uint64  `json:"revision,omitempty"`
+	PrevRevision uint64  `json:"prev_revision,omitempty"`
+	PrevValue    *string `json:"prev_value,omitempty"`
+	Deleted      bool    `json:"deleted,omitempty"`
+}
+
+// writeResult responds to a write of a single key with its result, and the
+// key's new revision as ETag. A state machine may answer writes without a
+// result, the response then has no body.
+func writeResult(w http.ResponseWriter, res *command.Result, enc string) {
+	if res == nil {
+		return
+	}
+	out := result{
+		Op:           res.Op.String(),
+		Namespace:    res.Namespace,
+		Key:          res.Key,
+		Index:        res.Index,
+		Revision:     res.Revision,
+		PrevRevision: res.PrevRevision,
+		Deleted:      res.Deleted(),
+	}
+	if res.PrevRevision != 0 {
+		v := encodeValue(res.PrevValue, enc)
+		out.PrevValue = &v
+	}
+	if res.Revision != 0 {
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, res.Revision))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// writeError responds to a write the state machine rejected, or that failed
+// to be replicated, with the status matching the code of err and a JSON body
+// holding the code and message.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	code := command.ErrorCode(err)
+	switch code {
+	case command.CodeConflict:
+		status = http.StatusPreconditionFailed
+	case command.CodeInvalid:
+		status = http.StatusBadRequest
+	case command.CodeNotFound:
+		status = http.StatusNotFound
+	case command.CodeQuota:
+		status = http.StatusRequestEntityTooLarge
+	case command.CodeUnsupported:
+		status = http.StatusNotImplemented
+	}
+	body := struct {
+		Code     command.Code `json:"code"`
+		Error    string       `json:"error"`
+		Key      string       `json:"key,omitempty"`
+		Revision uint64       `json:"revision,omitempty"`
+		Limit    string       `json:"limit,omitempty"`
+	}{Code: code, Error: err.Error()}
+	var e *command.Error
+	if errors.As(err, &e) {
+		body.Key, body.Revision, body.Limit = e.Key, e.Revision, e.Limit
+	}
+	writeJSON(w, status, body)
+}
+
+// limitBody bounds the body of r to the request size limit, if any.
+func (s *Service) limitBody(w http.ResponseWriter, r *http.Request) {
+	if s.maxRequestBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxRequestBytes)
+	}
+}
+
+// checkLimits checks c against the limits of the service, counting it if
+// rejected, and has it carry them, so that every node checks it against the
+// same limits when applying it. A patch is checked on the document it would
+// leave. The store size is checked against what the leader has applied:
+// writes in flight can take the store a little past it, which applying them
+// catches.
+func (s *Service) checkLimits(c *command.Command) error {
+	err := s.limits.Check(c)
+	if err == nil && isPatch(c.Op) {
+		v, _ := s.written(c)
+		err = s.limits.Check(&command.Command{Key: c.Key, Value: v})
+	}
+	if err == nil {
+		err = s.checkStoreSize(c)
+	}
+	if err != nil {
+		command.CountRejected(err)
+		return err
+	}
+	if s.limits != (command.Limits{}) {
+		l := s.limits
+		c.Limits = &l
+	}
+	return nil
+}
+
+// checkStoreSize rejects c if it would take the store over its size limit.
+// Writes that do not grow the store are always accepted.
+func (s *Service) checkStoreSize(c *command.Command) error {
+	max := s.limits.MaxStoreBytes
+	sz, ok := s.store.(raftnode.Sizer)
+	if max <= 0 || !ok {
+		return nil
+	}
+	_, n := sz.Size()
+	if grow := s.growth(c); grow > 0 && n+grow > max {
+		return command.LimitError(command.LimitStoreSize, c.Key, "store is limited to %d bytes", max)
+	}
+	return nil
+}
+
+// growth returns the bytes the keys and values c writes, its operations
+// included, add to the store, less those of the values they overwrite.
+func (s *Service) growth(c *command.Command) int64 {
+	var n int64
+	for _, op := range c.Ops {
+		n += s.growth(op)
+	}
+	if c.Key == "" || len(c.Value) == 0 {
+		return n
+	}
+	v, old := s.written(c)
+	n += int64(len(c.Key) + len(v))
+	if old != nil {
+		n -= int64(len(c.Key) + len(old))
+	}
+	return n
+}
+
+// written returns the value c writes to its key, the document it leaves for
+// a patch, and the value the key holds, nil if none. A patch that does not
+// apply writes its own bytes, as far as limits go; applying it fails.
+func (s *Service) written(c *command.Command) (v, old []byte) {
+	rd := raftnode.Reader(s.store)
+	if nsr, ok := s.store.(raftnode.Namespacer); ok && c.Namespace != "" {
+		var err error
+		if rd, err = nsr.Namespace(c.Namespace); err != nil {
+			return c.Value, nil
+		}
+	}
+	old, _ = rd.Get(c.Key)
+	if !isPatch(c.Op) {
+		return c.Value, old
+	}
+	var err error
+	if c.Op == command.OpMergePatch {
+		v, err = jsondoc.MergePatch(old, c.Value)
+	} else {
+		v, err = jsondoc.Patch(old, c.Value)
+	}
+	if err != nil {
+		return c.Value, old
+	}
+	return v, old
+}
+
+// isPatch tells whether op patches the document of a key.
+func isPatch(op command.Op) bool {
+	return op == command.OpMergePatch || op == command.OpJSONPatch
+}
+
+// bodyError responds to a request whose body could not be read or decoded:
+// 413 if it exceeds the request size limit, 400 otherwise.
+func bodyError(w http.ResponseWriter, err error) {
+	var mbe *http.MaxBytesError
+	if !errors.As(err, &mbe) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = command.LimitError(command.LimitRequestSize, "", "request body exceeds the limit of %d bytes", mbe.Limit)
+	command.CountRejected(err)
+	writeError(w, err)
+}
+
+// writeJSON responds with status and v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// preconditions returns the conditions a write must meet, from the If-Match
+// header (the modify index the key must have, as returned in its ETag), the
+// If-None-Match: * header (the key must not exist) or the prev_value query
+// parameter (the value the key must hold, in encoding enc).
+func preconditions(r *http.Request, enc string) (prevIndex *uint64, prevValue *[]byte, err error) {
+	if h := r.Header.Get("If-Match"); h != "" {
+		idx, err := strconv.ParseUint(strings.Trim(h, `"`), 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		prevIndex = &idx
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" {
+		if h != "*" || prevIndex != nil {
+			return nil, nil, fmt.Errorf("unsupported If-None-Match: %s", h)
+		}
+		var none uint64
+		prevIndex = &none
+	}
+	if q := r.URL.Query(); q.Has("prev_value") {
+		v, err := decodeValue(q.Get("prev_value"), enc)
+		if err != nil {
+			return nil, nil, err
+		}
+		prevValue = &v
+	}
+	return prevIndex, prevValue, nil
+}
+
+// kv is a key and its value in a /keys listing.
+type kv struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// handleListRequest returns, in key order, the keys that have the prefix
+// query parameter and lie in [start, end), at most limit of them. When more
+// keys follow, the response carries a cursor, to be passed back as the
+// cursor parameter to fetch the next page.
+func (s *Service) handleListRequest(w http.ResponseWriter, r *http.Request) {
+	_, rd, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+	rg, ok := rd.(raftnode.Ranger)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultListLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	enc, err := valueEncoding(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	start := q.Get("start")
+	if c := q.Get("cursor"); c != "" {
+		start = c
+	}
+
+	resp := struct {
+		KVs    []kv   `json:"kvs"`
+		Cursor string `json:"cursor,omitempty"`
+	}{KVs: make([]kv, 0)}
+	err = rg.Range(q.Get("prefix"), start, q.Get("end"), func(key string, value []byte) bool {
+		if len(resp.KVs) == limit {
+			resp.Cursor = key
+			return false
+		}
+		resp.KVs = append(resp.KVs, kv{Key: key, Value: encodeValue(value, enc)})
+		return true
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleWatchRequest waits for changes to the key or under the prefix given
+// as query parameters (every key if neither is given), applied from the log
+// entry at index onwards or from now on if index is not set.
+//
+// By default it long-polls: it returns as soon as there are events, or with
+// none after wait, together with the index to watch from next. A client that
+// accepts text/event-stream instead gets a Server-Sent Events stream, whose
+// event ids are log indexes so that Last-Event-ID resumes it. 410 means the
+// index is no longer in the history, or that the watch fell behind, and the
+// client has to read the keys again.
+func (s *Service) handleWatchRequest(w http.ResponseWriter, r *http.Request) {
+	_, rd, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+	wr, ok := rd.(raftnode.Watcher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	q := r.URL.Query()
+	key, prefix := q.Get("key"), false
+	if q.Has("prefix") || !q.Has("key") {
+		if q.Has("key") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		key, prefix = q.Get("prefix"), true
+	}
+	var index uint64
+	if i := q.Get("index"); i != "" {
+		n, err := strconv.ParseUint(i, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		index = n
+	} else if id := r.Header.Get("Last-Event-ID"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		index = n + 1
+	} else if ai, ok := s.store.(raftnode.AppliedIndexer); ok {
+		index = ai.AppliedIndex() + 1
+	}
+	wait := defaultWatchWait
+	if d := q.Get("wait"); d != "" {
+		dur, err := time.ParseDuration(d)
+		if err != nil || dur <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wait = dur
+	}
+	if wait > maxWatchWait {
+		wait = maxWatchWait
+	}
+
+	enc, err := valueEncoding(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	watch, err := wr.Watch(key, prefix, index)
+	if errors.Is(err, raftnode.ErrCompacted) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer watch.Close()
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.streamEvents(w, r, watch, enc)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	events, err := watch.Next(ctx)
+	switch {
+	case err == nil:
+		index = events[len(events)-1].Index + 1
+	case errors.Is(err, raftnode.ErrWatchClosed):
+		w.WriteHeader(http.StatusGone)
+		return
+	case errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil:
+	default:
+		return
+	}
+
+	resp := struct {
+		Events []event `json:"events"`
+		Index  uint64  `json:"index"`
+	}{make([]event, 0, len(events)), index}
+	for _, e := range events {
+		resp.Events = append(resp.Events, newEvent(e, enc))
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// event is a raftnode.Event in a /watch response, its value encoded with
+// the encoding of the request.
+type event struct {
+	Index     uint64 `json:"index"`
+	Op        string `json:"op"`
+	Namespace string `json:"ns,omitempty"`
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+}
+
+func newEvent(e raftnode.Event, enc string) event {
+	return event{Index: e.Index, Op: e.Op, Namespace: e.Namespace, Key: e.Key, Value: encodeValue(e.Value, enc)}
+}
+
+// streamEvents writes the events of watch as Server-Sent Events until the
+// client goes away or the watch is closed.
+func (s *Service) streamEvents(w http.ResponseWriter, r *http.Request, watch *raftnode.Watch, enc string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), watchKeepAlive)
+		events, err := watch.Next(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil {
+			io.WriteString(w, ": keepalive\n\n")
+			flusher.Flush()
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, e := range events {
+			b, err := json.Marshal(newEvent(e, enc))
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Index, e.Op, b)
+		}
+		flusher.Flush()
+	}
+}
+
+// handleTxnRequest applies a batch of operations atomically, in one log
+// entry. The body is {"ops": [...]} where each operation is a "set" (key,
+// value, optional ttl in seconds and session), a "delete" (key) or a
+// "compare" (key with prev_index and/or prev_value), values being encoded as
+// the encoding query parameter says. If a compare does not hold nothing is applied and 412 is
+// returned; the per-operation results are returned in either case.
+func (s *Service) handleTxnRequest(w http.ResponseWriter, r *http.Request) {
+	if s.raft.GetRaftState() != raft.Leader.String() {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ns, _, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+	enc, err := valueEncoding(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Ops []*txnOp `json:"ops"`
+	}
+	s.limitBody(w, r)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if len(req.Ops) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ops := make([]*command.Command, 0, len(req.Ops))
+	for _, op := range req.Ops {
+		if op == nil || op.Key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c := &command.Command{Namespace: ns, Key: op.Key, TTL: op.TTL, Session: op.Session, PrevIndex: op.PrevIndex}
+		switch op.Op {
+		case "set":
+			c.Op = command.OpSet
+			c.Value, err = decodeValue(op.Value, enc)
+		case "delete":
+			c.Op = command.OpDelete
+		case "compare":
+			c.Op = command.OpCompare
+			if op.PrevIndex == nil && op.PrevValue == nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if op.PrevValue != nil {
+				var v []byte
+				v, err = decodeValue(*op.PrevValue, enc)
+				c.PrevValue = &v
+			}
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ops = append(ops, c)
+	}
+
+	resp, err := s.Txn(ops)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if raftnode.IsConflict(resp) {
+		status = http.StatusPreconditionFailed
+	}
+	writeJSON(w, status, resp)
+}
+
+// handleRollbackRequest restores a key to its value as of the log entry at
+// the index query parameter, or deletes it if it did not exist then. The
+// write only applies if the key did not change since it was read, 412 is
+// returned otherwise. A TTL the key had then is not restored.
+func (s *Service) handleRollbackRequest(w http.ResponseWriter, r *http.Request) {
+	ns, rd, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+	vs, ok := rd.(raftnode.Versioned)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if s.raft.GetRaftState() != raft.Leader.String() {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	k := pathKey(r)
+	index, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if err != nil || index == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	v, _, rev, err := vs.GetAt(k, index)
+	if errors.Is(err, raftnode.ErrCompacted) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if errors.Is(err, raftnode.ErrNotApplied) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, _, cur, err := vs.GetAt(k, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	op := &command.Command{Op: command.OpSet, Namespace: ns, Key: k, Value: v}
+	if rev == 0 {
+		op = &command.Command{Op: command.OpDelete, Namespace: ns, Key: k}
+	}
+	resp, err := s.Txn([]*command.Command{{Op: command.OpCompare, Namespace: ns, Key: k, PrevIndex: &cur}, op})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if raftnode.IsConflict(resp) {
+		status = http.StatusPreconditionFailed
+	}
+	writeJSON(w, status, resp)
+}
+
+// handleTTLRequest returns the seconds a key has left to live, -1 if the key
+// has no TTL.
+func (s *Service) handleTTLRequest(w http.ResponseWriter, r *http.Request) {
+	_, rd, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+	ex, ok := rd.(raftnode.TTLReader)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	k := pathKey(r)
+	ttl, ok, err := ex.TTL(k)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	secs := int64(-1)
+	if ok {
+		secs = int64((ttl + time.Second - 1) / time.Second)
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"key": k, "ttl": secs})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
 // Addr returns the address on which the Service is listening
 func (s *Service) Addr() net.Addr {
 	return s.ln.Addr()
 }
 
-// Get raft state
+// Get raft state, and the index of the last log entry applied to the local
+// store when the store tracks it.
 func (s *Service) handleRaftRequest(w http.ResponseWriter, r *http.Request) {
 	reState := struct {
-		State string
-		Node  string
+		State        string
+		Node         string
+		AppliedIndex uint64 `json:",omitempty"`
+		Keys         int64  `json:",omitempty"`
+		Bytes        int64  `json:",omitempty"`
 	}{
 		State: s.raft.GetRaftState(),
 		Node:  s.raft.GetRaftNodeLocalId(),
 	}
+	if ai, ok := s.store.(raftnode.AppliedIndexer); ok {
+		reState.AppliedIndex = ai.AppliedIndex()
+	}
+	if sz, ok := s.store.(raftnode.Sizer); ok {
+		reState.Keys, reState.Bytes = sz.Size()
+	}
 	jsonData, _ := json.Marshal(reState)
 
 	// 设置响应头为 JSON 类型
@@ -263,53 +1192,135 @@ func (s *Service) writeRaftState(content string) {
 	}
 }
 
-var idx = 0
-func (s *Service) Set(key, value string) error {
-	
-	now := time.Now()
-	// milliseconds := now.UnixNano() 
-	tstr := fmt.Sprintf("APISet 时间%s", now.Format("2006-01-02 15:04:05.000"))
-	value = fmt.Sprintf("value:%s APISetNode %s-%s", value, s.raft.GetRaftNodeLocalId(), tstr)
-
-	c := &command{
-		Op:    "set",
-		Key:   key,
-		Value: value,
+// Set sets key of namespace ns, "" for the default one, to value. A non-zero
+// ttl makes the key expire; its deadline is fixed here, on the leader, and
+// replicated with the command. A non-zero session attaches the key to that
+// session, which deletes it when it ends.
+func (s *Service) Set(ns, key string, value []byte, ttl time.Duration, session uint64) (*command.Result, error) {
+	c := &command.Command{
+		Op:        command.OpSet,
+		Namespace: ns,
+		Key:       key,
+		Value:     value,
+		Session:   session,
 	}
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
+	if ttl > 0 {
+		c.TTL = int64(ttl / time.Second)
+		c.Expires = time.Now().Add(ttl).UnixNano()
 	}
-	idx++
-	log.Info("HTTP set key", "key", key, "time", value)
-	f := s.raft.Apply(b)
-
-	// if idx % 3 == 0 {
-	// 	time.Sleep(1 * time.Second) // 延迟一秒
-	// 	log.Info("save snapshot log")
-	// 	rs :=s.raft.GetRaft().Snapshot()
-	// 	if rs.Error() != nil {
-	// 		log.Info("snapshot error %s", rs.Error())
-	// 	}
+	log.Info("HTTP set key", "key", key)
+	return s.applyCommand(c)
+}
 
-	// }
-	return f.(raft.ApplyFuture).Error()
+// CompareAndSet sets key to value only if it currently has modify index
+// *prevIndex (0 meaning the key must not exist) and holds *prevValue; nil
+// preconditions are not checked. If they do not hold the error satisfies
+// raftnode.IsConflict. ttl and session are those of Set.
+func (s *Service) CompareAndSet(ns, key string, value []byte, ttl time.Duration, session uint64, prevIndex *uint64, prevValue *[]byte) (*command.Result, error) {
+	c := &command.Command{
+		Op:        command.OpCAS,
+		Namespace: ns,
+		Key:       key,
+		Value:     value,
+		Session:   session,
+		PrevIndex: prevIndex,
+		PrevValue: prevValue,
+	}
+	if ttl > 0 {
+		c.TTL = int64(ttl / time.Second)
+		c.Expires = time.Now().Add(ttl).UnixNano()
+	}
+	return s.applyCommand(c)
 }
 
-func (s *Service) Delete(key string) error {
+// Delete deletes key of namespace ns. The result tells whether the key
+// existed.
+func (s *Service) Delete(ns, key string) (*command.Result, error) {
 	if s.raft.GetRaft().State() != raft.Leader {
-		return fmt.Errorf("not leader")
+		return nil, raft.ErrNotLeader
 	}
 
-	c := &command{
-		Op:  "delete",
-		Key: key,
+	c := &command.Command{
+		Op:        command.OpDelete,
+		Namespace: ns,
+		Key:       key,
 	}
-	b, err := json.Marshal(c)
+	return s.applyCommand(c)
+}
+
+// Txn applies ops in a single log entry and returns the state machine's
+// response, which holds the result of every operation.
+func (s *Service) Txn(ops []*command.Command) (interface{}, error) {
+	for _, op := range ops {
+		if op.Op == command.OpSet && op.TTL > 0 {
+			op.Expires = time.Now().Add(time.Duration(op.TTL) * time.Second).UnixNano()
+		}
+	}
+	return s.propose(&command.Command{Op: command.OpTxn, Ops: ops})
+}
+
+// applyCommand replicates c, group committed with concurrent writes, waits
+// for it to be applied and returns its result. An error returned by the
+// state machine for it is returned as well.
+func (s *Service) applyCommand(c *command.Command) (*command.Result, error) {
+	resp, err := s.propose(c)
+	res, _ := resp.(*command.Result)
+	return res, err
+}
+
+// apply replicates c and returns the state machine's response to it, or the
+// error it responded with.
+func (s *Service) apply(c *command.Command) (interface{}, error) {
+	b, err := command.Encode(c)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	f := s.raft.Apply(b).(raft.ApplyFuture)
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	resp := f.Response()
+	if err, ok := resp.(error); ok {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// expireKeys runs for the lifetime of the service. While this node is the
+// leader it proposes an expire command for every key past its deadline.
+func (s *Service) expireKeys() {
+	ex, ok := s.store.(raftnode.Expirer)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if s.raft.GetRaftState() != raft.Leader.String() {
+			continue
+		}
+		for _, k := range ex.Expired(time.Now().UnixNano(), expiryBatch) {
+			if err := s.expire(k.Namespace, k.Key, k.Expires); err != nil {
+				log.Error("failed to expire key", "ns", k.Namespace, "key", k.Key, "error", err)
+				break
+			}
+		}
 	}
+}
 
-	f := s.raft.Apply(b)
-	return f.(raft.ApplyFuture).Error()
+func (s *Service) expire(ns, key string, expires int64) error {
+	c := &command.Command{
+		Op:        command.OpExpire,
+		Namespace: ns,
+		Key:       key,
+		Expires:   expires,
+	}
+	_, err := s.apply(c)
+	return err
 }
@@ -2,19 +2,30 @@ package httpd
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/raftnode"
+	"github.com/ifoxhz/raft-nginx/store"
 )
 
 // Test_NewServer tests that a server can perform all basic operations.
 func Test_NewServer(t *testing.T) {
 	store := newTestStore()
-	s := &testServer{New(":0", store)}
+	s := &testServer{New(":0", store, newTestRaft(t, store))}
 	if s == nil {
 		t.Fatal("failed to create HTTP service")
 	}
@@ -35,7 +46,9 @@ func Test_NewServer(t *testing.T) {
 		t.Fatalf(`wrong value received for key k1: %s (expected "v1")`, string(b))
 	}
 
+	store.mu.Lock()
 	store.m["k2"] = "v2"
+	store.mu.Unlock()
 	b = doGet(t, s.URL(), "k2")
 	if string(b) != `{"k2":"v2"}` {
 		t.Fatalf(`wrong value received for key k2: %s (expected "v2")`, string(b))
@@ -49,6 +62,1089 @@ func Test_NewServer(t *testing.T) {
 
 }
 
+// Test_KeyTTL tests that a key set with a TTL reports it and is expired by
+// the leader.
+func Test_KeyTTL(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	b, _ := json.Marshal(map[string]string{"k1": "v1"})
+	resp, err := http.Post(s.URL()+"/key?ttl=1", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+
+	if b := doGetPath(t, s.URL(), "/ttl/k1"); b != `{"key":"k1","ttl":1}` {
+		t.Fatalf("wrong TTL received for key k1: %s", b)
+	}
+	if b := doGetPath(t, s.URL(), "/ttl/k2"); b != `{"key":"k2","ttl":-1}` {
+		t.Fatalf("wrong TTL received for missing key k2: %s", b)
+	}
+
+	for i := 0; i < 40; i++ {
+		if doGet(t, s.URL(), "k1") == `{"k1":""}` {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("key k1 was not expired")
+}
+
+// Test_ConditionalWrite tests writes conditioned on a key's ETag.
+func Test_ConditionalWrite(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	post := func(header, value, body string) int {
+		req, _ := http.NewRequest("POST", s.URL()+"/key", strings.NewReader(body))
+		req.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST request failed: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post("If-None-Match", "*", `{"k1":"v1"}`); code != http.StatusOK {
+		t.Fatalf("create-only write failed: %d", code)
+	}
+	if code := post("If-None-Match", "*", `{"k1":"v2"}`); code != http.StatusPreconditionFailed {
+		t.Fatalf("create-only write over existing key returned %d", code)
+	}
+
+	resp, err := http.Get(s.URL() + "/key/k1")
+	if err != nil {
+		t.Fatalf("failed to GET key: %s", err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("no ETag returned for k1")
+	}
+	if code := post("If-Match", etag, `{"k1":"v3"}`); code != http.StatusOK {
+		t.Fatalf("write with current ETag failed: %d", code)
+	}
+	if code := post("If-Match", etag, `{"k1":"v4"}`); code != http.StatusPreconditionFailed {
+		t.Fatalf("write with stale ETag returned %d", code)
+	}
+	if b := doGet(t, s.URL(), "k1"); b != `{"k1":"v3"}` {
+		t.Fatalf("wrong value received for key k1: %s", b)
+	}
+}
+
+// Test_WriteResults tests that writes are answered with their result, and
+// rejected writes with the error code.
+func Test_WriteResults(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	do := func(method, path, body string, header ...string) (int, result, map[string]interface{}) {
+		req, _ := http.NewRequest(method, s.URL()+path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %s", method, err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		var res result
+		var m map[string]interface{}
+		json.Unmarshal(b, &res)
+		json.Unmarshal(b, &m)
+		if etag := resp.Header.Get("ETag"); resp.StatusCode == http.StatusOK && res.Revision != 0 && etag != fmt.Sprintf(`"%d"`, res.Revision) {
+			t.Fatalf("wrong ETag %s for revision %d", etag, res.Revision)
+		}
+		return resp.StatusCode, res, m
+	}
+
+	code, created, _ := do("POST", "/key/k1", "v1")
+	if code != http.StatusOK || created.Op != "set" || created.Key != "k1" || created.Revision == 0 || created.Index != created.Revision || created.PrevValue != nil {
+		t.Fatalf("wrong result for create: %d %+v", code, created)
+	}
+	code, updated, _ := do("POST", "/key?encoding=base64", `{"k1":"djI="}`)
+	if code != http.StatusOK || updated.PrevRevision != created.Revision || updated.PrevValue == nil || *updated.PrevValue != "djE=" {
+		t.Fatalf("wrong result for update: %d %+v", code, updated)
+	}
+
+	code, _, m := do("POST", "/key", `{"k1":"v3"}`, "If-None-Match", "*")
+	if code != http.StatusPreconditionFailed || m["code"] != "conflict" || m["key"] != "k1" || m["revision"] != float64(updated.Revision) {
+		t.Fatalf("wrong response for conflict: %d %v", code, m)
+	}
+
+	code, deleted, _ := do("DELETE", "/key/k1", "")
+	if code != http.StatusOK || !deleted.Deleted || deleted.Revision != 0 || *deleted.PrevValue != "v2" {
+		t.Fatalf("wrong result for delete: %d %+v", code, deleted)
+	}
+	code, missing, _ := do("DELETE", "/key/k1", "")
+	if code != http.StatusOK || missing.Deleted || missing.Index <= deleted.Index {
+		t.Fatalf("wrong result for delete of missing key: %d %+v", code, missing)
+	}
+}
+
+// Test_Txn tests that a batch of operations is applied atomically and
+// returns per-operation results.
+func Test_Txn(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	doPost(t, s.URL(), "k1", "v1")
+	txn := func(body string) (int, string) {
+		resp, err := http.Post(s.URL()+"/txn", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST request failed: %s", err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	code, body := txn(`{"ops":[{"op":"compare","key":"k1","prev_value":"old"},{"op":"set","key":"k2","value":"v2"}]}`)
+	if code != http.StatusPreconditionFailed {
+		t.Fatalf("failed txn returned %d: %s", code, body)
+	}
+	if b := doGet(t, s.URL(), "k2"); b != `{"k2":""}` {
+		t.Fatalf("failed txn was applied: %s", b)
+	}
+
+	code, body = txn(`{"ops":[{"op":"compare","key":"k1","prev_value":"v1"},{"op":"set","key":"k2","value":"v2"},{"op":"delete","key":"k1"}]}`)
+	if code != http.StatusOK || !strings.Contains(body, `"succeeded":true,"results":[{"op":"compare","key":"k1","succeeded":true`) {
+		t.Fatalf("txn returned %d: %s", code, body)
+	}
+	if b := doGet(t, s.URL(), "k2"); b != `{"k2":"v2"}` {
+		t.Fatalf("wrong value received for key k2: %s", b)
+	}
+	if b := doGet(t, s.URL(), "k1"); b != `{"k1":""}` {
+		t.Fatalf("wrong value received for key k1: %s", b)
+	}
+
+	if code, _ := txn(`{"ops":[{"op":"get","key":"k1"}]}`); code != http.StatusBadRequest {
+		t.Fatalf("txn with unsupported op returned %d", code)
+	}
+}
+
+// Test_ListKeys tests paginated prefix listings.
+func Test_ListKeys(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	doPost(t, s.URL(), "upstreams/a", "1")
+	doPost(t, s.URL(), "upstreams/b", "2")
+	doPost(t, s.URL(), "upstreams/c", "3")
+	doPost(t, s.URL(), "routes/a", "4")
+
+	b := doGetPath(t, s.URL(), "/keys?prefix=upstreams/&limit=2")
+	if b != `{"kvs":[{"key":"upstreams/a","value":"1"},{"key":"upstreams/b","value":"2"}],"cursor":"upstreams/c"}` {
+		t.Fatalf("wrong first page: %s", b)
+	}
+	b = doGetPath(t, s.URL(), "/keys?prefix=upstreams/&limit=2&cursor=upstreams/c")
+	if b != `{"kvs":[{"key":"upstreams/c","value":"3"}]}` {
+		t.Fatalf("wrong last page: %s", b)
+	}
+}
+
+// Test_Watch tests long-polling for changes under a prefix.
+func Test_Watch(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	if b := doGetPath(t, s.URL(), "/watch?prefix=upstreams/&wait=100ms"); !strings.HasPrefix(b, `{"events":[],"index":`) {
+		t.Fatalf("wrong response for idle watch: %s", b)
+	}
+
+	idx := st.AppliedIndex() + 1
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		doPost(t, s.URL(), "routes/a", "1")
+		doPost(t, s.URL(), "upstreams/a", "2")
+	}()
+	var resp struct {
+		Events []event
+		Index  uint64
+	}
+	b := doGetPath(t, s.URL(), fmt.Sprintf("/watch?prefix=upstreams/&index=%d", idx))
+	if err := json.Unmarshal([]byte(b), &resp); err != nil {
+		t.Fatalf("failed to decode watch response %s: %s", b, err)
+	}
+	if len(resp.Events) != 1 || resp.Events[0].Key != "upstreams/a" || resp.Events[0].Value != "2" || resp.Index != resp.Events[0].Index+1 {
+		t.Fatalf("wrong response for watch: %s", b)
+	}
+}
+
+// Test_HistoricalRead tests reading a key as of a past index and rolling it
+// back to it.
+func Test_HistoricalRead(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	doPost(t, s.URL(), "k1", "v1")
+	idx := st.AppliedIndex()
+	doPost(t, s.URL(), "k1", "v2")
+
+	resp, err := http.Get(fmt.Sprintf("%s/key/k1?index=%d", s.URL(), idx))
+	if err != nil {
+		t.Fatalf("failed to GET key: %s", err)
+	}
+	resp.Body.Close()
+	if etag, create := resp.Header.Get("ETag"), resp.Header.Get("X-Create-Index"); etag != fmt.Sprintf(`"%d"`, idx) || create != fmt.Sprint(idx) {
+		t.Fatalf("wrong revisions for k1 at %d: %s %s", idx, etag, create)
+	}
+	if b := doGetPath(t, s.URL(), fmt.Sprintf("/key/k1?index=%d", idx)); b != `{"k1":"v1"}` {
+		t.Fatalf("wrong value received for key k1 at %d: %s", idx, b)
+	}
+
+	resp, err = http.Post(fmt.Sprintf("%s/rollback/k1?index=%d", s.URL(), idx), "", nil)
+	if err != nil {
+		t.Fatalf("rollback request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("rollback returned %d", resp.StatusCode)
+	}
+	if b := doGet(t, s.URL(), "k1"); b != `{"k1":"v1"}` {
+		t.Fatalf("wrong value received for key k1 after rollback: %s", b)
+	}
+	if b := doGetPath(t, s.URL(), fmt.Sprintf("/key/k1?index=%d", idx+100)); b != "" {
+		t.Fatalf("read of unapplied index returned %s", b)
+	}
+}
+
+// Test_BinaryValues tests writing raw values and reading them raw or
+// base64 encoded.
+func Test_BinaryValues(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	bin := []byte{0, 0xff, 0xfe, '\n', 'a'}
+	resp, err := http.Post(s.URL()+"/key/bin", "application/octet-stream", bytes.NewReader(bin))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("raw write returned %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", s.URL()+"/key/bin", nil)
+	req.Header.Set("Accept", "application/octet-stream")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to GET key: %s", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(b, bin) {
+		t.Fatalf("wrong raw value received for key bin: %q", b)
+	}
+
+	enc := base64.StdEncoding.EncodeToString(bin)
+	if b := doGetPath(t, s.URL(), "/key/bin?encoding=base64"); b != `{"bin":"`+enc+`"}` {
+		t.Fatalf("wrong base64 value received for key bin: %s", b)
+	}
+
+	resp, err = http.Post(s.URL()+"/key?encoding=base64", "application/json", strings.NewReader(`{"bin2":"`+enc+`"}`))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+	if v, _ := st.Get("bin2"); !bytes.Equal(v, bin) {
+		t.Fatalf("wrong value stored for key bin2: %q", v)
+	}
+	if b := doGetPath(t, s.URL(), "/keys?prefix=bin2&encoding=base64"); b != `{"kvs":[{"key":"bin2","value":"`+enc+`"}]}` {
+		t.Fatalf("wrong base64 listing: %s", b)
+	}
+	if b := doGetPath(t, s.URL(), "/key/bin?encoding=hex"); b != "" {
+		t.Fatalf("unsupported encoding returned %s", b)
+	}
+}
+
+// Test_GroupCommit tests that concurrent writes each get the result of their
+// own operation.
+func Test_GroupCommit(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	const n = 50
+	var wg sync.WaitGroup
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Post(s.URL()+"/key", "application/json", strings.NewReader(fmt.Sprintf(`{"k%d":"v%d"}`, i, i)))
+			if err != nil {
+				t.Errorf("POST request failed: %s", err)
+				return
+			}
+			resp.Body.Close()
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", s.URL()+"/key", strings.NewReader(fmt.Sprintf(`{"once":"v%d"}`, i)))
+			req.Header.Set("If-None-Match", "*")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("POST request failed: %s", err)
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			created++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Fatalf("create-only write returned %d", code)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("key once was created %d times", created)
+	}
+	for i := 0; i < n; i++ {
+		if v, _ := st.Get(fmt.Sprintf("k%d", i)); string(v) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("wrong value for key k%d: %q", i, v)
+		}
+	}
+}
+
+// Test_GroupCommitEntries tests that the writes queued while a proposal is in
+// flight share one log entry, and that a lone write is proposed on its own.
+func Test_GroupCommitEntries(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.raft.GetRaft().Barrier(0).Error(); err != nil {
+		t.Fatalf("failed to wait for the leader's entries: %s", err)
+	}
+	first := s.raft.GetRaft().LastIndex()
+
+	// The writes are queued before the service starts committing them, as
+	// they would be while a proposal is in flight.
+	const n = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.Set("", fmt.Sprintf("k%d", i), []byte("v"), 0, 0)
+			errs <- err
+		}(i)
+	}
+	for len(s.proposals) < n {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("queued write failed: %s", err)
+		}
+	}
+	if entries := s.raft.GetRaft().LastIndex() - first; entries != 1 {
+		t.Fatalf("%d queued writes took %d log entries", n, entries)
+	}
+
+	if _, err := s.Set("", "lone", []byte("v"), 0, 0); err != nil {
+		t.Fatalf("lone write failed: %s", err)
+	}
+	if entries := s.raft.GetRaft().LastIndex() - first; entries != 2 {
+		t.Fatalf("lone write took %d log entries", entries-1)
+	}
+}
+
+// Test_Namespaces tests the namespace endpoints, and that keys are served
+// per namespace under /ns/{ns}.
+func Test_Namespaces(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	do := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, s.URL()+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %s", method, err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, _ := do("GET", "/ns/t1/key/k", ""); code != http.StatusNotFound {
+		t.Fatalf("read in missing namespace returned %d", code)
+	}
+	if code, _ := do("POST", "/ns/t1/key/k", "v"); code != http.StatusNotFound {
+		t.Fatalf("write in missing namespace returned %d", code)
+	}
+	if code, b := do("PUT", "/ns/t1", `{"max_keys":1}`); code != http.StatusOK || !strings.Contains(b, `"ns":"t1"`) {
+		t.Fatalf("failed to create namespace: %d %s", code, b)
+	}
+	if code, _ := do("PUT", "/ns/t2", ""); code != http.StatusOK {
+		t.Fatalf("failed to create namespace without quota: %d", code)
+	}
+
+	doPost(t, s.URL(), "k", "default")
+	if code, b := do("POST", "/ns/t1/key/k", "t1"); code != http.StatusOK || !strings.Contains(b, `"ns":"t1"`) {
+		t.Fatalf("failed to write in namespace: %d %s", code, b)
+	}
+	if code, b := do("POST", "/ns/t1/key/k2", "t1"); code != http.StatusRequestEntityTooLarge || !strings.Contains(b, `"code":"quota"`) {
+		t.Fatalf("write over quota returned %d %s", code, b)
+	}
+	if code, _ := do("POST", "/ns/t2/txn", `{"ops":[{"op":"set","key":"k","value":"t2"}]}`); code != http.StatusOK {
+		t.Fatalf("txn in namespace returned %d", code)
+	}
+
+	for path, want := range map[string]string{
+		"/key/k":       `{"k":"default"}`,
+		"/ns/t1/key/k": `{"k":"t1"}`,
+		"/ns/t2/key/k": `{"k":"t2"}`,
+		"/ns/t1/keys":  `{"kvs":[{"key":"k","value":"t1"}]}`,
+		"/ns/t1":       `{"name":"t1","max_keys":1,"keys":1,"bytes":3}`,
+	} {
+		if b := doGetPath(t, s.URL(), path); b != want {
+			t.Fatalf("wrong response for %s: %s", path, b)
+		}
+	}
+	if b := doGetPath(t, s.URL(), "/ns"); !strings.Contains(b, `"name":"t1"`) || !strings.Contains(b, `"name":"t2"`) {
+		t.Fatalf("wrong namespaces listed: %s", b)
+	}
+
+	if code, _ := do("DELETE", "/ns/t1", ""); code != http.StatusOK {
+		t.Fatalf("failed to delete namespace: %d", code)
+	}
+	if code, _ := do("GET", "/ns/t1", ""); code != http.StatusNotFound {
+		t.Fatalf("deleted namespace returned %d", code)
+	}
+	if b := doGet(t, s.URL(), "k"); b != `{"k":"default"}` {
+		t.Fatalf("deleting a namespace changed the default one: %s", b)
+	}
+
+	// A store without namespaces.
+	ts := newTestStore()
+	s2 := &testServer{New(":0", ts, newTestRaft(t, ts))}
+	if err := s2.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s2.Close()
+	resp, err := http.Get(s2.URL() + "/ns/t1/key/k")
+	if err != nil {
+		t.Fatalf("GET request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("namespace read from store without namespaces returned %d", resp.StatusCode)
+	}
+}
+
+// Test_Limits tests that writes exceeding the limits are rejected with 413
+// before being proposed, and counted in /debug/vars.
+func Test_Limits(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	s.SetLimits(command.Limits{MaxKeyBytes: 8, MaxValueBytes: 16, MaxStoreBytes: 40}, 64)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post(s.URL()+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST request failed: %s", err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	first := st.AppliedIndex()
+	for path, body := range map[string]string{
+		"/key/k":          strings.Repeat("v", 17),
+		"/key/long-key-1": "v",
+		"/key":            `{"k1": "v", "k2": "` + strings.Repeat("v", 17) + `"}`,
+		"/txn":            `{"ops": [{"op": "set", "key": "k", "value": "` + strings.Repeat("v", 60) + `"}]}`,
+	} {
+		if code, b := post(path, body); code != http.StatusRequestEntityTooLarge || !strings.Contains(b, `"code":"quota"`) {
+			t.Fatalf("write to %s over the limits returned %d %s", path, code, b)
+		}
+	}
+	if st.AppliedIndex() != first {
+		t.Fatalf("writes over the limits were proposed")
+	}
+	if code, _ := post("/key/k", strings.Repeat("v", 16)); code != http.StatusOK {
+		t.Fatalf("write within the limits returned %d", code)
+	}
+	if code, _ := post("/key/k2", strings.Repeat("v", 16)); code != http.StatusOK {
+		t.Fatalf("write within the store size returned %d", code)
+	}
+	first = st.AppliedIndex()
+	if code, b := post("/key/k3", strings.Repeat("v", 16)); code != http.StatusRequestEntityTooLarge || !strings.Contains(b, `"limit":"store_size"`) {
+		t.Fatalf("write over the store size returned %d %s", code, b)
+	}
+	if st.AppliedIndex() != first {
+		t.Fatalf("write over the store size was proposed")
+	}
+	// Overwrites that do not grow the store are accepted.
+	if code, _ := post("/key/k2", strings.Repeat("v", 16)); code != http.StatusOK {
+		t.Fatalf("overwrite within the store size returned %d", code)
+	}
+
+	var vars struct {
+		RejectedWrites map[string]int64 `json:"rejected_writes"`
+	}
+	if err := json.Unmarshal([]byte(doGetPath(t, s.URL(), "/debug/vars")), &vars); err != nil {
+		t.Fatalf("failed to decode /debug/vars: %s", err)
+	}
+	for _, limit := range []string{command.LimitKeySize, command.LimitValueSize, command.LimitStoreSize, command.LimitRequestSize} {
+		if vars.RejectedWrites[limit] == 0 {
+			t.Fatalf("no rejected writes counted for %s: %v", limit, vars.RejectedWrites)
+		}
+	}
+}
+
+// Test_PatchLimits tests that the leader rejects patches whose document would
+// exceed the value size limit, or take the store over its size, although
+// each patch is small.
+func Test_PatchLimits(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	s.SetLimits(command.Limits{MaxValueBytes: 48, MaxStoreBytes: 80}, 0)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	grow := func(key string) (int, string) {
+		doPost(t, s.URL(), key, "{}")
+		for i := 0; i < 100; i++ {
+			req, _ := http.NewRequest("PATCH", s.URL()+"/key/"+key, strings.NewReader(fmt.Sprintf(`{"k%d": %d}`, i, i)))
+			req.Header.Set("Content-Type", "application/merge-patch+json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("PATCH request failed: %s", err)
+			}
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return resp.StatusCode, string(b)
+			}
+		}
+		return http.StatusOK, ""
+	}
+	if code, b := grow("a"); code != http.StatusRequestEntityTooLarge || !strings.Contains(b, `"limit":"value_size"`) {
+		t.Fatalf("growing document was rejected with %d %s", code, b)
+	}
+	if v, _ := st.Get("a"); len(v) > 48 {
+		t.Fatalf("document grew to %d bytes", len(v))
+	}
+	if code, b := grow("b"); code != http.StatusRequestEntityTooLarge || !strings.Contains(b, `"limit":"store_size"`) {
+		t.Fatalf("document growing the store was rejected with %d %s", code, b)
+	}
+	if _, bytes := st.Size(); bytes > 80 {
+		t.Fatalf("store grew to %d bytes", bytes)
+	}
+}
+
+// Test_BackupRestore tests that a dump taken from one cluster restores every
+// namespace and key into another, and that a truncated dump is refused.
+func Test_BackupRestore(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	req, _ := http.NewRequest("PUT", s.URL()+"/ns/t1", strings.NewReader(`{"max_keys":10}`))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to create namespace: %v", err)
+	}
+	doPost(t, s.URL(), "k1", "v1")
+	doPost(t, s.URL(), "k2", "v2")
+	resp, err := http.Post(s.URL()+"/ns/t1/key/k", "application/octet-stream", bytes.NewReader([]byte{0, 0xff}))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(s.URL() + "/backup")
+	if err != nil {
+		t.Fatalf("GET request failed: %s", err)
+	}
+	dump, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong backup response: %d", resp.StatusCode)
+	}
+	if dr, err := command.NewDumpReader(bytes.NewReader(dump)); err != nil || dr.Index != st.AppliedIndex() {
+		t.Fatalf("backup of the state at %d has header %+v, %v", st.AppliedIndex(), dr, err)
+	}
+
+	st2 := store.NewStore(true)
+	s2 := &testServer{New(":0", st2, newTestRaft(t, st2))}
+	if err := s2.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s2.Close()
+	doPost(t, s2.URL(), "k1", "old")
+	doPost(t, s2.URL(), "k3", "kept")
+
+	restore := func(body []byte) (int, string) {
+		resp, err := http.Post(s2.URL()+"/restore", "application/x-ndjson", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST request failed: %s", err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	lines := bytes.SplitAfter(dump, []byte("\n"))
+	if code, b := restore(bytes.Join(lines[:len(lines)-2], nil)); code != http.StatusBadRequest || !strings.Contains(b, "truncated") {
+		t.Fatalf("restore of truncated dump returned %d %s", code, b)
+	}
+	code, b := restore(dump)
+	if code != http.StatusOK || !strings.Contains(b, `"restored":4`) {
+		t.Fatalf("restore failed: %d %s", code, b)
+	}
+
+	for path, want := range map[string]string{
+		"/key/k1": `{"k1":"v1"}`,
+		"/key/k2": `{"k2":"v2"}`,
+		"/key/k3": `{"k3":"kept"}`,
+		"/ns/t1":  `{"name":"t1","max_keys":10,"keys":1,"bytes":3}`,
+	} {
+		if b := doGetPath(t, s2.URL(), path); b != want {
+			t.Fatalf("wrong response for %s after restore: %s", path, b)
+		}
+	}
+	rd, _ := st2.Namespace("t1")
+	if v, _ := rd.Get("k"); !bytes.Equal(v, []byte{0, 0xff}) {
+		t.Fatalf("wrong binary value after restore: %q", v)
+	}
+}
+
+// Test_Locks tests that a lock is held by one holder at a time, that a
+// blocking acquire gets it once it is released, and that the fencing token
+// grows with every new lease.
+func Test_Locks(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	type lease struct {
+		Holder string `json:"holder"`
+		Token  uint64 `json:"token"`
+		TTL    int64  `json:"ttl"`
+	}
+	do := func(method, path string) (int, lease) {
+		req, _ := http.NewRequest(method, s.URL()+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("%s request failed: %s", method, err)
+			return 0, lease{}
+		}
+		defer resp.Body.Close()
+		var l lease
+		json.NewDecoder(resp.Body).Decode(&l)
+		return resp.StatusCode, l
+	}
+
+	code, a := do("POST", "/lock/renew-certs?holder=gw1&ttl=30")
+	if code != http.StatusOK || a.Holder != "gw1" || a.Token == 0 || a.TTL != 30 {
+		t.Fatalf("failed to acquire lock: %d %+v", code, a)
+	}
+	if code, _ := do("POST", "/lock/renew-certs?holder=gw2"); code != http.StatusPreconditionFailed {
+		t.Fatalf("acquire of held lock returned %d", code)
+	}
+	if code, l := do("GET", "/lock/renew-certs"); code != http.StatusOK || l.Holder != "gw1" || l.Token != a.Token {
+		t.Fatalf("wrong lock holder: %d %+v", code, l)
+	}
+	if code, l := do("PUT", fmt.Sprintf("/lock/renew-certs?token=%d&ttl=60", a.Token)); code != http.StatusOK || l.Token != a.Token || l.TTL != 60 {
+		t.Fatalf("failed to renew lock: %d %+v", code, l)
+	}
+	if code, _ := do("DELETE", fmt.Sprintf("/lock/renew-certs?token=%d", a.Token+1)); code != http.StatusPreconditionFailed {
+		t.Fatalf("release with wrong token returned %d", code)
+	}
+
+	// A blocking acquire gets the lock once it is released.
+	got := make(chan lease)
+	go func() {
+		code, l := do("POST", "/lock/renew-certs?holder=gw2&wait=10s")
+		if code != http.StatusOK {
+			t.Errorf("blocking acquire returned %d", code)
+		}
+		got <- l
+	}()
+	time.Sleep(300 * time.Millisecond)
+	if code, _ := do("DELETE", fmt.Sprintf("/lock/renew-certs?token=%d", a.Token)); code != http.StatusOK {
+		t.Fatalf("failed to release lock: %d", code)
+	}
+	select {
+	case b := <-got:
+		if b.Holder != "gw2" || b.Token <= a.Token {
+			t.Fatalf("wrong lease after blocking acquire: %+v", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("blocking acquire did not get the released lock")
+	}
+
+	// The leader releases leases that lapse.
+	if code, _ := do("POST", "/lock/short?holder=gw1&ttl=1"); code != http.StatusOK {
+		t.Fatalf("failed to acquire lock: %d", code)
+	}
+	for i := 0; ; i++ {
+		if code, _ := do("GET", "/lock/short"); code == http.StatusNotFound {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("lapsed lease was not released")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Test_Counters tests that concurrent increments are all counted, that
+// bounds are enforced, and that sequence blocks never overlap.
+func Test_Counters(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	post := func(path string, v interface{}) int {
+		resp, err := http.Post(s.URL()+path, "", nil)
+		if err != nil {
+			t.Errorf("POST request failed: %s", err)
+			return 0
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			json.NewDecoder(resp.Body).Decode(v)
+		}
+		return resp.StatusCode
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := post("/incr/hits?delta=2", nil); code != http.StatusOK {
+				t.Errorf("incr returned %d", code)
+			}
+		}()
+	}
+	wg.Wait()
+	if b := doGet(t, s.URL(), "hits"); b != `{"hits":"40"}` {
+		t.Fatalf("wrong counter value: %s", b)
+	}
+	var res struct {
+		Value int64 `json:"value"`
+	}
+	if code := post("/decr/hits?delta=40&min=0", &res); code != http.StatusOK || res.Value != 0 {
+		t.Fatalf("decr returned %d %+v", code, res)
+	}
+	if code := post("/decr/hits?min=0", nil); code != http.StatusPreconditionFailed {
+		t.Fatalf("decr under min returned %d", code)
+	}
+	if code := post("/incr/hits?delta=x", nil); code != http.StatusBadRequest {
+		t.Fatalf("incr with invalid delta returned %d", code)
+	}
+
+	type block struct {
+		First int64 `json:"first"`
+		Last  int64 `json:"last"`
+	}
+	blocks := make([]block, 10)
+	for i := range blocks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if code := post("/seq/ids?count=100", &blocks[i]); code != http.StatusOK {
+				t.Errorf("sequence allocation returned %d", code)
+			}
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[int64]bool)
+	for _, b := range blocks {
+		if b.Last-b.First != 99 || b.First < 1 {
+			t.Fatalf("wrong block allocated: %+v", b)
+		}
+		if seen[b.First] {
+			t.Fatalf("block allocated twice: %+v", b)
+		}
+		seen[b.First] = true
+		if (b.First-1)%100 != 0 || b.Last > 1000 {
+			t.Fatalf("blocks overlap: %+v", blocks)
+		}
+	}
+}
+
+// Test_Sessions tests that keys written with a session are deleted when it
+// ends, and that the leader ends sessions that are not kept alive.
+func Test_Sessions(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	type session struct {
+		ID   uint64 `json:"id"`
+		Node string `json:"node"`
+		TTL  int64  `json:"ttl"`
+		Left int64  `json:"left"`
+		Keys int    `json:"keys"`
+	}
+	do := func(method, path, body string) (int, session) {
+		req, _ := http.NewRequest(method, s.URL()+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("%s request failed: %s", method, err)
+			return 0, session{}
+		}
+		defer resp.Body.Close()
+		var ss session
+		json.NewDecoder(resp.Body).Decode(&ss)
+		return resp.StatusCode, ss
+	}
+
+	if code, _ := do("POST", "/session?node=node9", ""); code != http.StatusBadRequest {
+		t.Fatalf("session for unknown node returned %d", code)
+	}
+	code, a := do("POST", "/session?node=node0&ttl=30", "")
+	if code != http.StatusOK || a.ID == 0 || a.Node != "node0" || a.TTL != 30 || a.Left != 30 {
+		t.Fatalf("failed to create session: %d %+v", code, a)
+	}
+	if code, _ := do("POST", fmt.Sprintf("/key/gw1?session=%d", a.ID), "10.0.0.1"); code != http.StatusOK {
+		t.Fatalf("failed to set key with session: %d", code)
+	}
+	if code, _ := do("POST", fmt.Sprintf("/key?session=%d", a.ID), `{"gw2": "10.0.0.2", "gw3": "10.0.0.3"}`); code != http.StatusOK {
+		t.Fatalf("failed to set keys with session: %d", code)
+	}
+	if code, _ := do("POST", "/key/gw4?session=999999", "x"); code != http.StatusNotFound {
+		t.Fatalf("set with unknown session returned %d", code)
+	}
+	if code, ss := do("PUT", fmt.Sprintf("/session/%d", a.ID), ""); code != http.StatusOK || ss.Left != 30 || ss.Keys != 3 {
+		t.Fatalf("failed to renew session: %d %+v", code, ss)
+	}
+	doPost(t, s.URL(), "static", "v")
+	if code, _ := do("DELETE", fmt.Sprintf("/session/%d", a.ID), ""); code != http.StatusOK {
+		t.Fatalf("failed to destroy session: %d", code)
+	}
+	if code, _ := do("GET", fmt.Sprintf("/session/%d", a.ID), ""); code != http.StatusNotFound {
+		t.Fatalf("destroyed session returned %d", code)
+	}
+	if v := doGet(t, s.URL(), "gw1"); v != `{"gw1":""}` {
+		t.Fatalf("key of destroyed session exists: %s", v)
+	}
+	if v := doGet(t, s.URL(), "static"); v != `{"static":"v"}` {
+		t.Fatalf("key without session deleted: %s", v)
+	}
+
+	// The leader ends sessions whose heartbeats stop, with their keys.
+	_, b := do("POST", "/session?ttl=1", "")
+	do("POST", fmt.Sprintf("/key/gw5?session=%d", b.ID), "x")
+	for i := 0; ; i++ {
+		if code, _ := do("GET", fmt.Sprintf("/session/%d", b.ID), ""); code == http.StatusNotFound {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("lapsed session was not ended")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if v := doGet(t, s.URL(), "gw5"); v != `{"gw5":""}` {
+		t.Fatalf("key of lapsed session exists: %s", v)
+	}
+}
+
+// Test_Documents tests that JSON documents are patched in place and read by
+// path.
+func Test_Documents(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	do := func(method, path, contentType, body string) (int, string) {
+		req, _ := http.NewRequest(method, s.URL()+path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("%s request failed: %s", method, err)
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	do("POST", "/key/route-api", "", `{"host": "api.example.com", "servers": [{"addr": "10.0.0.1:80", "weight": 1}]}`)
+	code, body := do("PATCH", "/key/route-api", "application/merge-patch+json", `{"timeout": "5s"}`)
+	if code != http.StatusOK || !strings.Contains(body, `"value":{"host":"api.example.com","servers":[{"addr":"10.0.0.1:80","weight":1}],"timeout":"5s"}`) {
+		t.Fatalf("failed to merge patch: %d %s", code, body)
+	}
+	code, body = do("PATCH", "/key/route-api", "application/json-patch+json", `[{"op": "replace", "path": "/servers/0/weight", "value": 3}]`)
+	if code != http.StatusOK {
+		t.Fatalf("failed to JSON patch: %d %s", code, body)
+	}
+	if code, body := do("GET", "/key/route-api?path=servers.0.weight", "", ""); code != http.StatusOK || body != "3" {
+		t.Fatalf("wrong value at path: %d %s", code, body)
+	}
+	if code, body := do("GET", "/key/route-api?path=/servers/0", "", ""); code != http.StatusOK || body != `{"addr":"10.0.0.1:80","weight":3}` {
+		t.Fatalf("wrong value at pointer: %d %s", code, body)
+	}
+	if code, _ := do("GET", "/key/route-api?path=servers.5", "", ""); code != http.StatusNotFound {
+		t.Fatalf("missing path returned %d", code)
+	}
+
+	for _, tt := range []struct {
+		contentType, patch string
+		code               int
+	}{
+		{"application/json", `{"a": 1}`, http.StatusUnsupportedMediaType},
+		{"application/merge-patch+json", `{"a": `, http.StatusBadRequest},
+		{"application/json-patch+json", `[{"op": "remove", "path": "/missing"}]`, http.StatusBadRequest},
+		{"application/json-patch+json", `[{"op": "test", "path": "/host", "value": "www.example.com"}]`, http.StatusPreconditionFailed},
+	} {
+		if code, body := do("PATCH", "/key/route-api", tt.contentType, tt.patch); code != tt.code {
+			t.Fatalf("PATCH %s %s returned %d %s, want %d", tt.contentType, tt.patch, code, body, tt.code)
+		}
+	}
+	do("POST", "/key/plain", "", "not json")
+	if code, _ := do("PATCH", "/key/plain", "application/merge-patch+json", `{"a": 1}`); code != http.StatusBadRequest {
+		t.Fatalf("patch of non-JSON value returned %d", code)
+	}
+}
+
+// Test_Search tests that keys are searched by glob, key and value regular
+// expressions, within a limit.
+func Test_Search(t *testing.T) {
+	st := store.NewStore(true)
+	s := &testServer{New(":0", st, newTestRaft(t, st))}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	for k, v := range map[string]string{
+		"api-eu/health":   "ok",
+		"api-us/health":   "down",
+		"api-us/addr":     "10.0.0.5:80",
+		"web-eu/health":   "ok",
+		"web-eu/a/health": "ok",
+	} {
+		doPost(t, s.URL(), k, v)
+	}
+	search := func(query string) (int, []string, bool) {
+		resp, err := http.Get(s.URL() + "/search?" + query)
+		if err != nil {
+			t.Fatalf("search failed: %s", err)
+		}
+		defer resp.Body.Close()
+		var res struct {
+			KVs       []kv `json:"kvs"`
+			Truncated bool `json:"truncated"`
+		}
+		json.NewDecoder(resp.Body).Decode(&res)
+		var keys []string
+		for _, kv := range res.KVs {
+			keys = append(keys, kv.Key)
+		}
+		return resp.StatusCode, keys, res.Truncated
+	}
+
+	for _, tt := range []struct {
+		query     string
+		keys      []string
+		truncated bool
+	}{
+		{"glob=*/health", []string{"api-eu/health", "api-us/health", "web-eu/a/health", "web-eu/health"}, false},
+		{"glob=web-eu/?/health", []string{"web-eu/a/health"}, false},
+		{"glob=" + url.QueryEscape("[^w]*-??/health"), []string{"api-eu/health", "api-us/health"}, false},
+		{"glob=api-*/health&value=^ok$", []string{"api-eu/health"}, false},
+		{"regex=^web-.*health$", []string{"web-eu/a/health", "web-eu/health"}, false},
+		{"value=" + url.QueryEscape(`10\.0\.0\.5`), []string{"api-us/addr"}, false},
+		{"glob=*/health&limit=3", []string{"api-eu/health", "api-us/health", "web-eu/a/health"}, true},
+		{"glob=api-*&prefix=web-", nil, false},
+	} {
+		code, keys, truncated := search(tt.query)
+		if code != http.StatusOK || !reflect.DeepEqual(keys, tt.keys) || truncated != tt.truncated {
+			t.Fatalf("search %s returned %d %v %v, want %v %v", tt.query, code, keys, truncated, tt.keys, tt.truncated)
+		}
+	}
+	for _, query := range []string{"", "glob=[", "glob=[]", "glob=" + url.QueryEscape(`a\`), "glob=[z-a]", "regex=(", "glob=*&timeout=x"} {
+		if code, _, _ := search(query); code != http.StatusBadRequest {
+			t.Fatalf("search %s returned %d", query, code)
+		}
+	}
+}
+
 type testServer struct {
 	*Service
 }
@@ -58,8 +1154,11 @@ func (t *testServer) URL() string {
 	return fmt.Sprintf("http://127.0.0.1:%s", port)
 }
 
+// testStore is a minimal raftnode.StateMachine, standing in for a
+// user-supplied backend.
 type testStore struct {
-	m map[string]string
+	mu sync.Mutex
+	m  map[string]string
 }
 
 func newTestStore() *testStore {
@@ -68,21 +1167,63 @@ func newTestStore() *testStore {
 	}
 }
 
-func (t *testStore) Get(key string) (string, error) {
-	return t.m[key], nil
+func (t *testStore) Get(key string) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.m[key]
+	if !ok {
+		return nil, nil
+	}
+	return []byte(v), nil
 }
 
-func (t *testStore) Set(key, value string) error {
-	t.m[key] = value
+func (t *testStore) FsmApply(l *raft.Log) interface{} {
+	c, err := command.Decode(l.Data)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch c.Op {
+	case command.OpSet:
+		t.m[c.Key] = string(c.Value)
+	case command.OpDelete:
+		delete(t.m, c.Key)
+	}
 	return nil
 }
 
-func (t *testStore) Delete(key string) error {
-	delete(t.m, key)
-	return nil
+func (t *testStore) FsmSnapshot() (raft.FSMSnapshot, error) {
+	return nil, fmt.Errorf("snapshots not supported")
 }
 
-func (t *testStore) Join(nodeID, addr string) error {
+func (t *testStore) FsmRestore(rc io.ReadCloser) error {
+	return fmt.Errorf("restore not supported")
+}
+
+// newTestRaft opens a single-node cluster over sm and waits until it leads.
+func newTestRaft(t *testing.T, sm raftnode.StateMachine) *raftnode.RaftNode {
+	tmpDir, err := ioutil.TempDir("", "httpd_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	rn := raftnode.New(raftnode.NewRaftFsm(sm))
+	rn.RaftDir = tmpDir
+	rn.RaftBind = "127.0.0.1:0"
+	if err := rn.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open raft node: %s", err)
+	}
+	t.Cleanup(func() { rn.GetRaft().Shutdown().Error() })
+
+	for i := 0; i < 100; i++ {
+		if rn.GetRaftState() == raft.Leader.String() {
+			return rn
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("raft node did not become leader")
 	return nil
 }
 
@@ -99,6 +1240,19 @@ func doGet(t *testing.T, url, key string) string {
 	return string(body)
 }
 
+func doGetPath(t *testing.T, url, path string) string {
+	resp, err := http.Get(url + path)
+	if err != nil {
+		t.Fatalf("failed to GET %s: %s", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	return string(body)
+}
+
 func doPost(t *testing.T, url, key, value string) {
 	b, err := json.Marshal(map[string]string{key: value})
 	if err != nil {
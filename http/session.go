@@ -0,0 +1,228 @@
+package httpd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/raftnode"
+)
+
+// defaultSessionTTL is the lease of a session created without a ttl.
+const defaultSessionTTL = 15 * time.Second
+
+// sessionInfo is a raftnode.SessionInfo, or the result of a session command,
+// in a /session response. Left is the seconds the lease has left, rounded up.
+type sessionInfo struct {
+	ID    uint64 `json:"id"`
+	Node  string `json:"node,omitempty"`
+	TTL   int64  `json:"ttl,omitempty"`
+	Left  int64  `json:"left"`
+	Keys  int    `json:"keys"`
+	Index uint64 `json:"index,omitempty"`
+}
+
+func newSessionInfo(si raftnode.SessionInfo) sessionInfo {
+	out := sessionInfo{ID: si.ID, Node: si.Node, TTL: si.TTL, Keys: si.Keys}
+	if d := time.Duration(si.Expires - time.Now().UnixNano()); d > 0 {
+		out.Left = int64((d + time.Second - 1) / time.Second)
+	}
+	return out
+}
+
+// handleSessionsRequest lists every session.
+func (s *Service) handleSessionsRequest(w http.ResponseWriter, r *http.Request) {
+	sr, ok := s.store.(raftnode.Sessioner)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	out := []sessionInfo{}
+	for _, si := range sr.Sessions() {
+		out = append(out, newSessionInfo(si))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleSessionRequest returns a session (GET), creates one (POST, with
+// optionally ttl in seconds and node, the ID of the raft server the session
+// is bound to), sends a heartbeat extending its lease (PUT, with optionally a
+// new ttl) or ends it (DELETE). A session that ended, or whose lease lapsed,
+// is answered with 404. When a session ends, the keys written with it are
+// deleted.
+func (s *Service) handleSessionRequest(w http.ResponseWriter, r *http.Request) {
+	sr, ok := s.store.(raftnode.Sessioner)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	var id uint64
+	if r.Method != "POST" {
+		var err error
+		if id, err = strconv.ParseUint(chi.URLParam(r, "id"), 10, 64); err != nil || id == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.Method == "GET" {
+		si, ok := sr.Session(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, newSessionInfo(si))
+		return
+	}
+
+	if s.raft.GetRaftState() != raft.Leader.String() {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	var ttl time.Duration
+	if t := q.Get("ttl"); t != "" {
+		secs, err := strconv.ParseInt(t, 10, 64)
+		if err != nil || secs <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+
+	var res *command.Result
+	var err error
+	switch r.Method {
+	case "POST":
+		node := q.Get("node")
+		if node != "" {
+			servers, cerr := s.servers()
+			if cerr != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !servers[raft.ServerID(node)] {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if ttl == 0 {
+			ttl = defaultSessionTTL
+		}
+		res, err = s.CreateSession(node, ttl)
+	case "PUT":
+		if ttl == 0 {
+			si, ok := sr.Session(id)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			ttl = time.Duration(si.TTL) * time.Second
+		}
+		res, err = s.RenewSession(id, ttl)
+	case "DELETE":
+		res, err = s.DestroySession(id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if res == nil {
+		return
+	}
+	si, _ := sr.Session(res.Session)
+	si.ID, si.Expires = res.Session, res.Expires
+	out := newSessionInfo(si)
+	out.Index = res.Index
+	writeJSON(w, http.StatusOK, out)
+}
+
+// servers returns the IDs of the servers in the raft configuration.
+func (s *Service) servers() (map[raft.ServerID]bool, error) {
+	f := s.raft.GetRaft().GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	ids := make(map[raft.ServerID]bool)
+	for _, srv := range f.Configuration().Servers {
+		ids[srv.ID] = true
+	}
+	return ids, nil
+}
+
+// CreateSession creates a session with a lease of ttl, bound to raft server
+// node if not empty, and returns it, its ID in Session. The session ends if
+// it is not renewed within its lease, or once node leaves the cluster.
+func (s *Service) CreateSession(node string, ttl time.Duration) (*command.Result, error) {
+	return s.applyCommand(&command.Command{
+		Op:      command.OpCreateSession,
+		Node:    node,
+		TTL:     int64(ttl / time.Second),
+		Expires: time.Now().Add(ttl).UnixNano(),
+	})
+}
+
+// RenewSession extends the lease of session id to ttl from now.
+func (s *Service) RenewSession(id uint64, ttl time.Duration) (*command.Result, error) {
+	return s.applyCommand(&command.Command{
+		Op:      command.OpRenewSession,
+		Session: id,
+		TTL:     int64(ttl / time.Second),
+		Expires: time.Now().Add(ttl).UnixNano(),
+	})
+}
+
+// DestroySession ends session id and deletes the keys attached to it.
+func (s *Service) DestroySession(id uint64) (*command.Result, error) {
+	return s.applyCommand(&command.Command{Op: command.OpDestroySession, Session: id})
+}
+
+// expireSessions runs for the lifetime of the service. While this node is the
+// leader it proposes the destruction of every session past its deadline, and
+// of every session bound to a server no longer in the raft configuration.
+func (s *Service) expireSessions() {
+	sr, ok := s.store.(raftnode.Sessioner)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if s.raft.GetRaftState() != raft.Leader.String() {
+			continue
+		}
+		for _, si := range sr.ExpiredSessions(time.Now().UnixNano(), expiryBatch) {
+			c := &command.Command{Op: command.OpDestroySession, Session: si.ID, Expires: si.Expires}
+			if _, err := s.apply(c); err != nil {
+				log.Error("failed to destroy expired session", "session", si.ID, "error", err)
+				break
+			}
+		}
+		servers, err := s.servers()
+		if err != nil {
+			log.Error("failed to get raft configuration", "error", err)
+			continue
+		}
+		for _, si := range sr.Sessions() {
+			if si.Node == "" || servers[raft.ServerID(si.Node)] {
+				continue
+			}
+			c := &command.Command{Op: command.OpDestroySession, Session: si.ID}
+			if _, err := s.apply(c); err != nil && command.ErrorCode(err) != command.CodeNotFound {
+				log.Error("failed to destroy session of removed node", "session", si.ID, "node", si.Node, "error", err)
+				break
+			}
+		}
+	}
+}
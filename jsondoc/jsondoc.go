@@ -0,0 +1,429 @@
+// Package jsondoc reads and patches values holding JSON documents: it looks
+// up the part of a document at a path, and applies JSON merge patches (RFC
+// 7386) and JSON patches (RFC 6902) to documents.
+//
+// Numbers are kept as they are written. Objects are written back with their
+// members sorted by name, so patching a document gives the same bytes on
+// every node.
+package jsondoc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNotDocument is returned for a value that is not a JSON document.
+	ErrNotDocument = errors.New("value is not a JSON document")
+
+	// ErrNotFound is returned for a path that leads nowhere in a document.
+	ErrNotFound = errors.New("path not found")
+
+	// ErrTestFailed is returned by Patch for a test operation that does not
+	// hold.
+	ErrTestFailed = errors.New("test operation failed")
+)
+
+// ParsePath splits path into the names of the members and the indexes of
+// the elements it goes through. A path starting with "/" is a JSON pointer
+// (RFC 6901); any other is dotted, like "servers.0.weight", and cannot go
+// through members whose name holds a dot. The empty path is the whole
+// document.
+func ParsePath(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if path[0] != '/' {
+		return strings.Split(path, "."), nil
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		if strings.Contains(strings.ReplaceAll(strings.ReplaceAll(t, "~0", ""), "~1", ""), "~") {
+			return nil, fmt.Errorf("invalid escape in JSON pointer %q", path)
+		}
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// Get returns the part of document doc at path.
+func Get(doc []byte, path string) ([]byte, error) {
+	p, err := ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := decode(doc)
+	if err != nil {
+		return nil, ErrNotDocument
+	}
+	if v, err = lookup(v, p); err != nil {
+		return nil, err
+	}
+	return encode(v)
+}
+
+// MergePatch returns document doc with the merge patch patch applied. An
+// empty doc, such as the value of a key that does not exist, is null.
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	v, err := decode(doc)
+	if err != nil {
+		return nil, ErrNotDocument
+	}
+	pv, err := decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid merge patch: %v", err)
+	}
+	return encode(merge(v, pv))
+}
+
+func merge(v, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+	}
+	for name, pv := range pm {
+		if pv == nil {
+			delete(m, name)
+		} else {
+			m[name] = merge(m[name], pv)
+		}
+	}
+	return m
+}
+
+// operation is an operation of a JSON patch.
+type operation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Patch returns document doc with the JSON patch patch applied: all of its
+// operations, or none if one of them fails. An empty doc is null. Its paths
+// are JSON pointers, or dotted paths as ParsePath reads them.
+func Patch(doc, patch []byte) ([]byte, error) {
+	v, err := decode(doc)
+	if err != nil {
+		return nil, ErrNotDocument
+	}
+	var ops []operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("invalid JSON patch: %v", err)
+	}
+	for i, op := range ops {
+		if v, err = apply(v, &op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s): %w", i, op.Op, err)
+		}
+	}
+	return encode(v)
+}
+
+// apply applies op to v and returns the resulting document.
+func apply(v interface{}, op *operation) (interface{}, error) {
+	if op.Path == nil {
+		return nil, errors.New("missing path")
+	}
+	path, err := ParsePath(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		if value, err = decode(op.Value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		if op.From == nil {
+			return nil, errors.New("missing from")
+		}
+		from, err := ParsePath(*op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = lookup(v, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			value = clone(value)
+			break
+		}
+		if len(from) < len(path) && equalPath(from, path[:len(from)]) {
+			return nil, fmt.Errorf("cannot move %s into itself", *op.From)
+		}
+		if v, err = remove(v, from); err != nil {
+			return nil, err
+		}
+	case "remove":
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return add(v, path, value)
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		if _, err := lookup(v, path); err != nil {
+			return nil, err
+		}
+		if v, err = remove(v, path); err != nil {
+			return nil, err
+		}
+		return add(v, path, value)
+	case "remove":
+		return remove(v, path)
+	}
+	cur, err := lookup(v, path)
+	if err != nil {
+		return nil, err
+	}
+	if !equal(cur, value) {
+		return nil, fmt.Errorf("%w: %s", ErrTestFailed, *op.Path)
+	}
+	return v, nil
+}
+
+// lookup returns the value at path p of v.
+func lookup(v interface{}, p []string) (interface{}, error) {
+	for i, t := range p {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = c[t]; !ok {
+				return nil, notFound(p[:i+1])
+			}
+		case []interface{}:
+			n, err := index(t, len(c)-1)
+			if err != nil {
+				return nil, notFound(p[:i+1])
+			}
+			v = c[n]
+		default:
+			return nil, notFound(p[:i+1])
+		}
+	}
+	return v, nil
+}
+
+// add returns v with value added at path p: the member of an object is set,
+// the value is inserted in an array at an index, or appended at "-". The
+// empty path replaces the whole document.
+func add(v interface{}, p []string, value interface{}) (interface{}, error) {
+	return update(v, p, func(c interface{}, t string) (interface{}, error) {
+		switch c := c.(type) {
+		case map[string]interface{}:
+			c[t] = value
+			return c, nil
+		case []interface{}:
+			n := len(c)
+			if t != "-" {
+				var err error
+				if n, err = index(t, len(c)); err != nil {
+					return nil, err
+				}
+			}
+			c = append(c, nil)
+			copy(c[n+1:], c[n:])
+			c[n] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot add to a %s", kind(c))
+	}, value)
+}
+
+// remove returns v without the value at path p, which must exist.
+func remove(v interface{}, p []string) (interface{}, error) {
+	if len(p) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return update(v, p, func(c interface{}, t string) (interface{}, error) {
+		switch c := c.(type) {
+		case map[string]interface{}:
+			if _, ok := c[t]; !ok {
+				return nil, notFound(p)
+			}
+			delete(c, t)
+			return c, nil
+		case []interface{}:
+			n, err := index(t, len(c)-1)
+			if err != nil {
+				return nil, notFound(p)
+			}
+			return append(c[:n], c[n+1:]...), nil
+		}
+		return nil, notFound(p)
+	}, nil)
+}
+
+// update returns v with fn applied to the container at path p but its last
+// token, and that token; fn returns the changed container. The empty path
+// makes root the whole document.
+func update(v interface{}, p []string, fn func(c interface{}, t string) (interface{}, error), root interface{}) (interface{}, error) {
+	if len(p) == 0 {
+		return root, nil
+	}
+	if len(p) == 1 {
+		return fn(v, p[0])
+	}
+	child, err := lookup(v, p[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = update(child, p[1:], fn, root); err != nil {
+		return nil, err
+	}
+	switch c := v.(type) {
+	case map[string]interface{}:
+		c[p[0]] = child
+	case []interface{}:
+		n, _ := index(p[0], len(c)-1)
+		c[n] = child
+	}
+	return v, nil
+}
+
+// index parses t as an array index, at most max.
+func index(t string, max int) (int, error) {
+	n, err := strconv.Atoi(t)
+	if err != nil || n < 0 || n > max || (len(t) > 1 && t[0] == '0') || t[0] == '+' {
+		return 0, fmt.Errorf("invalid array index %q", t)
+	}
+	return n, nil
+}
+
+func notFound(p []string) error {
+	return fmt.Errorf("%w: %s", ErrNotFound, strings.Join(p, "."))
+}
+
+func equalPath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// equal reports whether a and b are the same JSON value, numbers being
+// compared by value.
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, av := range a {
+			bv, ok := b[name]
+			if !ok || !equal(av, bv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		af, aerr := a.Float64()
+		bf, berr := b.Float64()
+		return aerr == nil && berr == nil && af == bf
+	}
+	return a == b
+}
+
+// clone returns a deep copy of v.
+func clone(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for name, mv := range v {
+			m[name] = clone(mv)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i := range v {
+			a[i] = clone(v[i])
+		}
+		return a
+	}
+	return v
+}
+
+func kind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "array"
+}
+
+// decode decodes the single JSON value b, empty being null.
+func decode(b []byte) (interface{}, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("data after JSON value")
+	}
+	return v, nil
+}
+
+// encode encodes v compactly, without escaping HTML characters.
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,102 @@
+package jsondoc
+
+import (
+	"errors"
+	"testing"
+)
+
+// upstream has its members sorted, as Get writes them back.
+const upstream = `{"a/b":{"~c":true},"name":"api","servers":[{"addr":"10.0.0.1:80","weight":5},{"addr":"10.0.0.2:80","weight":1e2}]}`
+
+// Test_Get tests that dotted paths and JSON pointers address members and
+// elements, and that numbers are returned as written.
+func Test_Get(t *testing.T) {
+	for _, tt := range []struct {
+		path, want string
+		err        error
+	}{
+		{"", upstream, nil},
+		{"name", `"api"`, nil},
+		{"servers.1.weight", `1e2`, nil},
+		{"/servers/0", `{"addr":"10.0.0.1:80","weight":5}`, nil},
+		{"/a~1b/~0c", `true`, nil},
+		{"servers.2", "", ErrNotFound},
+		{"servers.01", "", ErrNotFound},
+		{"name.first", "", ErrNotFound},
+		{"missing", "", ErrNotFound},
+	} {
+		got, err := Get([]byte(upstream), tt.path)
+		if !errors.Is(err, tt.err) || string(got) != tt.want {
+			t.Errorf("Get(%q) = %s, %v, want %s, %v", tt.path, got, err, tt.want, tt.err)
+		}
+	}
+	if _, err := Get([]byte("not json"), "a"); err != ErrNotDocument {
+		t.Fatalf("Get on a value that is not JSON returned %v", err)
+	}
+}
+
+// Test_MergePatch tests RFC 7386 merges, null removing members.
+func Test_MergePatch(t *testing.T) {
+	for _, tt := range []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`["a","b"]`, `{"a":"c"}`, `{"a":"c"}`},
+		{``, `{"a":{"b":1}}`, `{"a":{"b":1}}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"a":"<b>"}`, `{}`, `{"a":"<b>"}`},
+	} {
+		got, err := MergePatch([]byte(tt.doc), []byte(tt.patch))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("MergePatch(%s, %s) = %s, %v, want %s", tt.doc, tt.patch, got, err, tt.want)
+		}
+	}
+	if _, err := MergePatch([]byte(`{"a":1}`), []byte(`{"a":`)); err == nil {
+		t.Fatalf("invalid merge patch applied")
+	}
+}
+
+// Test_Patch tests RFC 6902 operations, and that a patch whose operation
+// fails changes nothing.
+func Test_Patch(t *testing.T) {
+	for _, tt := range []struct {
+		doc, patch, want string
+		err              error
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, nil},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, nil},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`, nil},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":1}]`, ``, nil},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, nil},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, nil},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, ``, ErrNotFound},
+		{`{"baz":"qux"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo"}`, nil},
+		{`{"baz":"qux"}`, `[{"op":"replace","path":"/bar","value":"boo"}]`, ``, ErrNotFound},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, nil},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar"}]`, ``, nil},
+		{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`, `{"baz":{"bar":2},"foo":{"bar":1}}`, nil},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`, nil},
+		{`{"baz":"qux"}`, `[{"op":"replace","path":"/baz","value":"x"},{"op":"test","path":"/baz","value":"qux"}]`, ``, ErrTestFailed},
+		{`{"servers":[{"weight":5}]}`, `[{"op":"replace","path":"servers.0.weight","value":10}]`, `{"servers":[{"weight":10}]}`, nil},
+		{``, `[{"op":"add","path":"","value":{"a":1}}]`, `{"a":1}`, nil},
+		{`{"a":1}`, `[{"op":"frob","path":"/a"}]`, ``, nil},
+		{`{"a":1}`, `[{"op":"add","path":"/b"}]`, ``, nil},
+	} {
+		got, err := Patch([]byte(tt.doc), []byte(tt.patch))
+		if tt.want == "" {
+			if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+				t.Errorf("Patch(%s, %s) = %s, %v, want error %v", tt.doc, tt.patch, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("Patch(%s, %s) = %s, %v, want %s", tt.doc, tt.patch, got, err, tt.want)
+		}
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 
+	"github.com/ifoxhz/raft-nginx/command"
 	httpd "github.com/ifoxhz/raft-nginx/http"
 	"github.com/ifoxhz/raft-nginx/raftnode"
 	"github.com/ifoxhz/raft-nginx/config"
@@ -31,6 +34,10 @@ var raftAddr string
 var joinAddr string
 var nodeID string
 var configFile string
+var snapshotCompression string
+var limits config.LimitsConfig
+var backupAddr string
+var restoreAddr string
 
 
 func init() {
@@ -40,16 +47,38 @@ func init() {
 	flag.StringVar(&joinAddr, "join", "", "Set join address, if any")
 	flag.StringVar(&nodeID, "id", "", "Node ID. If not set, same as Raft bind address")
 	flag.StringVar(&configFile, "config", "", "Configuration file")
+	flag.StringVar(&snapshotCompression, "snapshot-compression", "none", "Compression of snapshots: none, gzip or snappy")
+	flag.Int64Var(&limits.MaxKeyBytes, "max-key-bytes", 0, "Largest key accepted, in bytes, 0 for no limit")
+	flag.Int64Var(&limits.MaxValueBytes, "max-value-bytes", 0, "Largest value accepted, in bytes, 0 for no limit")
+	flag.Int64Var(&limits.MaxStoreBytes, "max-store-bytes", 0, "Most bytes of keys and values stored, 0 for no limit")
+	flag.Int64Var(&limits.MaxRequestBytes, "max-request-bytes", 0, "Largest write request body accepted, in bytes, 0 for no limit")
+	flag.StringVar(&backupAddr, "backup", "", "Write a dump of the keys served at this HTTP address to the file given instead of the raft path, - for stdout, and exit")
+	flag.StringVar(&restoreAddr, "restore", "", "Load the dump in the file given instead of the raft path, - for stdin, into the cluster at this HTTP address, and exit")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <raft-data-path> \n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -backup|-restore <http-addr> <dump-file> \n", os.Args[0])
 		flag.PrintDefaults()
 	}
 }
 
 func main() {
 	flag.Parse()
+
+	if backupAddr != "" || restoreAddr != "" {
+		var err error
+		if backupAddr != "" {
+			err = backup(backupAddr, flag.Arg(0))
+		} else {
+			err = restore(restoreAddr, flag.Arg(0))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	
-	var rfstore *store.Store 
+	var rfstore raftnode.StateMachine
 	var fsm   *raftnode.RaftFsm
 	var raftNode *raftnode.RaftNode
 	
@@ -63,7 +92,19 @@ func main() {
 			log.Info("Raft configuration loaded:", fmt.Sprintf("%+v", config)) 	
 		}
 
-		rfstore = store.NewStore(false)
+		storePath := config.Store.Path
+		if storePath == "" {
+			storePath = filepath.Join(config.RaftDir, "kv.db")
+		}
+		kv, err := openStore(config.Store.Inmem, storePath, config.Store.SnapshotCompression)
+		if err != nil {
+			log.Error("failed to open key-value store: %s", err.Error())
+			os.Exit(-1)
+		}
+		defer kv.Close()
+		limits = config.Limits
+
+		rfstore = kv
 		fsm   = raftnode.NewRaftFsm(rfstore)
 		raftNode = raftnode.New(fsm)
 
@@ -96,7 +137,14 @@ func main() {
 			os.Exit(-2)
 		}
 
-		rfstore = store.NewStore(inmem)
+		kv, err := openStore(inmem, filepath.Join(raftDir, "kv.db"), snapshotCompression)
+		if err != nil {
+			log.Error("failed to open key-value store: %s", err.Error())
+			os.Exit(-2)
+		}
+		defer kv.Close()
+
+		rfstore = kv
 		fsm   = raftnode.NewRaftFsm(rfstore)
 		raftNode = raftnode.New(fsm)
 
@@ -114,6 +162,7 @@ func main() {
 
 
 	h := httpd.New(httpAddr,rfstore,raftNode)
+	h.SetLimits(storeLimits(limits), limits.MaxRequestBytes)
 	if err := h.Start(); err != nil {
 		log.Error("failed to start HTTP service: %s", err.Error())
 		os.Exit(-2)
@@ -135,6 +184,107 @@ func main() {
 	log.Info("hraftd exiting")
 }
 
+// openStore returns an in-memory store if inmem is set, otherwise a store
+// persisted at path. Its snapshots are compressed as compression says.
+func openStore(inmem bool, path, compression string) (*store.Store, error) {
+	c, err := store.ParseCompression(compression)
+	if err != nil {
+		return nil, err
+	}
+	var st *store.Store
+	if inmem {
+		st = store.NewStore(true)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if st, err = store.OpenStore(path); err != nil {
+			return nil, err
+		}
+	}
+	st.SetSnapshotCompression(c)
+	return st, nil
+}
+
+// storeLimits returns the limits on what commands write configured by l.
+func storeLimits(l config.LimitsConfig) command.Limits {
+	return command.Limits{
+		MaxKeyBytes:   l.MaxKeyBytes,
+		MaxValueBytes: l.MaxValueBytes,
+		MaxStoreBytes: l.MaxStoreBytes,
+	}
+}
+
+// backup writes the dump served by the leader at addr to path, - meaning
+// stdout. A dump cut short is left in place but reported as an error.
+func backup(addr, path string) error {
+	if path == "" {
+		return fmt.Errorf("no dump file specified")
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/backup", addr))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("backup from %s failed: %s %s", addr, resp.Status, b)
+	}
+
+	out := os.Stdout
+	if path != "-" {
+		if out, err = os.Create(path); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	// Check the dump while writing it, so a truncated one is reported.
+	dr, err := command.NewDumpReader(io.TeeReader(resp.Body, out))
+	if err != nil {
+		return err
+	}
+	n := 0
+	for ; ; n++ {
+		if _, err := dr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "dumped %d commands at index %d\n", n, dr.Index)
+	if out != os.Stdout {
+		return out.Sync()
+	}
+	return nil
+}
+
+// restore loads the dump at path, - meaning stdin, into the cluster whose
+// leader serves addr.
+func restore(addr, path string) error {
+	if path == "" {
+		return fmt.Errorf("no dump file specified")
+	}
+	in := os.Stdin
+	if path != "-" {
+		var err error
+		if in, err = os.Open(path); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	resp, err := http.Post(fmt.Sprintf("http://%s/restore", addr), "application/x-ndjson", in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("restore to %s failed: %s %s", addr, resp.Status, b)
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", b)
+	return nil
+}
+
 func join(joinAddr, raftAddr, nodeID string) error {
 	b, err := json.Marshal(map[string]string{"addr": raftAddr, "id": nodeID})
 	if err != nil {
@@ -1,26 +1,235 @@
 package raftnode
 import (
+	"errors"
 	"io"
 	"sync"
 	"time"
-	"fmt"
 	"github.com/hashicorp/raft"
 	"github.com/ifoxhz/raft-nginx/helper"
-	"github.com/ifoxhz/raft-nginx/store"
 )
 
+// StateMachine is the application state replicated by a RaftNode. RaftFsm
+// forwards the raft FSM callbacks to it, and the HTTP service reads from it,
+// so a backend other than the bundled map-based store.Store (RocksDB, say)
+// only has to implement this interface to be plugged in.
+type StateMachine interface {
+	// FsmApply applies a committed raft log entry. The returned value is
+	// made available to the caller through raft.ApplyFuture.Response().
+	FsmApply(l *raft.Log) interface{}
+
+	// FsmSnapshot returns a point-in-time snapshot of the state. Apply is
+	// not called concurrently with FsmSnapshot, but may be called while the
+	// returned snapshot is being persisted.
+	FsmSnapshot() (raft.FSMSnapshot, error)
+
+	// FsmRestore replaces the whole state with the content of a snapshot.
+	FsmRestore(rc io.ReadCloser) error
+
+	Reader
+}
+
+// Reader reads keys from the local state. The optional read interfaces below
+// are implemented on top of it.
+type Reader interface {
+	// Get returns the value stored for key, reading the local state only.
+	Get(key string) ([]byte, error)
+}
+
+// AppliedIndexer is implemented by state machines that track the index of the
+// last log entry they applied. A state machine that keeps its data on disk
+// reports that index right after a restart, which lets RaftNode skip
+// restoring a snapshot the state machine has already applied past.
+type AppliedIndexer interface {
+	AppliedIndex() uint64
+}
+
+// Sizer is implemented by state machines that track their size: the number
+// of keys they hold and the bytes of those keys and their values. The HTTP
+// service reports it, for operators to compare with the store size limit.
+type Sizer interface {
+	Size() (keys, bytes int64)
+}
+
+// Dumper is implemented by state machines that can write out their whole
+// state, which the HTTP service serves as a backup.
+type Dumper interface {
+	// Dump writes the state as of the last log entry applied to w, in the
+	// format of command.DumpWriter, and returns the index of that entry.
+	Dump(w io.Writer) (index uint64, err error)
+}
+
+// Revisioned is implemented by state machines that track, for every key, the
+// index of the log entry that last modified it. The HTTP service exposes it
+// as the key's ETag and accepts it in If-Match for conditional writes.
+type Revisioned interface {
+	// GetRevision returns the value of key and its modify index, 0 if the
+	// key does not exist.
+	GetRevision(key string) (value []byte, modIndex uint64, err error)
+}
+
+// ErrNotApplied is returned by a historical read of an index the state
+// machine has not applied yet.
+var ErrNotApplied = errors.New("index not applied yet")
+
+// Versioned is implemented by state machines that keep past versions of keys
+// for a window of log indexes. The HTTP service serves reads as of an index
+// and rolls keys back to them.
+type Versioned interface {
+	// GetAt returns the value of key as of the log entry at index, with the
+	// indexes of the entries that created and last modified it, both 0 if
+	// the key did not exist then. A zero index reads the current value.
+	// Indexes before the window fail with ErrCompacted, indexes after the
+	// applied one with ErrNotApplied.
+	GetAt(key string, index uint64) (value []byte, createIndex, modIndex uint64, err error)
+}
+
+// IsConflict reports whether v, an error or the response of an applied log
+// entry, means a conditional write was rejected because its precondition
+// did not hold. State machines mark such values with a Conflict method.
+func IsConflict(v interface{}) bool {
+	var c interface{ Conflict() bool }
+	if err, ok := v.(error); ok {
+		return errors.As(err, &c) && c.Conflict()
+	}
+	c, ok := v.(interface{ Conflict() bool })
+	return ok && c.Conflict()
+}
+
+// Ranger is implemented by state machines that can iterate over their keys
+// in order, which the HTTP service uses for prefix and range listings.
+type Ranger interface {
+	// Range calls fn, in key order, for every key in [start, end) that has
+	// prefix, until fn returns false. An empty end means no upper bound.
+	Range(prefix, start, end string, fn func(key string, value []byte) bool) error
+}
+
+// TTLReader is implemented by state machines that support keys with a TTL.
+type TTLReader interface {
+	// TTL returns the time key has left to live. ok is false if the key
+	// does not exist or has no TTL.
+	TTL(key string) (ttl time.Duration, ok bool, err error)
+}
+
+// ExpiredKey is a key past its deadline, in Unix nanoseconds.
+type ExpiredKey struct {
+	Namespace string
+	Key       string
+	Expires   int64
+}
+
+// Expirer is implemented by state machines that support keys with a TTL.
+// Expiry is driven by the leader, which periodically asks for expired keys
+// and proposes an expire command for each, so every node drops a key at the
+// same log index.
+type Expirer interface {
+	TTLReader
+
+	// Expired returns up to max keys, of any namespace, whose deadline is
+	// at or before now.
+	Expired(now int64, max int) []ExpiredKey
+}
+
+// ErrNamespaceNotFound is returned for a namespace that does not exist.
+var ErrNamespaceNotFound = errors.New("namespace not found")
+
+// NamespaceInfo describes a namespace: its quota, zero meaning no limit, and
+// its current usage, the bytes of its keys and values.
+type NamespaceInfo struct {
+	Name     string `json:"name"`
+	MaxKeys  int64  `json:"max_keys,omitempty"`
+	MaxBytes int64  `json:"max_bytes,omitempty"`
+	Keys     int64  `json:"keys"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// Namespacer is implemented by state machines that partition keys into
+// namespaces, each a key space of its own. The keys of the state machine
+// itself are those of the default namespace, "", which always exists.
+type Namespacer interface {
+	// Namespace returns the keys of namespace name, or fails with
+	// ErrNamespaceNotFound. The Reader implements the same optional read
+	// interfaces as the state machine, scoped to the namespace.
+	Namespace(name string) (Reader, error)
+
+	// Namespaces returns every namespace but the default one, in name
+	// order.
+	Namespaces() []NamespaceInfo
+}
+
+// Lease is the lease of a lock: its holder, the fencing token the holder
+// passes along to the resources it guards, and the deadline of the lease, in
+// Unix nanoseconds. The token is the raft index of the entry that acquired the
+// lock, so every lease of every lock gets a greater one than those before it.
+type Lease struct {
+	Name    string `json:"name"`
+	Holder  string `json:"holder"`
+	Token   uint64 `json:"token"`
+	Expires int64  `json:"expires"`
+}
+
+// Locker is implemented by state machines that hold locks. Like key expiry,
+// lease expiry is driven by the leader, which periodically asks for lapsed
+// leases and proposes a release command for each.
+type Locker interface {
+	// Lock returns the lease of lock name, ok being false if it is free.
+	// A lease past its deadline is returned until it is released.
+	Lock(name string) (lease Lease, ok bool)
+
+	// ExpiredLocks returns up to max leases whose deadline is at or
+	// before now.
+	ExpiredLocks(now int64, max int) []Lease
+}
+
+// SessionInfo describes a session: the raft server it is bound to, if any,
+// its TTL in seconds, the deadline of its lease in Unix nanoseconds, and the
+// number of keys attached to it.
+type SessionInfo struct {
+	ID      uint64 `json:"id"`
+	Node    string `json:"node,omitempty"`
+	TTL     int64  `json:"ttl"`
+	Expires int64  `json:"expires"`
+	Keys    int    `json:"keys"`
+}
+
+// Sessioner is implemented by state machines that attach keys to sessions,
+// which clients keep alive with heartbeats, and delete the keys of a session
+// when it ends. The leader ends sessions whose lease lapsed, and sessions
+// bound to a server that left the raft configuration, by proposing their
+// destruction.
+type Sessioner interface {
+	// Session returns session id, ok being false if it does not exist.
+	Session(id uint64) (info SessionInfo, ok bool)
+
+	// Sessions returns every session, in ID order.
+	Sessions() []SessionInfo
+
+	// ExpiredSessions returns up to max sessions whose deadline is at or
+	// before now.
+	ExpiredSessions(now int64, max int) []SessionInfo
+}
+
+// BatchApplier is implemented by state machines that can apply several
+// committed log entries at once, e.g. under a single lock acquisition or disk
+// transaction. RaftFsm hands it the command entries of every batch raft
+// commits.
+type BatchApplier interface {
+	// FsmApplyBatch applies logs, in order, and returns the response to
+	// each of them at the same position.
+	FsmApplyBatch(logs []*raft.Log) []interface{}
+}
+
 /*
 	The FSM implements the Finite State Machine (FSM) interface
 */
 
 type RaftFsm struct {
 	mu    sync.RWMutex
-	store *store.Store
+	store StateMachine
 	log  helper.Log
 	RaftNodeId string 
 }
 
-func NewRaftFsm(s *store.Store) *RaftFsm {
+func NewRaftFsm(s StateMachine) *RaftFsm {
 	return &RaftFsm{
 		mu:    sync.RWMutex{},
 		store: s,
@@ -35,15 +244,43 @@ var idx = 0
 func (rf *RaftFsm) Apply(l *raft.Log) interface{} {
 
 	// This produces A LOT of logs
-	rf.log.Debug("Received log", "index", l.Index, "data", string(l.Data))
-	now := time.Now()
-	// milliseconds := now.UnixNano() 
-	tstr := fmt.Sprintf("FSM Applied 时间：%s", now.Format("2006-01-02 15:04:05.000"))
-	value := fmt.Sprintf("%s: ApplyNode %s-%s",string(l.Data), rf.RaftNodeId, tstr)
-	rf.log.Info("RaftFsm Applying", "index", l.Index, "value", value)
+	rf.log.Debug("Received log", "index", l.Index, "node", rf.RaftNodeId, "size", len(l.Data))
 	return rf.store.FsmApply(l)
 }
 
+/*
+	Required by Raft BatchingFSM interface
+*/
+func (rf *RaftFsm) ApplyBatch(logs []*raft.Log) []interface{} {
+	resps := make([]interface{}, len(logs))
+
+	// Only commands are meant for the state machine, configuration
+	// changes get no response.
+	cmds := make([]*raft.Log, 0, len(logs))
+	pos := make([]int, 0, len(logs))
+	for i, l := range logs {
+		if l.Type == raft.LogCommand {
+			cmds = append(cmds, l)
+			pos = append(pos, i)
+		}
+	}
+	if len(cmds) == 0 {
+		return resps
+	}
+	rf.log.Debug("Received logs", "first", cmds[0].Index, "last", cmds[len(cmds)-1].Index, "node", rf.RaftNodeId)
+
+	if ba, ok := rf.store.(BatchApplier); ok {
+		for i, resp := range ba.FsmApplyBatch(cmds) {
+			resps[pos[i]] = resp
+		}
+		return resps
+	}
+	for i, l := range cmds {
+		resps[pos[i]] = rf.store.FsmApply(l)
+	}
+	return resps
+}
+
 /*
 	Required by Raft FSM interface
 */
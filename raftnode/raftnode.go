@@ -41,6 +41,7 @@ type RaftNode struct {
 	raft *raft.Raft // The consensus mechanism
 	fsm  *RaftFsm
 	config config.RaftConfig
+	localID string
 }
 
 func New(f * RaftFsm) *RaftNode {
@@ -56,6 +57,7 @@ func (s *RaftNode) Open(enableSingle bool, localID string) error {
 	// Setup Raft configuration.
 	config := raft.DefaultConfig()
 	config.LocalID = raft.ServerID(localID)
+	s.localID = localID
 
 
 	// Setup Raft communication.
@@ -73,6 +75,7 @@ func (s *RaftNode) Open(enableSingle bool, localID string) error {
 	if err != nil {
 		return fmt.Errorf("file snapshot RaftNode: %s", err)
 	}
+	config.NoSnapshotRestoreOnStart = s.skipSnapshotRestore(snapshots)
 
 	// Create the log RaftNode and stable RaftNode.
 	var logStore raft.LogStore
@@ -129,6 +132,7 @@ func (s *RaftNode) OpenWithcConfig(configInstance config.RaftConfig) error {
 	// Setup Raft configuration  from file config.json
 	config := raft.DefaultConfig()
 	config.LocalID = raft.ServerID(configInstance.Nodes[0].ID)
+	s.localID = configInstance.Nodes[0].ID
 	config.HeartbeatTimeout = time.Duration(configInstance.HeartbeatIntervalMs *1000*1000) // Convert ms to ns
 	config.ElectionTimeout  = time.Duration(configInstance.ElectionTimeoutMs *1000*1000) // Convert ms to ns
 
@@ -148,6 +152,7 @@ func (s *RaftNode) OpenWithcConfig(configInstance config.RaftConfig) error {
 	if err != nil {
 		return fmt.Errorf("file snapshot RaftNode: %s", err)
 	}
+	config.NoSnapshotRestoreOnStart = s.skipSnapshotRestore(snapshots)
 
 	// Create the log RaftNode and stable RaftNode.
 	var logStore raft.LogStore
@@ -202,6 +207,27 @@ func (s *RaftNode) OpenWithcConfig(configInstance config.RaftConfig) error {
 	return nil
 }
 
+// skipSnapshotRestore reports whether the state machine already reflects the
+// latest snapshot, in which case restoring it at startup would only rewrite
+// state that was read back from disk. Raft then replays the log from the
+// snapshot index onwards as usual.
+func (s *RaftNode) skipSnapshotRestore(snapshots raft.SnapshotStore) bool {
+	ai, ok := s.fsm.store.(AppliedIndexer)
+	if !ok {
+		return false
+	}
+	metas, err := snapshots.List()
+	if err != nil || len(metas) == 0 {
+		return false
+	}
+	applied := ai.AppliedIndex()
+	if applied < metas[0].Index {
+		return false
+	}
+	log.Info("state machine is ahead of latest snapshot, skipping restore", "applied", applied, "snapshot", metas[0].Index)
+	return true
+}
+
 // Join joins a node, identified by nodeID and located at addr, to this RaftNode.
 // The node must be ready to respond to Raft communications at that address.
 func (s *RaftNode) Join(nodeID, addr string) error {
@@ -265,7 +291,7 @@ func (s *RaftNode) GetRaftState( ) string {
 
 // GetRaftNodeId returns the ID of the local Raft node.
 func (s *RaftNode) GetRaftNodeLocalId() string {
-	return s.config.Nodes[0].ID
+	return s.localID
 }
 func (s *RaftNode) GetRaft() *raft.Raft {
 	log.Info("raftnode Raft","object", s.raft)
@@ -1,15 +1,22 @@
 package raftnode
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/raft"
 )
 
 // Test_StoreOpen tests that the store can be opened.
 func Test_StoreOpen(t *testing.T) {
-	s := New(false)
+	s := New(NewRaftFsm(newTestStore()))
 	tmpDir, _ := ioutil.TempDir("", "store_test")
 	defer os.RemoveAll(tmpDir)
 
@@ -26,7 +33,8 @@ func Test_StoreOpen(t *testing.T) {
 
 // Test_StoreOpenSingleNode tests that a command can be applied to the log
 func Test_StoreOpenSingleNode(t *testing.T) {
-	s := New(false)
+	st := newTestStore()
+	s := New(NewRaftFsm(st))
 	tmpDir, _ := ioutil.TempDir("", "store_test")
 	defer os.RemoveAll(tmpDir)
 
@@ -43,31 +51,31 @@ func Test_StoreOpenSingleNode(t *testing.T) {
 	// Simple way to ensure there is a leader.
 	time.Sleep(3 * time.Second)
 
-	if err := s.Set("foo", "bar"); err != nil {
+	if err := applyCommand(s, "set", "foo", "bar"); err != nil {
 		t.Fatalf("failed to set key: %s", err.Error())
 	}
 
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
-	value, err := s.Get("foo")
+	value, err := st.Get("foo")
 	if err != nil {
 		t.Fatalf("failed to get key: %s", err.Error())
 	}
-	if value != "bar" {
+	if string(value) != "bar" {
 		t.Fatalf("key has wrong value: %s", value)
 	}
 
-	if err := s.Delete("foo"); err != nil {
+	if err := applyCommand(s, "delete", "foo", ""); err != nil {
 		t.Fatalf("failed to delete key: %s", err.Error())
 	}
 
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
-	value, err = s.Get("foo")
+	value, err = st.Get("foo")
 	if err != nil {
 		t.Fatalf("failed to get key: %s", err.Error())
 	}
-	if value != "" {
+	if len(value) != 0 {
 		t.Fatalf("key has wrong value: %s", value)
 	}
 }
@@ -75,7 +83,9 @@ func Test_StoreOpenSingleNode(t *testing.T) {
 // Test_StoreInMemOpenSingleNode tests that a command can be applied to the log
 // stored in RAM.
 func Test_StoreInMemOpenSingleNode(t *testing.T) {
-	s := New(true)
+	st := newTestStore()
+	s := New(NewRaftFsm(st))
+	s.inmem = true
 	tmpDir, _ := ioutil.TempDir("", "store_test")
 	defer os.RemoveAll(tmpDir)
 
@@ -92,31 +102,206 @@ func Test_StoreInMemOpenSingleNode(t *testing.T) {
 	// Simple way to ensure there is a leader.
 	time.Sleep(3 * time.Second)
 
-	if err := s.Set("foo", "bar"); err != nil {
+	if err := applyCommand(s, "set", "foo", "bar"); err != nil {
 		t.Fatalf("failed to set key: %s", err.Error())
 	}
 
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
-	value, err := s.Get("foo")
+	value, err := st.Get("foo")
 	if err != nil {
 		t.Fatalf("failed to get key: %s", err.Error())
 	}
-	if value != "bar" {
+	if string(value) != "bar" {
 		t.Fatalf("key has wrong value: %s", value)
 	}
 
-	if err := s.Delete("foo"); err != nil {
+	if err := applyCommand(s, "delete", "foo", ""); err != nil {
 		t.Fatalf("failed to delete key: %s", err.Error())
 	}
 
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
-	value, err = s.Get("foo")
+	value, err = st.Get("foo")
 	if err != nil {
 		t.Fatalf("failed to get key: %s", err.Error())
 	}
-	if value != "" {
+	if len(value) != 0 {
 		t.Fatalf("key has wrong value: %s", value)
 	}
 }
+
+// Test_RaftFsmStateMachine tests that RaftFsm drives any StateMachine.
+func Test_RaftFsmStateMachine(t *testing.T) {
+	sm := &testStateMachine{}
+	fsm := NewRaftFsm(sm)
+
+	fsm.Apply(&raft.Log{Index: 1, Data: []byte("a")})
+	fsm.Apply(&raft.Log{Index: 2, Data: []byte("b")})
+	if len(sm.applied) != 2 || sm.applied[1] != 2 {
+		t.Fatalf("state machine did not see applied entries: %v", sm.applied)
+	}
+}
+
+type testStateMachine struct {
+	StateMachine
+	applied []uint64
+}
+
+func (t *testStateMachine) FsmApply(l *raft.Log) interface{} {
+	t.applied = append(t.applied, l.Index)
+	return nil
+}
+
+// Test_RaftFsmApplyBatch tests that batches reach the state machine as a
+// whole when it supports it, entry by entry otherwise, without configuration
+// entries.
+func Test_RaftFsmApplyBatch(t *testing.T) {
+	logs := []*raft.Log{
+		{Index: 1, Type: raft.LogCommand},
+		{Index: 2, Type: raft.LogConfiguration},
+		{Index: 3, Type: raft.LogCommand},
+	}
+
+	sm := &testStateMachine{}
+	if resps := NewRaftFsm(sm).ApplyBatch(logs); len(resps) != 3 {
+		t.Fatalf("wrong number of responses: %d", len(resps))
+	}
+	if len(sm.applied) != 2 || sm.applied[0] != 1 || sm.applied[1] != 3 {
+		t.Fatalf("state machine did not see command entries: %v", sm.applied)
+	}
+
+	bsm := &testBatchStateMachine{}
+	resps := NewRaftFsm(bsm).ApplyBatch(logs)
+	if len(bsm.batches) != 1 || len(bsm.batches[0]) != 2 {
+		t.Fatalf("state machine did not get one batch of commands: %v", bsm.batches)
+	}
+	if resps[0] != uint64(1) || resps[1] != nil || resps[2] != uint64(3) {
+		t.Fatalf("responses not at the position of their entry: %v", resps)
+	}
+}
+
+type testBatchStateMachine struct {
+	StateMachine
+	batches [][]*raft.Log
+}
+
+func (t *testBatchStateMachine) FsmApplyBatch(logs []*raft.Log) []interface{} {
+	t.batches = append(t.batches, logs)
+	resps := make([]interface{}, len(logs))
+	for i, l := range logs {
+		resps[i] = l.Index
+	}
+	return resps
+}
+
+// Test_EventHub tests watches on keys and prefixes, resuming from a past
+// index and falling out of the history.
+func Test_EventHub(t *testing.T) {
+	h := NewEventHub(2, 10)
+	if _, err := h.Watch("a", false, 5); err != ErrCompacted {
+		t.Fatalf("watch before the hub started did not fail: %v", err)
+	}
+
+	h.Publish(Event{Index: 11, Op: "set", Key: "a/1"})
+	h.Publish(Event{Index: 12, Op: "set", Key: "b"}, Event{Index: 12, Op: "delete", Key: "a/2"})
+
+	w, err := h.Watch("a/", true, 11)
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer w.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	events, err := w.Next(ctx)
+	if err != nil || len(events) != 2 || events[0].Key != "a/1" || events[1].Key != "a/2" {
+		t.Fatalf("wrong replayed events: %v %v", events, err)
+	}
+
+	go h.Publish(Event{Index: 13, Op: "set", Key: "a/3"})
+	events, err = w.Next(ctx)
+	if err != nil || len(events) != 1 || events[0].Index != 13 {
+		t.Fatalf("wrong live events: %v %v", events, err)
+	}
+
+	h.Publish(Event{Index: 14, Op: "set", Key: "c"}, Event{Index: 14, Op: "set", Key: "d"})
+	if _, err := h.Watch("", true, 12); err != ErrCompacted {
+		t.Fatalf("watch from trimmed index did not fail: %v", err)
+	}
+
+	h.Reset(20)
+	if _, err := w.Next(ctx); err != ErrWatchClosed {
+		t.Fatalf("watch not closed by reset: %v", err)
+	}
+
+	// Events published after a watch from a later index opened, but
+	// applied before that index, are not delivered.
+	w, err = h.Watch("a", false, 30)
+	if err != nil {
+		t.Fatalf("failed to watch from a future index: %s", err)
+	}
+	defer w.Close()
+	h.Publish(Event{Index: 21, Op: "set", Key: "a"})
+	h.Publish(Event{Index: 29, Op: "set", Key: "a"})
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if events, err := w.Next(short); err != context.DeadlineExceeded {
+		t.Fatalf("events before the watched index delivered: %v %v", events, err)
+	}
+	h.Publish(Event{Index: 30, Op: "set", Key: "a"})
+	if events, err := w.Next(ctx); err != nil || len(events) != 1 || events[0].Index != 30 {
+		t.Fatalf("wrong events from the watched index: %v %v", events, err)
+	}
+}
+
+// testStore is a map-based StateMachine understanding set and delete.
+type testStore struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func newTestStore() *testStore {
+	return &testStore{m: make(map[string]string)}
+}
+
+func (t *testStore) Get(key string) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.m[key]
+	if !ok {
+		return nil, nil
+	}
+	return []byte(v), nil
+}
+
+func (t *testStore) FsmApply(l *raft.Log) interface{} {
+	var c map[string]string
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch c["op"] {
+	case "set":
+		t.m[c["key"]] = c["value"]
+	case "delete":
+		delete(t.m, c["key"])
+	}
+	return nil
+}
+
+func (t *testStore) FsmSnapshot() (raft.FSMSnapshot, error) {
+	return nil, fmt.Errorf("snapshots not supported")
+}
+
+func (t *testStore) FsmRestore(rc io.ReadCloser) error {
+	return fmt.Errorf("restore not supported")
+}
+
+func applyCommand(s *RaftNode, op, key, value string) error {
+	b, err := json.Marshal(map[string]string{"op": op, "key": key, "value": value})
+	if err != nil {
+		return err
+	}
+	return s.Apply(b).(raft.ApplyFuture).Error()
+}
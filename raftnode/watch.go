@@ -0,0 +1,221 @@
+package raftnode
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrCompacted is returned by Watch, or by a historical read, when the
+// requested index is older than the history kept by the state machine. The
+// caller has to read the current state again and watch from the index it was
+// read at.
+var ErrCompacted = errors.New("index has been compacted")
+
+// ErrWatchClosed is returned by Watch.Next once the watch was closed, either
+// by its owner, because it fell too far behind, or because the state was
+// replaced by a snapshot.
+var ErrWatchClosed = errors.New("watch closed")
+
+// Event describes a change applied to a key by the log entry at Index.
+type Event struct {
+	Index     uint64 `json:"index"`
+	Op        string `json:"op"` // "set", "delete" or "expire".
+	Namespace string `json:"ns,omitempty"`
+	Key       string `json:"key"`
+	Value     []byte `json:"value,omitempty"` // Base64 in JSON.
+}
+
+// Watcher is implemented by state machines that publish the changes they
+// apply, which the HTTP service streams to clients.
+type Watcher interface {
+	// Watch returns the changes to key, or to every key starting with key
+	// if prefix is set, applied from the log entry at index onwards. A zero
+	// index watches changes applied from now on.
+	Watch(key string, prefix bool, index uint64) (*Watch, error)
+}
+
+// EventHub keeps a bounded history of events, at least the last size and at
+// most twice as many, and fans them out to watches. A state machine publishes
+// the events of each log entry as it applies it.
+type EventHub struct {
+	mu      sync.Mutex
+	history []Event // Oldest first.
+	size    int
+	first   uint64 // Lowest index whose events are all in history.
+	watches map[*Watch]struct{}
+}
+
+// NewEventHub returns an EventHub keeping the last size events. applied is the
+// index the state machine is at, events start after it.
+func NewEventHub(size int, applied uint64) *EventHub {
+	return &EventHub{
+		size:    size,
+		first:   applied + 1,
+		watches: make(map[*Watch]struct{}),
+	}
+}
+
+// Publish records events, in index order, and delivers them.
+func (h *EventHub) Publish(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.history = append(h.history, events...)
+	if len(h.history) > 2*h.size {
+		// Trim back to size events, only whole log entries are
+		// considered available.
+		n := len(h.history) - h.size
+		h.first = h.history[n-1].Index + 1
+		h.history = append(h.history[:0:0], h.history[n:]...)
+	}
+	for w := range h.watches {
+		for _, e := range events {
+			w.deliver(e)
+		}
+	}
+}
+
+// Reset drops the history and closes every watch, for when the state is
+// replaced wholesale, e.g. by a snapshot restore, and the events published so
+// far no longer lead to it.
+func (h *EventHub) Reset(applied uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.history = nil
+	h.first = applied + 1
+	for w := range h.watches {
+		w.close()
+	}
+	h.watches = make(map[*Watch]struct{})
+}
+
+// Watch implements Watcher, for the keys of the default namespace.
+func (h *EventHub) Watch(key string, prefix bool, index uint64) (*Watch, error) {
+	return h.WatchNamespace("", key, prefix, index)
+}
+
+// WatchNamespace is Watch for the keys of namespace ns.
+func (h *EventHub) WatchNamespace(ns, key string, prefix bool, index uint64) (*Watch, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if index != 0 && index < h.first {
+		return nil, ErrCompacted
+	}
+	w := &Watch{
+		hub:    h,
+		ns:     ns,
+		key:    key,
+		prefix: prefix,
+		index:  index,
+		max:    h.size,
+		notify: make(chan struct{}, 1),
+	}
+	if index != 0 {
+		for _, e := range h.history {
+			w.deliver(e)
+		}
+	}
+	h.watches[w] = struct{}{}
+	return w, nil
+}
+
+func (h *EventHub) remove(w *Watch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.watches, w)
+	w.close()
+}
+
+// Watch is a subscription to the events of a key or a prefix.
+type Watch struct {
+	hub    *EventHub
+	ns     string
+	key    string
+	prefix bool
+	index  uint64 // Events of earlier log entries are not delivered.
+	max    int
+
+	mu      sync.Mutex
+	pending []Event
+	closed  bool
+	notify  chan struct{}
+}
+
+func (w *Watch) match(e Event) bool {
+	if e.Index < w.index || e.Namespace != w.ns {
+		return false
+	}
+	if w.prefix {
+		return strings.HasPrefix(e.Key, w.key)
+	}
+	return e.Key == w.key
+}
+
+// deliver queues e if it matches. A watch whose reader falls more than a
+// history's worth of events behind is closed, its reader resumes from the
+// index of the last event it got.
+func (w *Watch) deliver(e Event) {
+	if !w.match(e) {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	if len(w.pending) >= w.max {
+		w.closed = true
+		w.pending = nil
+	} else {
+		w.pending = append(w.pending, e)
+	}
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Watch) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Next blocks until events are available and returns all of them, in index
+// order. It fails with ctx's error when ctx is done first, and with
+// ErrWatchClosed once the watch is closed.
+func (w *Watch) Next(ctx context.Context) ([]Event, error) {
+	for {
+		w.mu.Lock()
+		if len(w.pending) > 0 {
+			events := w.pending
+			w.pending = nil
+			w.mu.Unlock()
+			return events, nil
+		}
+		closed := w.closed
+		w.mu.Unlock()
+		if closed {
+			return nil, ErrWatchClosed
+		}
+
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close stops the watch.
+func (w *Watch) Close() {
+	w.hub.remove(w)
+}
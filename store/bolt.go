@@ -0,0 +1,410 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+	"github.com/hashicorp/go-msgpack/v2/codec"
+	"github.com/ifoxhz/raft-nginx/command"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Layout of the bbolt file backing a disk-based Store. Every key lives in
+// bucketKV as an encoded entry, under its tree key; bucketNamespaces maps the
+// name of every namespace but the default one to its encoded quota;
+// bucketLocks maps the name of every lock held to its encoded lease;
+// bucketSessions maps the ID of every session, in big endian, to its encoded
+// lease; bucketMeta records the index and term of the last raft log entry reflected
+// in the others. All are updated in the same bolt transaction, so the file is
+// always a consistent applied state.
+var (
+	bucketKV         = []byte("kv")
+	bucketNamespaces = []byte("namespaces")
+	bucketLocks      = []byte("locks")
+	bucketSessions   = []byte("sessions")
+	bucketMeta       = []byte("meta")
+
+	metaAppliedIndex = []byte("applied_index")
+	metaAppliedTerm  = []byte("applied_term")
+)
+
+var msgpackHandle = &codec.MsgpackHandle{}
+
+func encodeEntry(e *entry) ([]byte, error) {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(e); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func decodeEntry(b []byte) (*entry, error) {
+	var e entry
+	if err := codec.NewDecoderBytes(b, msgpackHandle).Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func encodeQuota(q *command.Quota) ([]byte, error) {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(q); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func decodeQuota(b []byte) (command.Quota, error) {
+	var q command.Quota
+	err := codec.NewDecoderBytes(b, msgpackHandle).Decode(&q)
+	return q, err
+}
+
+func encodeLock(k *lock) ([]byte, error) {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(k); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func decodeLock(b []byte) (*lock, error) {
+	var k lock
+	if err := codec.NewDecoderBytes(b, msgpackHandle).Decode(&k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func encodeSession(s *session) ([]byte, error) {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(s); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func decodeSession(b []byte) (*session, error) {
+	var s session
+	if err := codec.NewDecoderBytes(b, msgpackHandle).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// sessionKey returns the key of session id in bucketSessions.
+func sessionKey(id uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], id)
+	return b[:]
+}
+
+// OpenStore returns a Store persisted in the bbolt database at path, creating
+// it if needed. The keys and the last applied index/term already on disk are
+// loaded, so the node can serve reads without waiting for the raft log to be
+// replayed.
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt store: %s", err)
+	}
+
+	st := NewStore(false)
+	st.db = db
+	txn := iradix.New().Txn()
+	s := &state{
+		namespaces: make(map[string]command.Quota),
+		locks:      make(map[string]*lock),
+		sessions:   make(map[uint64]*session),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		kv, err := tx.CreateBucketIfNotExists(bucketKV)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		nsb, err := tx.CreateBucketIfNotExists(bucketNamespaces)
+		if err != nil {
+			return err
+		}
+		lb, err := tx.CreateBucketIfNotExists(bucketLocks)
+		if err != nil {
+			return err
+		}
+		sb, err := tx.CreateBucketIfNotExists(bucketSessions)
+		if err != nil {
+			return err
+		}
+		s.index = getUint64(meta, metaAppliedIndex)
+		s.term = getUint64(meta, metaAppliedTerm)
+		err = nsb.ForEach(func(k, v []byte) error {
+			q, err := decodeQuota(v)
+			if err != nil {
+				return fmt.Errorf("decode namespace %q: %s", k, err)
+			}
+			s.namespaces[string(k)] = q
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = lb.ForEach(func(k, v []byte) error {
+			l, err := decodeLock(v)
+			if err != nil {
+				return fmt.Errorf("decode lock %q: %s", k, err)
+			}
+			s.locks[string(k)] = l
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = sb.ForEach(func(k, v []byte) error {
+			ss, err := decodeSession(v)
+			if err != nil || len(k) != 8 {
+				return fmt.Errorf("decode session %x: %v", k, err)
+			}
+			s.sessions[binary.BigEndian.Uint64(k)] = ss
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return kv.ForEach(func(k, v []byte) error {
+			e, err := decodeEntry(v)
+			if err != nil {
+				return fmt.Errorf("decode key %q: %s", k, err)
+			}
+			txn.Insert(k, e)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.tree = txn.Commit()
+	st.reset(s)
+	return st, nil
+}
+
+// stage records a mutation of key for the next flush. A nil entry deletes
+// key.
+func (st *Store) stage(key string, e *entry) {
+	if st.db == nil {
+		return
+	}
+	if st.pending == nil {
+		st.pending = make(map[string]*entry)
+	}
+	st.pending[key] = e
+}
+
+// stageNamespace records a change of namespace name for the next flush. A nil
+// quota deletes it.
+func (st *Store) stageNamespace(name string, q *command.Quota) {
+	if st.db == nil {
+		return
+	}
+	if st.pendingNS == nil {
+		st.pendingNS = make(map[string]*command.Quota)
+	}
+	st.pendingNS[name] = q
+}
+
+// stageLock records a change of the lease of lock name for the next flush. A
+// nil lease frees it.
+func (st *Store) stageLock(name string, k *lock) {
+	if st.db == nil {
+		return
+	}
+	if st.pendingLocks == nil {
+		st.pendingLocks = make(map[string]*lock)
+	}
+	st.pendingLocks[name] = k
+}
+
+// stageSession records a change of session id for the next flush. A nil
+// session ends it.
+func (st *Store) stageSession(id uint64, s *session) {
+	if st.db == nil {
+		return
+	}
+	if st.pendingSessions == nil {
+		st.pendingSessions = make(map[uint64]*session)
+	}
+	st.pendingSessions[id] = s
+}
+
+// flush writes the staged mutations together with the applied index and term
+// in a single transaction, so that every key touched by a log entry is
+// persisted, or none is.
+func (st *Store) flush() error {
+	if st.db == nil || (len(st.pending) == 0 && len(st.pendingNS) == 0 && len(st.pendingLocks) == 0 && len(st.pendingSessions) == 0) {
+		return nil
+	}
+	pending, pendingNS, pendingLocks, pendingSessions := st.pending, st.pendingNS, st.pendingLocks, st.pendingSessions
+	st.pending, st.pendingNS, st.pendingLocks, st.pendingSessions = nil, nil, nil, nil
+	return st.db.Update(func(tx *bolt.Tx) error {
+		sb := tx.Bucket(bucketSessions)
+		for id, s := range pendingSessions {
+			if s == nil {
+				if err := sb.Delete(sessionKey(id)); err != nil {
+					return err
+				}
+				continue
+			}
+			b, err := encodeSession(s)
+			if err != nil {
+				return err
+			}
+			if err := sb.Put(sessionKey(id), b); err != nil {
+				return err
+			}
+		}
+		lb := tx.Bucket(bucketLocks)
+		for name, k := range pendingLocks {
+			if k == nil {
+				if err := lb.Delete([]byte(name)); err != nil {
+					return err
+				}
+				continue
+			}
+			b, err := encodeLock(k)
+			if err != nil {
+				return err
+			}
+			if err := lb.Put([]byte(name), b); err != nil {
+				return err
+			}
+		}
+		nsb := tx.Bucket(bucketNamespaces)
+		for name, q := range pendingNS {
+			if q == nil {
+				if err := nsb.Delete([]byte(name)); err != nil {
+					return err
+				}
+				continue
+			}
+			b, err := encodeQuota(q)
+			if err != nil {
+				return err
+			}
+			if err := nsb.Put([]byte(name), b); err != nil {
+				return err
+			}
+		}
+		kv := tx.Bucket(bucketKV)
+		for key, e := range pending {
+			if e == nil {
+				if err := kv.Delete([]byte(key)); err != nil {
+					return err
+				}
+				continue
+			}
+			b, err := encodeEntry(e)
+			if err != nil {
+				return err
+			}
+			if err := kv.Put([]byte(key), b); err != nil {
+				return err
+			}
+		}
+		return putApplied(tx.Bucket(bucketMeta), st.index, st.term)
+	})
+}
+
+// persistAll replaces the whole content of the database with state s, as
+// needed when a snapshot is restored.
+func (st *Store) persistAll(s *state) error {
+	if st.db == nil {
+		return nil
+	}
+	return st.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketKV, bucketNamespaces, bucketLocks, bucketSessions} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		sb, err := tx.CreateBucket(bucketSessions)
+		if err != nil {
+			return err
+		}
+		for id, ss := range s.sessions {
+			b, err := encodeSession(ss)
+			if err != nil {
+				return err
+			}
+			if err := sb.Put(sessionKey(id), b); err != nil {
+				return err
+			}
+		}
+		lb, err := tx.CreateBucket(bucketLocks)
+		if err != nil {
+			return err
+		}
+		for name, k := range s.locks {
+			b, err := encodeLock(k)
+			if err != nil {
+				return err
+			}
+			if err := lb.Put([]byte(name), b); err != nil {
+				return err
+			}
+		}
+		nsb, err := tx.CreateBucket(bucketNamespaces)
+		if err != nil {
+			return err
+		}
+		for name, q := range s.namespaces {
+			b, err := encodeQuota(&q)
+			if err != nil {
+				return err
+			}
+			if err := nsb.Put([]byte(name), b); err != nil {
+				return err
+			}
+		}
+		kv, err := tx.CreateBucket(bucketKV)
+		if err != nil {
+			return err
+		}
+		it := s.tree.Root().Iterator()
+		for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+			b, err := encodeEntry(v.(*entry))
+			if err != nil {
+				return err
+			}
+			if err := kv.Put(k, b); err != nil {
+				return err
+			}
+		}
+		return putApplied(tx.Bucket(bucketMeta), st.index, st.term)
+	})
+}
+
+func putApplied(meta *bolt.Bucket, index, term uint64) error {
+	if err := putUint64(meta, metaAppliedIndex, index); err != nil {
+		return err
+	}
+	return putUint64(meta, metaAppliedTerm, term)
+}
+
+func getUint64(b *bolt.Bucket, key []byte) uint64 {
+	v := b.Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func putUint64(b *bolt.Bucket, key []byte, v uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return b.Put(key, buf[:])
+}
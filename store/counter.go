@@ -0,0 +1,73 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+)
+
+// Counters are plain keys whose value is a decimal integer, so that they read
+// like any other key. A key that does not exist, or holds an empty value,
+// counts as 0.
+
+// applyIncr adds the delta of c, an incr or decr command, to the value of its
+// key, with st.mu held. A key created by it gets the deadline and session of
+// c, one that exists keeps its own. The command fails with a conflict if the value would
+// leave the bounds of c, and changes nothing.
+func (st *Store) applyIncr(c *command.Command, l *raft.Log) interface{} {
+	k, err := st.key(c)
+	if err != nil {
+		return err
+	}
+	if err := st.checkSession(c); err != nil {
+		return err
+	}
+	delta := c.Delta
+	if delta == 0 {
+		delta = 1
+	}
+	if c.Op == command.OpDecr {
+		if delta == math.MinInt64 {
+			return command.Errorf(command.CodeInvalid, "decr of key %s by %d overflows", c.Key, delta)
+		}
+		delta = -delta
+	}
+
+	old := st.lookup(k)
+	var n int64
+	var modIndex uint64
+	e := newEntry(c, l)
+	if old != nil {
+		if len(old.Value) > 0 {
+			if n, err = strconv.ParseInt(string(old.Value), 10, 64); err != nil {
+				return &command.Error{Code: command.CodeInvalid, Err: fmt.Errorf("key %s does not hold an integer", c.Key), Key: c.Key}
+			}
+		}
+		modIndex = old.ModIndex
+		e.Expires = old.Expires
+		e.Session = old.Session
+	}
+	sum := n + delta
+	if (delta > 0 && sum < n) || (delta < 0 && sum > n) {
+		return command.Errorf(command.CodeInvalid, "%s of key %s by %d overflows", c.Op, c.Key, c.Delta)
+	}
+	if (c.Min != nil && sum < *c.Min) || (c.Max != nil && sum > *c.Max) {
+		return &command.Error{
+			Code:     command.CodeConflict,
+			Err:      fmt.Errorf("%s of key %s would take it from %d to %d, out of bounds", c.Op, c.Key, n, sum),
+			Key:      c.Key,
+			Revision: modIndex,
+		}
+	}
+	e.Value = []byte(strconv.FormatInt(sum, 10))
+
+	if err := (&quotaCheck{st: st}).set(k, e); err != nil {
+		return err
+	}
+	res := st.result(c, st.applySet(k, e), e)
+	res.Value = e.Value
+	return res
+}
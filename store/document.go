@@ -0,0 +1,61 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/jsondoc"
+)
+
+// Documents are plain keys whose value is a JSON document, so that they read
+// like any other key. Patches are applied by every node to the document it
+// holds, and give the same bytes on all of them.
+
+// applyPatch applies the patch of c, a merge_patch or json_patch command, to
+// the document in its key, with st.mu held. A key that does not exist, or
+// holds an empty value, is the document null, and is created; one that
+// exists keeps its deadline and session. Nothing changes if the
+// preconditions of c, if any, do not hold, if the key does not hold a JSON
+// document, or if an operation of a JSON patch fails; a test operation that
+// does not hold fails with a conflict.
+func (st *Store) applyPatch(c *command.Command, l *raft.Log) interface{} {
+	k, err := st.key(c)
+	if err != nil {
+		return err
+	}
+	ok, modIndex := st.compare(k, c)
+	if !ok {
+		return command.ConflictError(c.Key, modIndex)
+	}
+
+	old := st.lookup(k)
+	var doc []byte
+	e := newEntry(c, l)
+	if old != nil {
+		doc = old.Value
+		e.Expires = old.Expires
+		e.Session = old.Session
+	}
+	if c.Op == command.OpMergePatch {
+		e.Value, err = jsondoc.MergePatch(doc, c.Value)
+	} else {
+		e.Value, err = jsondoc.Patch(doc, c.Value)
+	}
+	if errors.Is(err, jsondoc.ErrTestFailed) {
+		return &command.Error{Code: command.CodeConflict, Err: err, Key: c.Key, Revision: modIndex}
+	}
+	if err != nil {
+		return &command.Error{Code: command.CodeInvalid, Err: err, Key: c.Key}
+	}
+	// The document can grow past the size of the patch.
+	if err := st.limits.Check(&command.Command{Key: c.Key, Value: e.Value}); err != nil {
+		return err
+	}
+	if err := (&quotaCheck{st: st}).set(k, e); err != nil {
+		return err
+	}
+	res := st.result(c, st.applySet(k, e), e)
+	res.Value = e.Value
+	return res
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"io"
+	"sort"
+
+	"github.com/ifoxhz/raft-nginx/command"
+)
+
+// Dump implements raftnode.Dumper. Like a snapshot it holds on to the current
+// state, so the dump is consistent while entries keep being applied. Keys
+// keep their absolute deadline: one that passed by the time the dump is
+// restored is dropped by the leader of the cluster restoring it. Locks,
+// sessions and the keys attached to sessions are left out: their leases are
+// only meaningful to the clients renewing them.
+func (st *Store) Dump(w io.Writer) (uint64, error) {
+	s := st.state.Load()
+	dw, err := command.NewDumpWriter(w, s.index, s.term)
+	if err != nil {
+		return 0, err
+	}
+
+	names := make([]string, 0, len(s.namespaces))
+	for name := range s.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := &command.Command{Op: command.OpSetNamespace, Namespace: name}
+		if q := s.namespaces[name]; q != (command.Quota{}) {
+			c.Quota = &q
+		}
+		if err := dw.Write(c); err != nil {
+			return 0, err
+		}
+	}
+
+	it := s.tree.Root().Iterator()
+	for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+		e := v.(*entry)
+		if e.Session != 0 {
+			continue
+		}
+		ns, key := splitKey(string(k))
+		c := &command.Command{Op: command.OpSet, Namespace: ns, Key: key, Value: e.Value, Expires: e.Expires}
+		if err := dw.Write(c); err != nil {
+			return 0, err
+		}
+	}
+	return s.index, dw.Close()
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/raftnode"
+)
+
+// Locks live apart from the keys of the namespaces: they are neither listed,
+// watched nor dumped, and their leases only mean something to the cluster
+// whose holders renew them. A lock is held as long as it has a lease.
+
+// lock is the lease of a lock. Leases are never modified once stored, a
+// command replaces the whole lease, so states can share them.
+type lock struct {
+	Holder  string `json:"holder"`
+	Token   uint64 `json:"token"`   // Index of the log entry that acquired the lock.
+	Expires int64  `json:"expires"` // Deadline in Unix nanoseconds.
+}
+
+func (k *lock) lease(name string) raftnode.Lease {
+	return raftnode.Lease{Name: name, Holder: k.Holder, Token: k.Token, Expires: k.Expires}
+}
+
+// lapsed reports whether the lease k ran out by the time the leader appended
+// l. Every node sees the same append time, so they all agree. Leases are
+// never found lapsed by entries without one, the leader's release commands
+// drop them then.
+func (k *lock) lapsed(l *raft.Log) bool {
+	return !l.AppendedAt.IsZero() && k.Expires <= l.AppendedAt.UnixNano()
+}
+
+// Lock implements raftnode.Locker.
+func (st *Store) Lock(name string) (raftnode.Lease, bool) {
+	k := st.state.Load().locks[name]
+	if k == nil {
+		return raftnode.Lease{}, false
+	}
+	return k.lease(name), true
+}
+
+// ExpiredLocks implements raftnode.Locker.
+func (st *Store) ExpiredLocks(now int64, max int) []raftnode.Lease {
+	var o []raftnode.Lease
+	for name, k := range st.state.Load().locks {
+		if len(o) >= max {
+			break
+		}
+		if k.Expires <= now {
+			o = append(o, k.lease(name))
+		}
+	}
+	return o
+}
+
+// leaseExpires returns the deadline of the lease c asks for. Commands
+// proposed without one get it from the time the leader appended them.
+func leaseExpires(c *command.Command, l *raft.Log) int64 {
+	if c.Expires == 0 && c.TTL > 0 && !l.AppendedAt.IsZero() {
+		return l.AppendedAt.Add(time.Duration(c.TTL) * time.Second).UnixNano()
+	}
+	return c.Expires
+}
+
+// checkLock checks the name of the lock c addresses. Locks have no
+// namespace.
+func checkLock(c *command.Command) error {
+	if c.Key == "" {
+		return command.Errorf(command.CodeInvalid, "%s command without lock name", c.Op)
+	}
+	if c.Namespace != "" {
+		return command.Errorf(command.CodeInvalid, "%s command in namespace %s", c.Op, c.Namespace)
+	}
+	return nil
+}
+
+// lockConflict returns the error of a lock command that lost to cur, the
+// current lease of the lock, nil if it is free.
+func lockConflict(name string, cur *lock) *command.Error {
+	if cur == nil {
+		return &command.Error{Code: command.CodeConflict, Err: fmt.Errorf("lock %s is not held", name), Key: name}
+	}
+	return &command.Error{
+		Code:     command.CodeConflict,
+		Err:      fmt.Errorf("lock %s is held by %s with token %d", name, cur.Holder, cur.Token),
+		Key:      name,
+		Revision: cur.Token,
+	}
+}
+
+// applyAcquire, applyRenew and applyRelease must be called with st.mu held.
+// applyAcquire gives the lock of c to its holder, if it is free, if its lease
+// lapsed, or if the holder already holds it, in which case the lease is
+// extended and keeps its token.
+func (st *Store) applyAcquire(c *command.Command, l *raft.Log) interface{} {
+	if err := checkLock(c); err != nil {
+		return err
+	}
+	if c.Holder == "" {
+		return command.Errorf(command.CodeInvalid, "acquire of lock %s without holder", c.Key)
+	}
+	expires := leaseExpires(c, l)
+	if expires == 0 {
+		return command.Errorf(command.CodeInvalid, "acquire of lock %s without lease", c.Key)
+	}
+	cur := st.locks[c.Key]
+	k := &lock{Holder: c.Holder, Token: l.Index, Expires: expires}
+	if cur != nil && !cur.lapsed(l) {
+		if cur.Holder != c.Holder {
+			return lockConflict(c.Key, cur)
+		}
+		k.Token = cur.Token
+	}
+	st.setLock(c.Key, k)
+	return st.lockResult(c, cur, k)
+}
+
+// applyRenew extends the lease of c, if its token is that of the current
+// lease and the lease did not lapse.
+func (st *Store) applyRenew(c *command.Command, l *raft.Log) interface{} {
+	if err := checkLock(c); err != nil {
+		return err
+	}
+	expires := leaseExpires(c, l)
+	if expires == 0 {
+		return command.Errorf(command.CodeInvalid, "renew of lock %s without lease", c.Key)
+	}
+	cur := st.locks[c.Key]
+	if cur == nil || cur.Token != c.Token || cur.lapsed(l) {
+		return lockConflict(c.Key, cur)
+	}
+	k := &lock{Holder: cur.Holder, Token: cur.Token, Expires: expires}
+	st.setLock(c.Key, k)
+	return st.lockResult(c, cur, k)
+}
+
+// applyRelease frees the lock of c if its token is that of the current
+// lease. A release proposed by the leader for a lapsed lease only frees the
+// lock if the lease was not renewed since.
+func (st *Store) applyRelease(c *command.Command) interface{} {
+	if err := checkLock(c); err != nil {
+		return err
+	}
+	cur := st.locks[c.Key]
+	if cur == nil || cur.Token != c.Token {
+		if c.Expires != 0 {
+			return st.lockResult(c, cur, cur)
+		}
+		return lockConflict(c.Key, cur)
+	}
+	if c.Expires != 0 && cur.Expires > c.Expires {
+		return st.lockResult(c, cur, cur)
+	}
+	st.setLock(c.Key, nil)
+	return st.lockResult(c, cur, nil)
+}
+
+// lockResult returns the result of c, which changed the lease of its lock
+// from old to k, nil meaning that the lock was free.
+func (st *Store) lockResult(c *command.Command, old, k *lock) *command.Result {
+	res := &command.Result{Op: c.Op, Key: c.Key, Index: st.index}
+	if old != nil {
+		res.PrevRevision = old.Token
+	}
+	if k != nil {
+		res.Revision = k.Token
+		res.Holder = k.Holder
+		res.Expires = k.Expires
+	}
+	return res
+}
+
+// setLock replaces the lease of lock name with k, nil freeing it, in a copy
+// of the locks, which states share.
+func (st *Store) setLock(name string, k *lock) {
+	m := make(map[string]*lock, len(st.locks)+1)
+	for n, v := range st.locks {
+		m[n] = v
+	}
+	if k == nil {
+		delete(m, name)
+	} else {
+		m[name] = k
+	}
+	st.locks = m
+	st.stageLock(name, k)
+}
+
+// sortedLocks returns the names of locks, in order.
+func sortedLocks(locks map[string]*lock) []string {
+	names := make([]string, 0, len(locks))
+	for name := range locks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,314 @@
+package store
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/raftnode"
+)
+
+// Namespaces share the tree of the store. The keys of the default namespace
+// are stored as they are, those of namespace ns behind the prefix
+// "\x00" + ns + "\x00", which keys of the default namespace cannot start
+// with and namespace names cannot contain. The keys of a namespace are thus
+// contiguous in the tree, and those of the default one are all at or after
+// "\x01".
+
+// nsPrefix returns the prefix of the tree keys of namespace ns.
+func nsPrefix(ns string) string {
+	if ns == "" {
+		return ""
+	}
+	return "\x00" + ns + "\x00"
+}
+
+// treeKey returns the tree key of key in namespace ns.
+func treeKey(ns, key string) string {
+	return nsPrefix(ns) + key
+}
+
+// splitKey returns the namespace and key of tree key k.
+func splitKey(k string) (ns, key string) {
+	if !strings.HasPrefix(k, "\x00") {
+		return "", k
+	}
+	i := strings.IndexByte(k[1:], 0) + 1
+	return k[1:i], k[i+1:]
+}
+
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// usage is the number of keys of a namespace and their size.
+type usage struct {
+	keys  int64
+	bytes int64
+}
+
+// add returns u once key changed from old to e, nil meaning that it did not
+// exist.
+func (u usage) add(key string, old, e *entry) usage {
+	if old != nil {
+		u.keys--
+		u.bytes -= int64(len(key) + len(old.Value))
+	}
+	if e != nil {
+		u.keys++
+		u.bytes += int64(len(key) + len(e.Value))
+	}
+	return u
+}
+
+// Namespace implements raftnode.Namespacer.
+func (st *Store) Namespace(name string) (raftnode.Reader, error) {
+	if name != "" {
+		if _, ok := st.state.Load().namespaces[name]; !ok {
+			return nil, raftnode.ErrNamespaceNotFound
+		}
+	}
+	return view{st: st, ns: name}, nil
+}
+
+// Namespaces implements raftnode.Namespacer.
+func (st *Store) Namespaces() []raftnode.NamespaceInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	infos := make([]raftnode.NamespaceInfo, 0, len(st.namespaces))
+	for name, q := range st.namespaces {
+		u := st.usage[name]
+		infos = append(infos, raftnode.NamespaceInfo{
+			Name:     name,
+			MaxKeys:  q.MaxKeys,
+			MaxBytes: q.MaxBytes,
+			Keys:     u.keys,
+			Bytes:    u.bytes,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// view is the key space of a namespace. Its methods read the state without
+// locking, like those of Store, which reads through the view of the default
+// namespace.
+type view struct {
+	st *Store
+	ns string
+}
+
+func (v view) get(key string) *entry {
+	return v.st.state.Load().get(treeKey(v.ns, key))
+}
+
+// Get returns the value for the given key, nil if it does not exist.
+func (v view) Get(key string) ([]byte, error) {
+	if e := v.get(key); e != nil {
+		return e.Value, nil
+	}
+	return nil, nil
+}
+
+// GetRevision returns the value for the given key together with the index
+// of the log entry that last modified it, 0 if the key does not exist.
+func (v view) GetRevision(key string) ([]byte, uint64, error) {
+	if e := v.get(key); e != nil {
+		return e.Value, e.ModIndex, nil
+	}
+	return nil, 0, nil
+}
+
+// GetAt implements raftnode.Versioned, see Store.GetAt.
+func (v view) GetAt(key string, index uint64) ([]byte, uint64, uint64, error) {
+	return v.st.getAt(treeKey(v.ns, key), index)
+}
+
+// Range calls fn, in key order, for every key in [start, end) that has prefix,
+// until fn returns false. An empty end means no upper bound. The keys are
+// those of the state at the time of the call, whatever is applied while fn
+// runs. fn must not modify value.
+func (v view) Range(prefix, start, end string, fn func(key string, value []byte) bool) error {
+	if start < prefix {
+		start = prefix
+	}
+	p := nsPrefix(v.ns)
+	lower := p + start
+	if v.ns == "" && lower < "\x01" {
+		lower = "\x01"
+	}
+	it := v.st.state.Load().tree.Root().Iterator()
+	it.SeekLowerBound([]byte(lower))
+	// Keys with prefix are contiguous and start is not before them, so
+	// the first key without it ends the range.
+	for k, val, ok := it.Next(); ok; k, val, ok = it.Next() {
+		key := string(k)
+		if !strings.HasPrefix(key, p+prefix) || (end != "" && key >= p+end) {
+			break
+		}
+		if !fn(key[len(p):], val.(*entry).Value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Watch returns the changes to key, or to every key under it if prefix is
+// set, applied from the log entry at index onwards.
+func (v view) Watch(key string, prefix bool, index uint64) (*raftnode.Watch, error) {
+	return v.st.hub.WatchNamespace(v.ns, key, prefix, index)
+}
+
+// TTL returns the time key has left to live. ok is false if the key does not
+// exist or has no TTL. A key past its deadline is reported with a zero TTL
+// until the leader's expire command for it is applied.
+func (v view) TTL(key string) (ttl time.Duration, ok bool, err error) {
+	e := v.get(key)
+	if e == nil || e.Expires == 0 {
+		return 0, false, nil
+	}
+	ttl = time.Duration(e.Expires - time.Now().UnixNano())
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, true, nil
+}
+
+// key returns the tree key of the key of c, failing if it is empty, if its
+// namespace does not exist, or if it is a key of the default namespace
+// starting with a NUL byte.
+func (st *Store) key(c *command.Command) (string, error) {
+	if c.Key == "" {
+		return "", command.Errorf(command.CodeInvalid, "%s command without key", c.Op)
+	}
+	if c.Namespace == "" {
+		if c.Key[0] == 0 {
+			return "", command.Errorf(command.CodeInvalid, "key %q starts with a NUL byte", c.Key)
+		}
+		return c.Key, nil
+	}
+	if _, ok := st.namespaces[c.Namespace]; !ok {
+		return "", command.Errorf(command.CodeNotFound, "namespace %s not found", c.Namespace)
+	}
+	return treeKey(c.Namespace, c.Key), nil
+}
+
+// applySetNamespace creates the namespace of c, or changes its quota. A quota
+// lowered below the usage of the namespace only rejects writes that add to
+// it.
+func (st *Store) applySetNamespace(c *command.Command) interface{} {
+	if !namespaceName.MatchString(c.Namespace) {
+		return command.Errorf(command.CodeInvalid, "invalid namespace name %q", c.Namespace)
+	}
+	var q command.Quota
+	if c.Quota != nil {
+		q = *c.Quota
+	}
+	if q.MaxKeys < 0 || q.MaxBytes < 0 {
+		return command.Errorf(command.CodeInvalid, "negative quota for namespace %s", c.Namespace)
+	}
+	st.setNamespaces(func(m map[string]command.Quota) { m[c.Namespace] = q })
+	st.stageNamespace(c.Namespace, &q)
+	return &command.Result{Op: c.Op, Namespace: c.Namespace, Index: st.index}
+}
+
+// applyDeleteNamespace deletes the namespace of c and every key in it.
+func (st *Store) applyDeleteNamespace(c *command.Command) interface{} {
+	if _, ok := st.namespaces[c.Namespace]; !ok {
+		return command.Errorf(command.CodeNotFound, "namespace %s not found", c.Namespace)
+	}
+	var keys []string
+	it := st.txn.Root().Iterator()
+	it.SeekPrefix([]byte(nsPrefix(c.Namespace)))
+	for k, _, ok := it.Next(); ok; k, _, ok = it.Next() {
+		keys = append(keys, string(k))
+	}
+	for _, k := range keys {
+		st.remove(k, "delete")
+	}
+	st.setNamespaces(func(m map[string]command.Quota) { delete(m, c.Namespace) })
+	delete(st.usage, c.Namespace)
+	st.stageNamespace(c.Namespace, nil)
+	return &command.Result{Op: c.Op, Namespace: c.Namespace, Index: st.index}
+}
+
+// bytes returns the size of the keys and values of every namespace.
+func (st *Store) bytes() int64 {
+	var n int64
+	for _, u := range st.usage {
+		n += u.bytes
+	}
+	return n
+}
+
+// setNamespaces applies fn to a copy of the namespaces, which states share.
+func (st *Store) setNamespaces(fn func(m map[string]command.Quota)) {
+	m := make(map[string]command.Quota, len(st.namespaces)+1)
+	for name, q := range st.namespaces {
+		m[name] = q
+	}
+	fn(m)
+	st.namespaces = m
+}
+
+// quotaCheck checks that a sequence of writes keeps namespaces within their
+// quota, and the store within its size limit, before any of them is applied,
+// tracking what they add up to.
+type quotaCheck struct {
+	st    *Store
+	keys  map[string]*entry // Tree keys written so far, nil once deleted.
+	usage map[string]usage  // Usage of the namespaces written so far.
+	bytes int64             // Bytes the writes so far add to the store.
+}
+
+func (q *quotaCheck) lookup(k string) *entry {
+	if e, ok := q.keys[k]; ok {
+		return e
+	}
+	return q.st.lookup(k)
+}
+
+// set checks that tree key k can be set to e, and records it.
+func (q *quotaCheck) set(k string, e *entry) error {
+	ns, key := splitKey(k)
+	cur, ok := q.usage[ns]
+	if !ok {
+		cur = q.st.usage[ns]
+	}
+	u := cur.add(key, q.lookup(k), e)
+	quota := q.st.namespaces[ns]
+	if quota.MaxKeys > 0 && u.keys > quota.MaxKeys && u.keys > cur.keys {
+		return command.LimitError(command.LimitNamespaceKeys, key, "namespace %s is limited to %d keys", ns, quota.MaxKeys)
+	}
+	if quota.MaxBytes > 0 && u.bytes > quota.MaxBytes && u.bytes > cur.bytes {
+		return command.LimitError(command.LimitNamespaceBytes, key, "namespace %s is limited to %d bytes", ns, quota.MaxBytes)
+	}
+	grow := u.bytes - cur.bytes
+	if max := q.st.limits.MaxStoreBytes; max > 0 && grow > 0 && q.st.bytes()+q.bytes+grow > max {
+		return command.LimitError(command.LimitStoreSize, key, "store is limited to %d bytes", max)
+	}
+	q.bytes += grow
+	q.record(k, ns, e, u)
+	return nil
+}
+
+// delete records that tree key k is deleted.
+func (q *quotaCheck) delete(k string) {
+	ns, key := splitKey(k)
+	cur, ok := q.usage[ns]
+	if !ok {
+		cur = q.st.usage[ns]
+	}
+	u := cur.add(key, q.lookup(k), nil)
+	q.bytes += u.bytes - cur.bytes
+	q.record(k, ns, nil, u)
+}
+
+func (q *quotaCheck) record(k, ns string, e *entry, u usage) {
+	if q.keys == nil {
+		q.keys = make(map[string]*entry)
+		q.usage = make(map[string]usage)
+	}
+	q.keys[k] = e
+	q.usage[ns] = u
+}
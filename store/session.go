@@ -0,0 +1,198 @@
+package store
+
+import (
+	"sort"
+
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/raftnode"
+)
+
+// Sessions, like locks, live apart from the keys of the namespaces. A key set
+// with a session is attached to it until it is set again without one, or
+// deleted; when the session ends, the keys attached to it are deleted with
+// it. Sessions are identified by the index of the log entry that created
+// them.
+
+// session is the lease of a session. Sessions are never modified once
+// stored, a command replaces the whole session, so states can share them.
+type session struct {
+	Node    string `json:"node,omitempty"` // Raft server the session is bound to, if any.
+	TTL     int64  `json:"ttl"`            // Seconds a renewal extends the lease by.
+	Expires int64  `json:"expires"`        // Deadline in Unix nanoseconds.
+}
+
+func (s *session) info(id uint64, keys int) raftnode.SessionInfo {
+	return raftnode.SessionInfo{ID: id, Node: s.Node, TTL: s.TTL, Expires: s.Expires, Keys: keys}
+}
+
+// lapsed reports whether the lease of s ran out by the time the leader
+// appended l, like lock.lapsed.
+func (s *session) lapsed(l *raft.Log) bool {
+	return !l.AppendedAt.IsZero() && s.Expires <= l.AppendedAt.UnixNano()
+}
+
+// Session implements raftnode.Sessioner.
+func (st *Store) Session(id uint64) (raftnode.SessionInfo, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := st.sessions[id]
+	if s == nil {
+		return raftnode.SessionInfo{}, false
+	}
+	return s.info(id, len(st.sessionKeys[id])), true
+}
+
+// Sessions implements raftnode.Sessioner.
+func (st *Store) Sessions() []raftnode.SessionInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	infos := make([]raftnode.SessionInfo, 0, len(st.sessions))
+	for _, id := range sortedSessions(st.sessions) {
+		infos = append(infos, st.sessions[id].info(id, len(st.sessionKeys[id])))
+	}
+	return infos
+}
+
+// ExpiredSessions implements raftnode.Sessioner.
+func (st *Store) ExpiredSessions(now int64, max int) []raftnode.SessionInfo {
+	var o []raftnode.SessionInfo
+	for id, s := range st.state.Load().sessions {
+		if len(o) >= max {
+			break
+		}
+		if s.Expires <= now {
+			o = append(o, s.info(id, 0))
+		}
+	}
+	return o
+}
+
+// checkSession checks that the session the key of c is attached to, if any,
+// exists.
+func (st *Store) checkSession(c *command.Command) error {
+	if c.Session != 0 && st.sessions[c.Session] == nil {
+		return command.Errorf(command.CodeNotFound, "session %d not found", c.Session)
+	}
+	return nil
+}
+
+// applyCreateSession, applyRenewSession and applyDestroySession must be
+// called with st.mu held. applyCreateSession creates a session whose ID is
+// the index of l.
+func (st *Store) applyCreateSession(c *command.Command, l *raft.Log) interface{} {
+	if c.TTL <= 0 {
+		return command.Errorf(command.CodeInvalid, "session without ttl")
+	}
+	s := &session{Node: c.Node, TTL: c.TTL, Expires: leaseExpires(c, l)}
+	if s.Expires == 0 {
+		return command.Errorf(command.CodeInvalid, "session without lease")
+	}
+	st.setSession(l.Index, s)
+	return st.sessionResult(c, l.Index, s)
+}
+
+// applyRenewSession extends the lease of the session of c, if it did not
+// lapse, by the TTL of c, which the session keeps for the next renewals.
+func (st *Store) applyRenewSession(c *command.Command, l *raft.Log) interface{} {
+	cur := st.sessions[c.Session]
+	if cur == nil || cur.lapsed(l) {
+		return command.Errorf(command.CodeNotFound, "session %d not found", c.Session)
+	}
+	s := &session{Node: cur.Node, TTL: cur.TTL, Expires: leaseExpires(c, l)}
+	if c.TTL > 0 {
+		s.TTL = c.TTL
+	}
+	if s.Expires == 0 {
+		return command.Errorf(command.CodeInvalid, "renewal of session %d without lease", c.Session)
+	}
+	st.setSession(c.Session, s)
+	return st.sessionResult(c, c.Session, s)
+}
+
+// applyDestroySession ends the session of c and deletes the keys attached to
+// it. A destruction proposed by the leader for a lapsed session only ends it
+// if it was not renewed since.
+func (st *Store) applyDestroySession(c *command.Command) interface{} {
+	cur := st.sessions[c.Session]
+	if cur == nil {
+		if c.Expires != 0 {
+			return st.sessionResult(c, c.Session, nil)
+		}
+		return command.Errorf(command.CodeNotFound, "session %d not found", c.Session)
+	}
+	if c.Expires != 0 && cur.Expires > c.Expires {
+		return st.sessionResult(c, c.Session, cur)
+	}
+	op := "delete"
+	if c.Expires != 0 {
+		op = "expire"
+	}
+	keys := make([]string, 0, len(st.sessionKeys[c.Session]))
+	for k := range st.sessionKeys[c.Session] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		st.remove(k, op)
+	}
+	st.setSession(c.Session, nil)
+	return st.sessionResult(c, c.Session, nil)
+}
+
+// sessionResult returns the result of c, which left session id as s, nil
+// meaning that it does not exist.
+func (st *Store) sessionResult(c *command.Command, id uint64, s *session) *command.Result {
+	res := &command.Result{Op: c.Op, Index: st.index, Session: id}
+	if s != nil {
+		res.Expires = s.Expires
+	}
+	return res
+}
+
+// setSession replaces session id with s, nil ending it, in a copy of the
+// sessions, which states share.
+func (st *Store) setSession(id uint64, s *session) {
+	m := make(map[uint64]*session, len(st.sessions)+1)
+	for n, v := range st.sessions {
+		m[n] = v
+	}
+	if s == nil {
+		delete(m, id)
+	} else {
+		m[id] = s
+	}
+	st.sessions = m
+	st.stageSession(id, s)
+}
+
+// attach moves tree key k from the session of old, the entry it replaced, to
+// that of e, either being nil or without session.
+func (st *Store) attach(k string, old, e *entry) {
+	if old != nil && old.Session != 0 {
+		if keys := st.sessionKeys[old.Session]; keys != nil {
+			delete(keys, k)
+			if len(keys) == 0 {
+				delete(st.sessionKeys, old.Session)
+			}
+		}
+	}
+	if e != nil && e.Session != 0 {
+		keys := st.sessionKeys[e.Session]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			st.sessionKeys[e.Session] = keys
+		}
+		keys[k] = struct{}{}
+	}
+}
+
+// sortedSessions returns the IDs of sessions, in order.
+func sortedSessions(sessions map[uint64]*session) []uint64 {
+	ids := make([]uint64, 0, len(sessions))
+	for id := range sessions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,555 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/golang/snappy"
+	"github.com/hashicorp/go-msgpack/v2/codec"
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+)
+
+// A snapshot written by fsmSnapshot is an envelope made of
+//
+//	magic "RNKV" | format (1 byte) | compression (1 byte) |
+//	index (8 bytes) | term (8 bytes) | payload | checksum (4 bytes)
+//
+// with integers in big endian. index and term are those of the last log
+// entry applied, and the checksum is the CRC-32C of every byte before it.
+// The payload, compressed as the header says, is a stream of records, each
+// a msgpack snapshotRecord preceded by its length as a uvarint, and ended by
+// a zero length, so that neither writing nor reading a snapshot holds more
+// than one record in memory. The records form a section per namespace, the
+// default one first: a record without an entry names the namespace and
+// carries its quota, and the key records after it hold the keys of that
+// namespace. Records carrying a lock, after the sections, hold the lease of
+// every lock held, and records carrying a session, after them, every
+// session. The payload of earlier formats is
+//
+//	format 1: the JSON snapshotData
+//	format 2: key records only, every key being in the default namespace
+//	format 3: namespace sections, without lock or session records
+//	format 4: namespace sections and lock records, without session records
+//
+// Snapshots not starting with the magic are legacy plain-JSON ones.
+var snapshotMagic = []byte("RNKV")
+
+const (
+	// snapshotFormat is the envelope format version written.
+	snapshotFormat = 5
+
+	snapshotHeaderSize = 4 + 1 + 1 + 8 + 8
+
+	// snapshotBufferSize is the size of the buffers snapshots are written
+	// and read through.
+	snapshotBufferSize = 64 << 10
+
+	// maxSnapshotRecordSize bounds the length of a snapshot record, so that
+	// a corrupted length is rejected rather than allocated.
+	maxSnapshotRecordSize = 1 << 30
+)
+
+// snapshotRecord is a key and its entry in the payload of a snapshot, a lock
+// named Key and its lease, a session and its ID, or the start of the section
+// of namespace NS if Entry, Lock and Session are all nil.
+type snapshotRecord struct {
+	Key     string         `json:"key,omitempty"`
+	Entry   *entry         `json:"entry,omitempty"`
+	NS      string         `json:"ns,omitempty"`
+	Quota   *command.Quota `json:"quota,omitempty"`
+	Lock    *lock          `json:"lock,omitempty"`
+	ID      uint64         `json:"id,omitempty"`
+	Session *session       `json:"session,omitempty"`
+}
+
+// snapshotReceiver receives what readSnapshot reads: every key, by tree key,
+// every namespace but the default one, every lock held and every session.
+type snapshotReceiver struct {
+	key       func(k string, e *entry)
+	namespace func(name string, q command.Quota)
+	lock      func(name string, k *lock)
+	session   func(id uint64, s *session)
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrSnapshotCorrupt is returned by FsmRestore for a snapshot whose checksum
+// does not match its content.
+var ErrSnapshotCorrupt = errors.New("snapshot checksum mismatch")
+
+// Compression is the compression of a snapshot payload.
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionSnappy
+)
+
+// ParseCompression returns the Compression named name: "none" (or empty),
+// "gzip" or "snappy".
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	}
+	return 0, fmt.Errorf("unknown snapshot compression: %s", name)
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionSnappy:
+		return "snappy"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+// compress returns a writer compressing into w. Closing it flushes the
+// compressed stream but leaves w open.
+func (c Compression) compress(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressionNone:
+		return nopCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionSnappy:
+		return snappy.NewBufferedWriter(w), nil
+	}
+	return nil, fmt.Errorf("unknown snapshot compression: %d", byte(c))
+}
+
+// decompress returns a reader decompressing r.
+func (c Compression) decompress(r io.Reader) (io.Reader, error) {
+	switch c {
+	case CompressionNone:
+		return r, nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionSnappy:
+		return snappy.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unknown snapshot compression: %d", byte(c))
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// readSnapshot reads a snapshot written by fsmSnapshot, or a legacy
+// plain-JSON one, into rcv. It returns the index and term of the last log
+// entry the snapshot reflects. The checksum can only be validated once the
+// whole snapshot has been read, so rcv may receive content before a
+// corrupted snapshot is rejected with ErrSnapshotCorrupt.
+func readSnapshot(r io.Reader, rcv *snapshotReceiver) (index, term uint64, err error) {
+	br := bufio.NewReaderSize(r, snapshotBufferSize)
+	if magic, _ := br.Peek(len(snapshotMagic)); !bytes.Equal(magic, snapshotMagic) {
+		b, err := ioutil.ReadAll(br)
+		if err != nil {
+			return 0, 0, err
+		}
+		data, err := decodeSnapshot(b)
+		if err != nil {
+			return 0, 0, err
+		}
+		for k, e := range data.Entries {
+			rcv.key(k, e)
+		}
+		return data.Index, data.Term, nil
+	}
+
+	cr := &checkReader{br: br, crc: crc32.New(crcTable)}
+	var header [snapshotHeaderSize]byte
+	if _, err := io.ReadFull(cr, header[:]); err != nil {
+		return 0, 0, fmt.Errorf("read snapshot header: %s", err)
+	}
+	index = binary.BigEndian.Uint64(header[6:])
+	term = binary.BigEndian.Uint64(header[14:])
+
+	err = readPayload(cr, header[4], Compression(header[5]), rcv)
+	if err != nil {
+		// A payload that does not decode is most likely corrupted,
+		// report it as such if the checksum confirms it.
+		io.Copy(ioutil.Discard, cr)
+	}
+	var trailer [4]byte
+	if _, terr := io.ReadFull(br, trailer[:]); terr != nil || binary.BigEndian.Uint32(trailer[:]) != cr.crc.Sum32() {
+		return 0, 0, ErrSnapshotCorrupt
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return index, term, nil
+}
+
+// readPayload decodes the payload of an envelope of the given format, read
+// from r, up to its end.
+func readPayload(r io.Reader, format byte, c Compression, rcv *snapshotReceiver) error {
+	dr, err := c.decompress(r)
+	if err != nil {
+		return err
+	}
+	pr := bufio.NewReaderSize(dr, snapshotBufferSize)
+	switch format {
+	case 1:
+		b, err := ioutil.ReadAll(pr)
+		if err != nil {
+			return err
+		}
+		data, err := decodeSnapshot(b)
+		if err != nil {
+			return err
+		}
+		for k, e := range data.Entries {
+			rcv.key(k, e)
+		}
+	case 2, 3, 4, 5:
+		if err := readRecords(pr, format >= 3, rcv); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported snapshot format %d", format)
+	}
+	// Consume what is left of the payload, e.g. the gzip footer, so the
+	// checksum covers all of it.
+	_, err = io.Copy(ioutil.Discard, pr)
+	return err
+}
+
+// readRecords decodes records from r up to the end marker, in sections if
+// sections is set.
+func readRecords(r *bufio.Reader, sections bool, rcv *snapshotReceiver) error {
+	var buf []byte
+	dec := codec.NewDecoderBytes(nil, msgpackHandle)
+	ns, inSection := "", !sections
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("read snapshot record: %s", err)
+		}
+		if n == 0 {
+			return nil
+		}
+		if n > maxSnapshotRecordSize {
+			return fmt.Errorf("%w: record of %d bytes", ErrSnapshotCorrupt, n)
+		}
+		if buf, err = readRecord(r, buf, int(n)); err != nil {
+			return fmt.Errorf("read snapshot record: %s", err)
+		}
+		var rec snapshotRecord
+		dec.ResetBytes(buf)
+		if err := dec.Decode(&rec); err != nil {
+			return fmt.Errorf("decode snapshot record: %s", err)
+		}
+		if rec.Lock != nil {
+			if rec.Key == "" {
+				return fmt.Errorf("snapshot record for a lock without name")
+			}
+			rcv.lock(rec.Key, rec.Lock)
+			continue
+		}
+		if rec.Session != nil {
+			if rec.ID == 0 {
+				return fmt.Errorf("snapshot record for a session without ID")
+			}
+			rcv.session(rec.ID, rec.Session)
+			continue
+		}
+		if sections && rec.Entry == nil {
+			if rec.NS != "" && !namespaceName.MatchString(rec.NS) {
+				return fmt.Errorf("snapshot section for invalid namespace %q", rec.NS)
+			}
+			ns, inSection = rec.NS, true
+			if ns != "" {
+				var q command.Quota
+				if rec.Quota != nil {
+					q = *rec.Quota
+				}
+				rcv.namespace(ns, q)
+			}
+			continue
+		}
+		if rec.Entry == nil {
+			return fmt.Errorf("snapshot record for key %q has no entry", rec.Key)
+		}
+		if !inSection {
+			return fmt.Errorf("snapshot record for key %q outside of any section", rec.Key)
+		}
+		rcv.key(treeKey(ns, rec.Key), rec.Entry)
+	}
+}
+
+// readRecord reads a record of n bytes from r into buf, which it returns. buf
+// grows as the bytes arrive, so a length past the end of a truncated
+// snapshot fails before allocating that much.
+func readRecord(r io.Reader, buf []byte, n int) ([]byte, error) {
+	buf = buf[:0]
+	for len(buf) < n {
+		m := n - len(buf)
+		if m > snapshotBufferSize {
+			m = snapshotBufferSize
+		}
+		if cap(buf)-len(buf) < m {
+			buf = append(buf[:cap(buf)], make([]byte, m)...)[:len(buf)]
+		}
+		if _, err := io.ReadFull(r, buf[len(buf):len(buf)+m]); err != nil {
+			return buf, err
+		}
+		buf = buf[:len(buf)+m]
+	}
+	return buf, nil
+}
+
+// checkReader reads an envelope up to its 4 bytes trailer, which it leaves
+// in br, and sums what it reads.
+type checkReader struct {
+	br  *bufio.Reader
+	crc hash.Hash32
+}
+
+func (c *checkReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n := len(p)
+	if max := c.br.Size() - 4; n > max {
+		n = max
+	}
+	b, err := c.br.Peek(n + 4)
+	if n = len(b) - 4; n <= 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	copy(p, b[:n])
+	c.br.Discard(n)
+	c.crc.Write(p[:n])
+	return n, nil
+}
+
+// snapshotVersion is the version of the snapshotData in the payload of the
+// snapshots written by fsmSnapshot. Plain-JSON snapshots without a version
+// hold values as JSON strings, version 1 holds them as bytes, base64 encoded.
+const snapshotVersion = 1
+
+// snapshotData is the JSON document in the payload of a snapshot.
+type snapshotData struct {
+	Version int               `json:"version,omitempty"`
+	Index   uint64            `json:"index"`
+	Term    uint64            `json:"term"`
+	Entries map[string]*entry `json:"entries,omitempty"`
+}
+
+// textSnapshotData is snapshotData before values were bytes. KV holds plain
+// values in snapshots written before entries carried a TTL.
+type textSnapshotData struct {
+	Index   uint64                `json:"index"`
+	Term    uint64                `json:"term"`
+	Entries map[string]*textEntry `json:"entries,omitempty"`
+	KV      map[string]string     `json:"kv,omitempty"`
+}
+
+type textEntry struct {
+	Value       string `json:"value"`
+	Expires     int64  `json:"expires,omitempty"`
+	ModIndex    uint64 `json:"mod_index,omitempty"`
+	CreateIndex uint64 `json:"create_index,omitempty"`
+}
+
+// decodeSnapshot decodes a plain-JSON snapshot or payload, falling back to the unversioned format
+// holding text values, and to the legacy format that was a bare JSON object
+// of keys to values and carried no applied index.
+func decodeSnapshot(b []byte) (*snapshotData, error) {
+	var data snapshotData
+	if err := decodeStrict(b, &data); err == nil && data.Version == snapshotVersion {
+		if data.Entries == nil {
+			data.Entries = make(map[string]*entry)
+		}
+		return &data, nil
+	}
+
+	var text textSnapshotData
+	if err := decodeStrict(b, &text); err != nil {
+		o := make(map[string]string)
+		if err := json.Unmarshal(b, &o); err != nil {
+			return nil, err
+		}
+		text = textSnapshotData{KV: o}
+	}
+	data = snapshotData{
+		Version: snapshotVersion,
+		Index:   text.Index,
+		Term:    text.Term,
+		Entries: make(map[string]*entry, len(text.Entries)+len(text.KV)),
+	}
+	for k, e := range text.Entries {
+		data.Entries[k] = &entry{Value: []byte(e.Value), Expires: e.Expires, ModIndex: e.ModIndex, CreateIndex: e.CreateIndex}
+	}
+	for k, v := range text.KV {
+		data.Entries[k] = &entry{Value: []byte(v)}
+	}
+	return &data, nil
+}
+
+// decodeStrict decodes the JSON document b into v, failing on fields v does
+// not have.
+func decodeStrict(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+type fsmSnapshot struct {
+	*state
+	compression Compression
+}
+
+func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := f.write(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// write writes the snapshot envelope to w.
+func (f *fsmSnapshot) write(w io.Writer) error {
+	crc := crc32.New(crcTable)
+	bw := bufio.NewWriterSize(io.MultiWriter(w, crc), snapshotBufferSize)
+
+	var header [snapshotHeaderSize]byte
+	copy(header[:], snapshotMagic)
+	header[4] = snapshotFormat
+	header[5] = byte(f.compression)
+	binary.BigEndian.PutUint64(header[6:], f.index)
+	binary.BigEndian.PutUint64(header[14:], f.term)
+	if _, err := bw.Write(header[:]); err != nil {
+		return err
+	}
+
+	cw, err := f.compression.compress(bw)
+	if err != nil {
+		return err
+	}
+	rw := &recordWriter{w: cw, enc: codec.NewEncoderBytes(nil, msgpackHandle)}
+	if err := f.writeSection(rw, ""); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(f.namespaces))
+	for name := range f.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := f.writeSection(rw, name); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedLocks(f.locks) {
+		if err := rw.write(&snapshotRecord{Key: name, Lock: f.locks[name]}); err != nil {
+			return err
+		}
+	}
+	for _, id := range sortedSessions(f.sessions) {
+		if err := rw.write(&snapshotRecord{ID: id, Session: f.sessions[id]}); err != nil {
+			return err
+		}
+	}
+	if err := rw.end(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	var trailer [4]byte
+	binary.BigEndian.PutUint32(trailer[:], crc.Sum32())
+	_, err = w.Write(trailer[:])
+	return err
+}
+
+// writeSection writes the section of namespace ns: its header and its keys.
+func (f *fsmSnapshot) writeSection(rw *recordWriter, ns string) error {
+	header := &snapshotRecord{NS: ns}
+	if ns != "" {
+		q := f.namespaces[ns]
+		header.Quota = &q
+	}
+	if err := rw.write(header); err != nil {
+		return err
+	}
+
+	p := nsPrefix(ns)
+	it := f.tree.Root().Iterator()
+	if ns == "" {
+		// The keys of the other namespaces all sort before "\x01",
+		// and only the empty key of the default one does.
+		if v, ok := f.tree.Get(nil); ok {
+			if err := rw.write(&snapshotRecord{Entry: v.(*entry)}); err != nil {
+				return err
+			}
+		}
+		it.SeekLowerBound([]byte("\x01"))
+	} else {
+		it.SeekPrefix([]byte(p))
+	}
+	for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+		if err := rw.write(&snapshotRecord{Key: string(k[len(p):]), Entry: v.(*entry)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordWriter writes length-prefixed records, reusing one buffer.
+type recordWriter struct {
+	w   io.Writer
+	buf []byte
+	enc *codec.Encoder
+}
+
+func (rw *recordWriter) write(rec *snapshotRecord) error {
+	rw.buf = rw.buf[:0]
+	rw.enc.ResetBytes(&rw.buf)
+	if err := rw.enc.Encode(rec); err != nil {
+		return err
+	}
+	var n [binary.MaxVarintLen64]byte
+	if _, err := rw.w.Write(n[:binary.PutUvarint(n[:], uint64(len(rw.buf)))]); err != nil {
+		return err
+	}
+	_, err := rw.w.Write(rw.buf)
+	return err
+}
+
+// end writes the end marker, a zero length.
+func (rw *recordWriter) end() error {
+	_, err := rw.w.Write([]byte{0})
+	return err
+}
+
+func (f *fsmSnapshot) Release() {}
@@ -1,139 +1,778 @@
 package store
 import (
-	"sync"
+	"bytes"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"io"
-	"encoding/json"
-	// "time"
+	"time"
+	iradix "github.com/hashicorp/go-immutable-radix"
 	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
 	"github.com/ifoxhz/raft-nginx/helper"
+	"github.com/ifoxhz/raft-nginx/raftnode"
 	// "github.com/syndtr/goleveldb/leveldb"
+	bolt "go.etcd.io/bbolt"
 )
 
 type Store struct {
 	inmem    bool
-	mu sync.Mutex
-	m  map[string]string // The key-value store for the system.
+
+	// state is the applied state, replaced as a whole once a log entry is
+	// applied. Readers load it without locking.
+	state atomic.Pointer[state]
+
+	// mu serializes the writers, which apply log entries to txn, a
+	// transaction on the current tree, and commit it as the next state.
+	// index and term are those of the entry being applied.
+	mu    sync.Mutex
+	txn   *iradix.Txn
 	index uint64
 	term  uint64
+	db    *bolt.DB // Backing file, nil for a purely in-memory store.
+
+	// expiring holds the deadline of every key that has a TTL, so the
+	// leader can find expired keys without scanning the whole store.
+	expiring map[string]int64
+
+	// pending holds the mutations of the log entry being applied until
+	// they are flushed to db, events the changes it made until they are
+	// published to hub.
+	pending map[string]*entry
+	events  []raftnode.Event
+	hub     *raftnode.EventHub
+
+	// history holds, per key, the versions replaced within the history
+	// window, oldest first, and histQueue the same versions in the order
+	// they were replaced, to trim them as the window moves. Versions are
+	// only kept in memory: after a restart or a restore the history starts
+	// at histFirst.
+	history   map[string][]version
+	histQueue []versionRef
+	histFirst uint64
+
+	compression Compression    // Of the snapshots taken.
+	limits      command.Limits // Of the command being applied.
+
+	// namespaces holds the quota of every namespace but the default one,
+	// usage the keys and bytes of every namespace, the default one
+	// included, as changed by the log entry being applied. pendingNS holds
+	// the namespaces it created, changed or deleted (nil) until they are
+	// flushed to db.
+	namespaces map[string]command.Quota
+	usage      map[string]usage
+	pendingNS  map[string]*command.Quota
+
+	// locks holds the lease of every lock held, as changed by the log
+	// entry being applied, and pendingLocks the leases it changed or
+	// dropped (nil) until they are flushed to db.
+	locks        map[string]*lock
+	pendingLocks map[string]*lock
+
+	// sessions holds every session, as changed by the log entry being
+	// applied, pendingSessions the sessions it changed or ended (nil) until
+	// they are flushed to db, and sessionKeys the tree keys attached to
+	// every session that has some.
+	sessions        map[uint64]*session
+	pendingSessions map[uint64]*session
+	sessionKeys     map[uint64]map[string]struct{}
 }
 
+// state is a point-in-time view of the store: every key mapped to its *entry
+// in an immutable radix tree, the namespaces, locks and sessions it holds,
+// and the index and term of the last log entry applied to it. A snapshot is
+// taken by holding on to one. namespaces, locks and sessions are never
+// modified once stored.
+type state struct {
+	tree       *iradix.Tree
+	namespaces map[string]command.Quota
+	locks      map[string]*lock
+	sessions   map[uint64]*session
+	index      uint64
+	term       uint64
+}
+
+func (s *state) get(key string) *entry {
+	if v, ok := s.tree.Get([]byte(key)); ok {
+		return v.(*entry)
+	}
+	return nil
+}
+
+// version is a state of a key, nil if it did not exist, that was current
+// until the log entry at index until replaced it.
+type version struct {
+	e     *entry
+	until uint64
+}
+
+type versionRef struct {
+	key   string
+	until uint64
+}
+
+// historyWindow is the number of log indexes for which past versions of keys
+// are kept.
+const historyWindow = 10000
+
+// watchHistory is the number of events kept for watches that resume from a
+// past index.
+const watchHistory = 10000
 
-type command struct {
-	Op    string `json:"op,omitempty"`
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
+// entry is the value stored for a key. Entries are never modified once
+// stored, a mutation replaces the whole entry, so states can share them.
+type entry struct {
+	Value       []byte `json:"value"`
+	Expires     int64  `json:"expires,omitempty"`      // Deadline in Unix nanoseconds, 0 if the key has no TTL.
+	ModIndex    uint64 `json:"mod_index,omitempty"`    // Index of the log entry that last set the key.
+	CreateIndex uint64 `json:"create_index,omitempty"` // Index of the log entry that created the key.
+	Session     uint64 `json:"session,omitempty"`      // Session the key is deleted with, 0 if none.
 }
 
 
+// TxnOpResult is the outcome of one operation of a "txn" command. For a
+// compare, Succeeded tells whether its precondition held and ModIndex is
+// the key's modify index; for a set, ModIndex is the key's new one.
+type TxnOpResult struct {
+	Op        string `json:"op"`
+	Key       string `json:"key"`
+	Succeeded bool   `json:"succeeded"`
+	ModIndex  uint64 `json:"mod_index,omitempty"`
+}
+
+// TxnResult is returned by FsmApply for a "txn" command. If any compare did
+// not hold, none of the operations was applied and Succeeded is false.
+type TxnResult struct {
+	Index     uint64        `json:"index"` // Index of the log entry the txn was applied at.
+	Succeeded bool          `json:"succeeded"`
+	Results   []TxnOpResult `json:"results"`
+}
+
+// Conflict marks a failed transaction, see raftnode.IsConflict.
+func (r *TxnResult) Conflict() bool { return !r.Succeeded }
+
+// NewStore returns an in-memory Store, whose state is rebuilt from raft
+// snapshots and log on every start. Use OpenStore for a disk-backed one.
 func NewStore(inmem bool) *Store {
-	return &Store{
-		m:      make(map[string]string),
-		inmem:  inmem,
+	st := &Store{
+		inmem:    inmem,
+		expiring: make(map[string]int64),
+		hub:      raftnode.NewEventHub(watchHistory, 0),
+		history:  make(map[string][]version),
+
+		namespaces: make(map[string]command.Quota),
+		usage:      make(map[string]usage),
+		locks:      make(map[string]*lock),
+
+		sessions:    make(map[uint64]*session),
+		sessionKeys: make(map[uint64]map[string]struct{}),
 	}
+	st.state.Store(&state{tree: iradix.New(), namespaces: st.namespaces, locks: st.locks, sessions: st.sessions})
+	return st
 }
 
+// Close releases the backing database, if any.
+func (st *Store) Close() error {
+	if st.db == nil {
+		return nil
+	}
+	return st.db.Close()
+}
 
-// Get returns the value for the given key.
-func (st *Store) Get(key string) (string, error) {
+// SetSnapshotCompression sets how the payload of the snapshots taken from now
+// on is compressed. Snapshots are restored whatever their compression.
+func (st *Store) SetSnapshotCompression(c Compression) {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	return st.m[key], nil
+	st.compression = c
 }
 
+// Size implements raftnode.Sizer.
+func (st *Store) Size() (keys, bytes int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, u := range st.usage {
+		keys += u.keys
+		bytes += u.bytes
+	}
+	return keys, bytes
+}
 
+// AppliedIndex returns the index of the last raft log entry applied.
+func (st *Store) AppliedIndex() uint64 {
+	return st.state.Load().index
+}
 
-// Apply applies a Raft log entry to the key-value store.
-func (st *Store) FsmApply(l *raft.Log) interface{} {
-	var c command
-	if err := json.Unmarshal(l.Data, &c); err != nil {
-		(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
+
+// Get returns the value for the given key, nil if it does not exist. The
+// read methods of Store read the default namespace, see Namespace for the
+// others.
+func (st *Store) Get(key string) ([]byte, error) {
+	return view{st: st}.Get(key)
+}
+
+// GetRevision returns the value for the given key together with the index
+// of the log entry that last modified it, 0 if the key does not exist.
+func (st *Store) GetRevision(key string) ([]byte, uint64, error) {
+	return view{st: st}.GetRevision(key)
+}
+
+// GetAt implements raftnode.Versioned. Past versions are kept for the last
+// historyWindow indexes, and only since the store was opened or last
+// restored from a snapshot. Reads of past indexes lock the history.
+func (st *Store) GetAt(key string, index uint64) ([]byte, uint64, uint64, error) {
+	return view{st: st}.GetAt(key, index)
+}
+
+// getAt implements GetAt for tree key k.
+func (st *Store) getAt(k string, index uint64) ([]byte, uint64, uint64, error) {
+	if index == 0 {
+		e := st.state.Load().get(k)
+		if e == nil {
+			return nil, 0, 0, nil
+		}
+		return e.Value, e.CreateIndex, e.ModIndex, nil
 	}
 
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	cur := st.state.Load()
+	if index > cur.index {
+		return nil, 0, 0, raftnode.ErrNotApplied
+	}
+	floor := st.histFirst
+	if cur.index > historyWindow && cur.index-historyWindow > floor {
+		floor = cur.index - historyWindow
+	}
+	if index < floor {
+		return nil, 0, 0, raftnode.ErrCompacted
+	}
+	// The first version replaced after index was the current one at
+	// index.
+	e := cur.get(k)
+	vs := st.history[k]
+	i := sort.Search(len(vs), func(i int) bool { return vs[i].until > index })
+	if i < len(vs) {
+		e = vs[i].e
+	}
+	if e == nil {
+		return nil, 0, 0, nil
+	}
+	return e.Value, e.CreateIndex, e.ModIndex, nil
+}
 
-	helper.Logger.Info("RaftFsm Apply set", "key", c.Key, "value", c.Value)
+// Range calls fn, in key order, for every key in [start, end) that has prefix,
+// until fn returns false. An empty end means no upper bound. The keys are
+// those of the state at the time of the call, whatever is applied while fn
+// runs. fn must not modify value.
+func (st *Store) Range(prefix, start, end string, fn func(key string, value []byte) bool) error {
+	return view{st: st}.Range(prefix, start, end, fn)
+}
 
-	st.index = l.Index
-	st.term = l.Term
+// Watch returns the changes to key, or to every key under it if prefix is
+// set, applied from the log entry at index onwards.
+func (st *Store) Watch(key string, prefix bool, index uint64) (*raftnode.Watch, error) {
+	return view{st: st}.Watch(key, prefix, index)
+}
 
-	switch c.Op {
-	case "set":
-		return st.applySet(c.Key, c.Value)
-	case "delete":
-		return st.applyDelete(c.Key)
-	default:
-		helper.Logger.Error(fmt.Sprintf("unrecognized command op: %s", c.Op))
+// TTL returns the time key has left to live. ok is false if the key does not
+// exist or has no TTL. A key past its deadline is reported with a zero TTL
+// until the leader's expire command for it is applied.
+func (st *Store) TTL(key string) (ttl time.Duration, ok bool, err error) {
+	return view{st: st}.TTL(key)
+}
+
+// Expired returns up to max keys, of any namespace, whose deadline is at or
+// before now. It is called on the leader, which proposes an expire command
+// for each of them.
+func (st *Store) Expired(now int64, max int) []raftnode.ExpiredKey {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var o []raftnode.ExpiredKey
+	for k, expires := range st.expiring {
+		if len(o) >= max {
+			break
+		}
+		if expires <= now {
+			ns, key := splitKey(k)
+			o = append(o, raftnode.ExpiredKey{Namespace: ns, Key: key, Expires: expires})
+		}
 	}
-	return nil
+	return o
 }
 
-// Snapshot returns a snapshot base realizing the store state.
-func (st *Store) FsmSnapshot() (raft.FSMSnapshot, error) {
+
+
+// Apply applies a Raft log entry to the key-value store. Entries at or below
+// the applied index are already reflected in the store, typically because a
+// disk-backed store is ahead of the snapshot raft replays the log from, and
+// are skipped so they cannot roll newer state back.
+func (st *Store) FsmApply(l *raft.Log) interface{} {
+	return st.FsmApplyBatch([]*raft.Log{l})[0]
+}
+
+// FsmApplyBatch applies consecutive log entries like FsmApply, under a single
+// lock acquisition. Their changes are flushed to disk, then become visible to
+// readers, together once the last one is applied. A failure to flush them
+// panics, as the node would otherwise diverge from the others.
+func (st *Store) FsmApplyBatch(logs []*raft.Log) []interface{} {
+	resps := make([]interface{}, len(logs))
 	st.mu.Lock()
 	defer st.mu.Unlock()
 
-	// Clone the map.
-	o := make(map[string]string)
-	for k, v := range st.m {
-		o[k] = v
+	st.txn = st.state.Load().tree.Txn()
+	applied := 0
+	for i, l := range logs {
+		if l.Index <= st.index {
+			helper.Logger.Debug("skipping already applied log", "index", l.Index, "applied", st.index)
+			continue
+		}
+		st.index = l.Index
+		st.term = l.Term
+		applied++
+		c, err := command.Decode(l.Data)
+		if err != nil {
+			// Every node fails the entry alike, so it still counts as
+			// applied; the proposer gets the error.
+			helper.Logger.Error("failed to decode command", "index", l.Index, "error", err)
+			resps[i] = err
+			continue
+		}
+		helper.Logger.Debug("store apply", "index", l.Index, "op", c.Op, "key", c.Key, "size", len(c.Value))
+		resps[i] = st.apply(c, l)
+		countRejected(resps[i])
+	}
+	if applied == 0 {
+		st.txn = nil
+		return resps
 	}
 
-	return &fsmSnapshot{store:o}, nil
+	// The entries are committed, and applied by the other nodes, so a node
+	// that cannot persist them cannot go on: readers and watchers would see
+	// state lost on restart.
+	if err := st.flush(); err != nil {
+		helper.Logger.Error("failed to persist log entries", "index", st.index, "error", err)
+		panic(fmt.Sprintf("persist log entries up to %d: %s", st.index, err))
+	}
+	st.commit()
+	events := st.events
+	st.events = nil
+	st.hub.Publish(events...)
+	return resps
 }
 
-// Restore stores the key-value store to a previous state.
-func (st *Store) FsmRestore(rc io.ReadCloser) error {
-	o := make(map[string]string)
-	if err := json.NewDecoder(rc).Decode(&o); err != nil {
-		return err
+// commit publishes the changes made to st.txn as the state at the applied
+// index.
+func (st *Store) commit() {
+	st.state.Store(&state{tree: st.txn.Commit(), namespaces: st.namespaces, locks: st.locks, sessions: st.sessions, index: st.index, term: st.term})
+	st.txn = nil
+}
+
+// lookup returns the entry of key as changed so far by the log entry being
+// applied, nil if the key does not exist.
+func (st *Store) lookup(key string) *entry {
+	if v, ok := st.txn.Get([]byte(key)); ok {
+		return v.(*entry)
 	}
-	helper.Logger.Debug("store FsmRestore","json",o)
-	// Set the state from the snapshot, no lock required according to
-	// Hashicorp docs.
-	st.m = o
 	return nil
 }
 
-func (st *Store) applySet(key, value string) interface{} {
+// countRejected counts the writes resp, the response to a command, rejected
+// for exceeding a limit.
+func countRejected(resp interface{}) {
+	switch r := resp.(type) {
+	case error:
+		command.CountRejected(r)
+	case []interface{}:
+		for _, r := range r {
+			countRejected(r)
+		}
+	}
+}
+
+// apply applies c, read from l, with st.mu held. c is checked against the
+// limits it carries, the commands of a batch one by one, and so is what it
+// writes.
+func (st *Store) apply(c *command.Command, l *raft.Log) interface{} {
+	if c.Op != command.OpBatch {
+		st.limits = command.Limits{}
+		if c.Limits != nil {
+			st.limits = *c.Limits
+		}
+		if err := st.limits.Check(c); err != nil {
+			return err
+		}
+	}
+	switch c.Op {
+	case command.OpSet:
+		return st.applySetKey(c, newEntry(c, l))
+	case command.OpCAS:
+		return st.applyCAS(c, newEntry(c, l))
+	case command.OpDelete:
+		return st.applyDelete(c)
+	case command.OpExpire:
+		return st.applyExpire(c)
+	case command.OpTxn:
+		return st.applyTxn(c, l)
+	case command.OpBatch:
+		return st.applyBatch(c, l)
+	case command.OpSetNamespace:
+		return st.applySetNamespace(c)
+	case command.OpDeleteNamespace:
+		return st.applyDeleteNamespace(c)
+	case command.OpAcquire:
+		return st.applyAcquire(c, l)
+	case command.OpRenew:
+		return st.applyRenew(c, l)
+	case command.OpRelease:
+		return st.applyRelease(c)
+	case command.OpIncr, command.OpDecr:
+		return st.applyIncr(c, l)
+	case command.OpCreateSession:
+		return st.applyCreateSession(c, l)
+	case command.OpRenewSession:
+		return st.applyRenewSession(c, l)
+	case command.OpDestroySession:
+		return st.applyDestroySession(c)
+	case command.OpMergePatch, command.OpJSONPatch:
+		return st.applyPatch(c, l)
+	}
+	return command.Errorf(command.CodeUnsupported, "unsupported command op: %s", c.Op)
+}
+
+// Snapshot returns a snapshot of the current state. The state is immutable,
+// so this takes constant time and the snapshot is persisted while entries
+// keep being applied.
+func (st *Store) FsmSnapshot() (raft.FSMSnapshot, error) {
 	st.mu.Lock()
-	defer st.mu.Unlock()
-	st.m[key] = value
-	return nil
+	c := st.compression
+	st.mu.Unlock()
+
+	s := st.state.Load()
+	return &fsmSnapshot{state: s, compression: c}, nil
 }
 
-func (st *Store) applyDelete(key string) interface{} {
+// Restore stores the key-value store to a previous state. The applied
+// index and term are reset to the ones recorded in the snapshot, as raft
+// resumes applying the log right after it.
+func (st *Store) FsmRestore(rc io.ReadCloser) error {
+	// The snapshot is decoded into a new tree, which replaces the current
+	// one only once the whole snapshot has been read and validated.
+	txn := iradix.New().Txn()
+	s := &state{
+		namespaces: make(map[string]command.Quota),
+		locks:      make(map[string]*lock),
+		sessions:   make(map[uint64]*session),
+	}
+	var err error
+	s.index, s.term, err = readSnapshot(rc, &snapshotReceiver{
+		key:       func(k string, e *entry) { txn.Insert([]byte(k), e) },
+		namespace: func(name string, q command.Quota) { s.namespaces[name] = q },
+		lock:      func(name string, k *lock) { s.locks[name] = k },
+		session:   func(id uint64, ss *session) { s.sessions[id] = ss },
+	})
+	if err != nil {
+		return err
+	}
+	s.tree = txn.Commit()
+	helper.Logger.Debug("store FsmRestore", "index", s.index, "term", s.term, "keys", s.tree.Len(), "namespaces", len(s.namespaces), "locks", len(s.locks), "sessions", len(s.sessions))
+
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	delete(st.m, key)
-	return nil
+	st.reset(s)
+	return st.persistAll(s)
+}
+
+// reset replaces the whole state with s, with st.mu held or before the store
+// is used. The history starts over from there. Maps s lacks are created
+// empty.
+func (st *Store) reset(s *state) {
+	if s.namespaces == nil {
+		s.namespaces = make(map[string]command.Quota)
+	}
+	if s.locks == nil {
+		s.locks = make(map[string]*lock)
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[uint64]*session)
+	}
+	st.index = s.index
+	st.term = s.term
+	st.namespaces = s.namespaces
+	st.locks = s.locks
+	st.sessions = s.sessions
+	st.state.Store(s)
+	st.hub.Reset(s.index)
+	st.history = make(map[string][]version)
+	st.histQueue = nil
+	st.histFirst = s.index
+	st.expiring = make(map[string]int64)
+	st.usage = make(map[string]usage)
+	st.sessionKeys = make(map[uint64]map[string]struct{})
+	s.tree.Root().Walk(func(k []byte, v interface{}) bool {
+		e := v.(*entry)
+		if e.Expires != 0 {
+			st.expiring[string(k)] = e.Expires
+		}
+		st.account(string(k), nil, e)
+		st.attach(string(k), nil, e)
+		return false
+	})
+}
+
+// newEntry returns the entry a set or cas command stores, modified at l.
+func newEntry(c *command.Command, l *raft.Log) *entry {
+	expires := c.Expires
+	if expires == 0 && c.TTL > 0 && !l.AppendedAt.IsZero() {
+		// Proposed without a deadline: derive it from the time the
+		// leader appended the entry, which followers see as well.
+		expires = l.AppendedAt.Add(time.Duration(c.TTL) * time.Second).UnixNano()
+	}
+	return &entry{Value: c.Value, Expires: expires, ModIndex: l.Index, Session: c.Session}
+}
+
+// result returns the result of c, which changed its key from old to e, nil
+// meaning that it did not exist.
+func (st *Store) result(c *command.Command, old, e *entry) *command.Result {
+	res := &command.Result{Op: c.Op, Namespace: c.Namespace, Key: c.Key, Index: st.index}
+	if old != nil {
+		res.PrevRevision = old.ModIndex
+		res.PrevValue = old.Value
+	}
+	if e != nil {
+		res.Revision = e.ModIndex
+	}
+	return res
+}
+
+// applySetKey, applyCAS, applyDelete, applyExpire and applyTxn must be
+// called with st.mu held. applySetKey stores e as the key of c, if its
+// namespace stays within its quota.
+func (st *Store) applySetKey(c *command.Command, e *entry) interface{} {
+	k, err := st.key(c)
+	if err != nil {
+		return err
+	}
+	if err := st.checkSession(c); err != nil {
+		return err
+	}
+	if err := (&quotaCheck{st: st}).set(k, e); err != nil {
+		return err
+	}
+	return st.result(c, st.applySet(k, e), e)
+}
+
+// applySet stores e as tree key k and returns the entry it replaced.
+func (st *Store) applySet(k string, e *entry) *entry {
+	old := st.lookup(k)
+	if old != nil && old.CreateIndex != 0 {
+		e.CreateIndex = old.CreateIndex
+	} else if old == nil {
+		e.CreateIndex = e.ModIndex
+	}
+	st.record(k, old)
+	st.txn.Insert([]byte(k), e)
+	if e.Expires != 0 {
+		st.expiring[k] = e.Expires
+	} else {
+		delete(st.expiring, k)
+	}
+	st.account(k, old, e)
+	st.attach(k, old, e)
+	st.stage(k, e)
+	ns, key := splitKey(k)
+	st.events = append(st.events, raftnode.Event{Index: st.index, Op: "set", Namespace: ns, Key: key, Value: e.Value})
+	return old
 }
 
-type fsmSnapshot struct {
-	store map[string]string
+// applyCAS stores e only if the preconditions of c hold, and returns a
+// conflict *command.Error otherwise.
+func (st *Store) applyCAS(c *command.Command, e *entry) interface{} {
+	if c.PrevIndex == nil && c.PrevValue == nil {
+		return command.Errorf(command.CodeInvalid, "cas on key %s without precondition", c.Key)
+	}
+	k, err := st.key(c)
+	if err != nil {
+		return err
+	}
+	if err := st.checkSession(c); err != nil {
+		return err
+	}
+	if ok, modIndex := st.compare(k, c); !ok {
+		return command.ConflictError(c.Key, modIndex)
+	}
+	if err := (&quotaCheck{st: st}).set(k, e); err != nil {
+		return err
+	}
+	return st.result(c, st.applySet(k, e), e)
 }
 
-func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
-	err := func() error {
-		// Encode data.
-		b, err := json.Marshal(f.store)
+// compare reports whether the preconditions of c hold for tree key k, and
+// returns its current modify index.
+func (st *Store) compare(k string, c *command.Command) (bool, uint64) {
+	cur := st.lookup(k)
+	exists := cur != nil
+	var modIndex uint64
+	if exists {
+		modIndex = cur.ModIndex
+	}
+	if c.PrevIndex != nil && *c.PrevIndex != modIndex {
+		return false, modIndex
+	}
+	if c.PrevValue != nil && (!exists || !bytes.Equal(cur.Value, *c.PrevValue)) {
+		return false, modIndex
+	}
+	return true, modIndex
+}
+
+// applyTxn evaluates every compare of c first, and applies its sets and
+// deletes in order only if they all hold and keep their namespaces within
+// their quota. All of them are flushed to disk together with the log entry.
+func (st *Store) applyTxn(c *command.Command, l *raft.Log) interface{} {
+	res := &TxnResult{Index: l.Index, Succeeded: true, Results: make([]TxnOpResult, len(c.Ops))}
+	keys := make([]string, len(c.Ops))
+	for i, op := range c.Ops {
+		res.Results[i] = TxnOpResult{Op: op.Op.String(), Key: op.Key}
+		k, err := st.key(op)
 		if err != nil {
 			return err
 		}
+		keys[i] = k
+		switch op.Op {
+		case command.OpCompare:
+			if op.PrevIndex == nil && op.PrevValue == nil {
+				return command.Errorf(command.CodeInvalid, "txn compare on key %s without precondition", op.Key)
+			}
+			ok, modIndex := st.compare(k, op)
+			res.Results[i].Succeeded = ok
+			res.Results[i].ModIndex = modIndex
+			if !ok {
+				res.Succeeded = false
+			}
+		case command.OpSet:
+			if err := st.checkSession(op); err != nil {
+				return err
+			}
+		case command.OpDelete:
+		default:
+			return command.Errorf(command.CodeInvalid, "unsupported txn op: %s", op.Op)
+		}
+	}
+	if !res.Succeeded {
+		return res
+	}
+
+	entries := make([]*entry, len(c.Ops))
+	q := &quotaCheck{st: st}
+	for i, op := range c.Ops {
+		switch op.Op {
+		case command.OpSet:
+			entries[i] = newEntry(op, l)
+			if err := q.set(keys[i], entries[i]); err != nil {
+				return err
+			}
+		case command.OpDelete:
+			q.delete(keys[i])
+		}
+	}
 
-		// Write data to sink.
-		if _, err := sink.Write(b); err != nil {
-			return err
+	for i, op := range c.Ops {
+		switch op.Op {
+		case command.OpSet:
+			st.applySet(keys[i], entries[i])
+			res.Results[i].ModIndex = l.Index
+		case command.OpDelete:
+			st.remove(keys[i], "delete")
+		default:
+			continue
 		}
+		res.Results[i].Succeeded = true
+	}
+	return res
+}
 
-		// Close the sink.
-		return sink.Close()
-	}()
+// applyBatch applies the commands of c, which the leader coalesced from
+// concurrent client requests, in order. Unlike the operations of a txn, each
+// one succeeds or fails on its own: the response is a slice holding the
+// response to every command at its position.
+func (st *Store) applyBatch(c *command.Command, l *raft.Log) interface{} {
+	resps := make([]interface{}, len(c.Ops))
+	for i, op := range c.Ops {
+		if op.Op == command.OpBatch {
+			resps[i] = command.Errorf(command.CodeInvalid, "nested batch command")
+			continue
+		}
+		resps[i] = st.apply(op, l)
+	}
+	return resps
+}
 
+func (st *Store) applyDelete(c *command.Command) interface{} {
+	k, err := st.key(c)
 	if err != nil {
-		sink.Cancel()
+		return err
 	}
+	return st.result(c, st.remove(k, "delete"), nil)
+}
 
-	return err
+// remove deletes tree key k, recording op as the cause of the change, and
+// returns the entry it removed.
+func (st *Store) remove(k, op string) *entry {
+	old := st.lookup(k)
+	if old == nil {
+		return nil
+	}
+	st.record(k, old)
+	st.txn.Delete([]byte(k))
+	delete(st.expiring, k)
+	st.account(k, old, nil)
+	st.attach(k, old, nil)
+	st.stage(k, nil)
+	ns, key := splitKey(k)
+	st.events = append(st.events, raftnode.Event{Index: st.index, Op: op, Namespace: ns, Key: key})
+	return old
 }
 
-func (f *fsmSnapshot) Release() {}
+// account updates the usage of the namespace of tree key k, which changed
+// from old to e.
+func (st *Store) account(k string, old, e *entry) {
+	ns, key := splitKey(k)
+	st.usage[ns] = st.usage[ns].add(key, old, e)
+}
+
+// record keeps old, the version of key replaced by the log entry being
+// applied, in the history, and trims versions that fell out of the window.
+func (st *Store) record(key string, old *entry) {
+	st.history[key] = append(st.history[key], version{e: old, until: st.index})
+	st.histQueue = append(st.histQueue, versionRef{key: key, until: st.index})
+
+	if st.index <= historyWindow {
+		return
+	}
+	floor := st.index - historyWindow
+	n := 0
+	for ; n < len(st.histQueue) && st.histQueue[n].until <= floor; n++ {
+		ref := st.histQueue[n]
+		if vs := st.history[ref.key]; len(vs) > 1 {
+			st.history[ref.key] = vs[1:]
+		} else {
+			delete(st.history, ref.key)
+		}
+	}
+	st.histQueue = st.histQueue[n:]
+}
+
+// applyExpire deletes key if it still carries a deadline at or before
+// expires. A key that was set again after the leader saw it expire is kept.
+func (st *Store) applyExpire(c *command.Command) interface{} {
+	k, err := st.key(c)
+	if err != nil {
+		return err
+	}
+	e := st.lookup(k)
+	if e == nil || e.Expires == 0 || e.Expires > c.Expires {
+		return st.result(c, e, e)
+	}
+	return st.result(c, st.remove(k, "expire"), nil)
+}
@@ -0,0 +1,1597 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	iradix "github.com/hashicorp/go-immutable-radix"
+	"github.com/hashicorp/raft"
+	"github.com/ifoxhz/raft-nginx/command"
+	"github.com/ifoxhz/raft-nginx/helper"
+	"github.com/ifoxhz/raft-nginx/raftnode"
+)
+
+// Test_OpenStorePersists tests that a disk-backed store reloads its keys and
+// applied index after being reopened.
+func Test_OpenStorePersists(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "kv.db")
+
+	st, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "foo", Value: []byte("bar")})
+	applyCommand(t, st, 2, command.Command{Op: command.OpSet, Key: "baz", Value: []byte("qux")})
+	applyCommand(t, st, 3, command.Command{Op: command.OpDelete, Key: "baz"})
+	if err := st.Close(); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+
+	st, err = OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	defer st.Close()
+	if v, _ := st.Get("foo"); string(v) != "bar" {
+		t.Fatalf("key foo has wrong value after reopen: %q", v)
+	}
+	if v, _ := st.Get("baz"); string(v) != "" {
+		t.Fatalf("deleted key baz came back after reopen: %q", v)
+	}
+	if idx := st.AppliedIndex(); idx != 3 {
+		t.Fatalf("wrong applied index after reopen: %d", idx)
+	}
+}
+
+// Test_FsmApplyPersistFailure tests that a failure to persist applied log
+// entries panics without making them visible.
+func Test_FsmApplyPersistFailure(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	st, err := OpenStore(filepath.Join(tmpDir, "kv.db"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "foo", Value: []byte("bar")})
+	st.db.Close()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("failure to persist log entry did not panic")
+			}
+		}()
+		applyCommand(t, st, 2, command.Command{Op: command.OpSet, Key: "foo", Value: []byte("baz")})
+	}()
+	if v, _ := st.Get("foo"); string(v) != "bar" {
+		t.Fatalf("log entry that failed to persist is visible, foo is %q", v)
+	}
+	if idx := st.AppliedIndex(); idx != 1 {
+		t.Fatalf("wrong applied index: %d", idx)
+	}
+}
+
+// Test_FsmApplySkipsApplied tests that log entries at or below the applied
+// index are not applied again.
+func Test_FsmApplySkipsApplied(t *testing.T) {
+	st := NewStore(true)
+	applyCommand(t, st, 5, command.Command{Op: command.OpSet, Key: "foo", Value: []byte("new")})
+	applyCommand(t, st, 4, command.Command{Op: command.OpSet, Key: "foo", Value: []byte("old")})
+	applyCommand(t, st, 5, command.Command{Op: command.OpDelete, Key: "foo"})
+
+	if v, _ := st.Get("foo"); string(v) != "new" {
+		t.Fatalf("replayed log entry was applied, foo is %q", v)
+	}
+	if idx := st.AppliedIndex(); idx != 5 {
+		t.Fatalf("wrong applied index: %d", idx)
+	}
+}
+
+// Test_FsmApplyDecodeError tests that an entry that cannot be decoded is
+// answered with the error, and still counts as applied.
+func Test_FsmApplyDecodeError(t *testing.T) {
+	st := NewStore(true)
+	for i, data := range [][]byte{{9, 1}, {1, 200}, []byte(`{"op":"set"`)} {
+		index := uint64(i + 1)
+		if _, ok := st.FsmApply(&raft.Log{Index: index, Term: 1, Data: data}).(error); !ok {
+			t.Fatalf("undecodable entry %v was not answered with an error", data)
+		}
+		if idx := st.AppliedIndex(); idx != index {
+			t.Fatalf("wrong applied index after undecodable entry: %d", idx)
+		}
+	}
+}
+
+// Test_SnapshotRestore tests that a snapshot carries the applied index and
+// that legacy snapshots without one can still be restored.
+func Test_SnapshotRestore(t *testing.T) {
+	st := NewStore(true)
+	applyCommand(t, st, 7, command.Command{Op: command.OpSet, Key: "foo", Value: []byte("bar")})
+
+	snap, err := st.FsmSnapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+
+	restored := NewStore(true)
+	if err := restored.FsmRestore(ioutil.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if v, _ := restored.Get("foo"); string(v) != "bar" {
+		t.Fatalf("wrong value after restore: %q", v)
+	}
+	if idx := restored.AppliedIndex(); idx != 7 {
+		t.Fatalf("wrong applied index after restore: %d", idx)
+	}
+
+	legacy := NewStore(true)
+	if err := legacy.FsmRestore(ioutil.NopCloser(bytes.NewReader([]byte(`{"index":"1","kv":"x"}`)))); err != nil {
+		t.Fatalf("failed to restore legacy snapshot: %s", err)
+	}
+	if v, _ := legacy.Get("index"); string(v) != "1" {
+		t.Fatalf("wrong value after legacy restore: %q", v)
+	}
+	if idx := legacy.AppliedIndex(); idx != 0 {
+		t.Fatalf("legacy snapshot set applied index: %d", idx)
+	}
+}
+
+// Test_SnapshotIsolation tests that a snapshot keeps the state it was taken
+// at while later log entries are applied, and that reads run while entries
+// are applied.
+func Test_SnapshotIsolation(t *testing.T) {
+	st := NewStore(true)
+	applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "a", Value: []byte("1")})
+	snap, err := st.FsmSnapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			st.Get("a")
+			st.Range("", "", "", func(key string, value []byte) bool { return true })
+		}
+	}()
+	for i := uint64(2); i < 100; i++ {
+		applyCommand(t, st, i, command.Command{Op: command.OpSet, Key: fmt.Sprint(i), Value: []byte("x")})
+	}
+	applyCommand(t, st, 100, command.Command{Op: command.OpDelete, Key: "a"})
+	<-done
+
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	restored := NewStore(true)
+	if err := restored.FsmRestore(ioutil.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if v, _ := restored.Get("a"); string(v) != "1" || restored.AppliedIndex() != 1 {
+		t.Fatalf("snapshot does not hold the state it was taken at: %q at %d", v, restored.AppliedIndex())
+	}
+	if n := restored.state.Load().tree.Len(); n != 1 {
+		t.Fatalf("snapshot holds %d keys", n)
+	}
+}
+
+// Test_SnapshotEnvelope tests snapshots with every compression, and that a
+// corrupted one is rejected.
+func Test_SnapshotEnvelope(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+		st := NewStore(true)
+		st.SetSnapshotCompression(c)
+		applyCommand(t, st, 3, command.Command{Op: command.OpSet, Key: "foo", Value: []byte("bar")})
+		snap, err := st.FsmSnapshot()
+		if err != nil {
+			t.Fatalf("failed to snapshot: %s", err)
+		}
+		sink := &testSink{}
+		if err := snap.Persist(sink); err != nil {
+			t.Fatalf("failed to persist %s snapshot: %s", c, err)
+		}
+		b := sink.Bytes()
+		if !bytes.HasPrefix(b, snapshotMagic) || Compression(b[5]) != c {
+			t.Fatalf("wrong %s snapshot header: %x", c, b[:snapshotHeaderSize])
+		}
+
+		restored := NewStore(true)
+		if err := restored.FsmRestore(ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+			t.Fatalf("failed to restore %s snapshot: %s", c, err)
+		}
+		if v, _ := restored.Get("foo"); string(v) != "bar" || restored.AppliedIndex() != 3 {
+			t.Fatalf("wrong state after %s restore: %q at %d", c, v, restored.AppliedIndex())
+		}
+
+		b[snapshotHeaderSize] ^= 0xff
+		err = NewStore(true).FsmRestore(ioutil.NopCloser(bytes.NewReader(b)))
+		if err != ErrSnapshotCorrupt {
+			t.Fatalf("corrupted %s snapshot restored with %v", c, err)
+		}
+	}
+}
+
+// Test_SnapshotRecordLength tests that a snapshot whose record length is
+// corrupted is rejected, even if its checksum matches.
+func Test_SnapshotRecordLength(t *testing.T) {
+	for _, n := range []uint64{1 << 62, maxSnapshotRecordSize - 1} {
+		b := make([]byte, snapshotHeaderSize)
+		copy(b, snapshotMagic)
+		b[4] = snapshotFormat
+		b[5] = byte(CompressionNone)
+		b = binary.AppendUvarint(b, n)
+		b = append(b, "short"...)
+		b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+
+		err := NewStore(true).FsmRestore(ioutil.NopCloser(bytes.NewReader(b)))
+		if err == nil || (n > maxSnapshotRecordSize && !errors.Is(err, ErrSnapshotCorrupt)) {
+			t.Fatalf("snapshot with a record of %d bytes restored with %v", n, err)
+		}
+	}
+}
+
+// Test_SnapshotStreaming tests snapshots larger than the buffers they are
+// streamed through, and that a truncated one is rejected.
+func Test_SnapshotStreaming(t *testing.T) {
+	st := NewStore(true)
+	txn := iradix.New().Txn()
+	for i := 0; i < 5000; i++ {
+		txn.Insert([]byte(fmt.Sprintf("key%d", i)), &entry{Value: bytes.Repeat([]byte{byte(i)}, i%300), ModIndex: uint64(i + 1)})
+	}
+	st.reset(&state{tree: txn.Commit(), index: 5000, term: 2})
+
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+		st.SetSnapshotCompression(c)
+		snap, _ := st.FsmSnapshot()
+		sink := &testSink{}
+		if err := snap.Persist(sink); err != nil {
+			t.Fatalf("failed to persist %s snapshot: %s", c, err)
+		}
+		b := sink.Bytes()
+
+		restored := NewStore(true)
+		if err := restored.FsmRestore(ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+			t.Fatalf("failed to restore %s snapshot: %s", c, err)
+		}
+		want, got := st.state.Load(), restored.state.Load()
+		if got.tree.Len() != want.tree.Len() || got.index != 5000 || got.term != 2 {
+			t.Fatalf("wrong state after %s restore: %d keys at %d/%d", c, got.tree.Len(), got.index, got.term)
+		}
+		it := want.tree.Root().Iterator()
+		for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+			e := v.(*entry)
+			if r := got.get(string(k)); r == nil || !bytes.Equal(r.Value, e.Value) || r.ModIndex != e.ModIndex {
+				t.Fatalf("wrong entry for %s after %s restore: %+v", k, c, r)
+			}
+		}
+
+		err := NewStore(true).FsmRestore(ioutil.NopCloser(bytes.NewReader(b[:len(b)-10])))
+		if err == nil {
+			t.Fatalf("truncated %s snapshot restored", c)
+		}
+	}
+}
+
+// Test_BinaryValues tests that values are stored byte for byte, and that
+// commands and snapshots written with text values are still understood.
+func Test_BinaryValues(t *testing.T) {
+	st := NewStore(true)
+	bin := []byte{0, 0xff, 0xfe, '\n', 'a'}
+	applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "bin", Value: bin})
+	st.FsmApply(&raft.Log{Index: 2, Term: 1, Data: []byte(`{"op":"set","key":"text","value":"abcd"}`)})
+	if err, ok := st.FsmApply(&raft.Log{Index: 3, Term: 1, Data: []byte(`{"op":"cas","key":"text","value":"efgh","prev_value":"abcd"}`)}).(error); ok {
+		t.Fatalf("cas with text precondition failed: %v", err)
+	}
+
+	snap, err := st.FsmSnapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	restored := NewStore(true)
+	if err := restored.FsmRestore(ioutil.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if v, _ := restored.Get("bin"); !bytes.Equal(v, bin) {
+		t.Fatalf("wrong binary value after restore: %q", v)
+	}
+	if v, _ := restored.Get("text"); string(v) != "efgh" {
+		t.Fatalf("wrong text value after restore: %q", v)
+	}
+
+	// "abcd" is valid base64 too, it must still be read as text.
+	text := NewStore(true)
+	if err := text.FsmRestore(ioutil.NopCloser(bytes.NewReader([]byte(`{"index":3,"term":1,"entries":{"k":{"value":"abcd","mod_index":2}}}`)))); err != nil {
+		t.Fatalf("failed to restore text snapshot: %s", err)
+	}
+	if v, rev, _ := text.GetRevision("k"); string(v) != "abcd" || rev != 2 {
+		t.Fatalf("wrong value after text snapshot restore: %q %d", v, rev)
+	}
+}
+
+// Test_Expiry tests that keys with a TTL are reported once expired and are
+// only dropped by an expire command for the deadline the leader saw.
+func Test_Expiry(t *testing.T) {
+	st := NewStore(true)
+	past := time.Now().Add(-time.Second).UnixNano()
+	future := time.Now().Add(time.Hour).UnixNano()
+	applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "old", Value: []byte("v"), Expires: past})
+	applyCommand(t, st, 2, command.Command{Op: command.OpSet, Key: "new", Value: []byte("v"), Expires: future})
+	applyCommand(t, st, 3, command.Command{Op: command.OpSet, Key: "none", Value: []byte("v")})
+
+	expired := st.Expired(time.Now().UnixNano(), 10)
+	if len(expired) != 1 || expired[0] != (raftnode.ExpiredKey{Key: "old", Expires: past}) {
+		t.Fatalf("wrong expired keys: %v", expired)
+	}
+	if ttl, ok, _ := st.TTL("new"); !ok || ttl < 59*time.Minute {
+		t.Fatalf("wrong TTL for key new: %s %v", ttl, ok)
+	}
+	if _, ok, _ := st.TTL("none"); ok {
+		t.Fatalf("key without TTL reported one")
+	}
+
+	// The key is set again before the leader's expire command is applied.
+	applyCommand(t, st, 4, command.Command{Op: command.OpSet, Key: "old", Value: []byte("v2"), Expires: future})
+	applyCommand(t, st, 5, command.Command{Op: command.OpExpire, Key: "old", Expires: past})
+	if v, _ := st.Get("old"); string(v) != "v2" {
+		t.Fatalf("key refreshed before expiry was dropped")
+	}
+	applyCommand(t, st, 6, command.Command{Op: command.OpExpire, Key: "new", Expires: future})
+	if v, _ := st.Get("new"); string(v) != "" {
+		t.Fatalf("expired key was not dropped: %q", v)
+	}
+	if len(st.Expired(future, 10)) != 1 {
+		t.Fatalf("dropped key still tracked for expiry")
+	}
+}
+
+// Test_ApplyResults tests the results commands are answered with.
+func Test_ApplyResults(t *testing.T) {
+	st := NewStore(true)
+	res := applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "a", Value: []byte("1")}).(*command.Result)
+	if res.Op != command.OpSet || res.Key != "a" || res.Index != 1 || res.Revision != 1 || res.PrevRevision != 0 || res.PrevValue != nil {
+		t.Fatalf("wrong result for create: %+v", res)
+	}
+	res = applyCommand(t, st, 2, command.Command{Op: command.OpSet, Key: "a", Value: []byte("2")}).(*command.Result)
+	if res.Revision != 2 || res.PrevRevision != 1 || string(res.PrevValue) != "1" || res.Deleted() {
+		t.Fatalf("wrong result for update: %+v", res)
+	}
+	res = applyCommand(t, st, 3, command.Command{Op: command.OpDelete, Key: "a"}).(*command.Result)
+	if res.Index != 3 || res.Revision != 0 || res.PrevRevision != 2 || string(res.PrevValue) != "2" || !res.Deleted() {
+		t.Fatalf("wrong result for delete: %+v", res)
+	}
+	res = applyCommand(t, st, 4, command.Command{Op: command.OpDelete, Key: "a"}).(*command.Result)
+	if res.Index != 4 || res.PrevRevision != 0 || res.Deleted() {
+		t.Fatalf("wrong result for delete of missing key: %+v", res)
+	}
+
+	err, ok := applyCommand(t, st, 5, command.Command{Op: command.OpCAS, Key: "a"}).(error)
+	if !ok || command.ErrorCode(err) != command.CodeInvalid {
+		t.Fatalf("cas without precondition returned %v", err)
+	}
+	err, ok = st.FsmApply(&raft.Log{Index: 6, Term: 1, Data: []byte{1, 200}}).(error)
+	if !ok || command.ErrorCode(err) != command.CodeUnsupported {
+		t.Fatalf("unknown op returned %v", err)
+	}
+}
+
+// Test_CompareAndSwap tests cas commands against the modify index and the
+// value of a key.
+func Test_CompareAndSwap(t *testing.T) {
+	st := NewStore(true)
+	zero, one, two := uint64(0), uint64(1), uint64(2)
+	bar, baz := []byte("bar"), []byte("baz")
+
+	if err, ok := applyCommand(t, st, 1, command.Command{Op: command.OpCAS, Key: "foo", Value: []byte("bar"), PrevIndex: &zero}).(error); ok {
+		t.Fatalf("create-only cas on missing key failed: %v", err)
+	}
+	if _, rev, _ := st.GetRevision("foo"); rev != 1 {
+		t.Fatalf("wrong modify index: %d", rev)
+	}
+	err, _ := applyCommand(t, st, 2, command.Command{Op: command.OpCAS, Key: "foo", Value: []byte("x"), PrevIndex: &zero}).(error)
+	if ce, ok := err.(*command.Error); !ok || ce.Code != command.CodeConflict || ce.Revision != 1 {
+		t.Fatalf("create-only cas on existing key did not conflict: %v", err)
+	}
+	if err, ok := applyCommand(t, st, 3, command.Command{Op: command.OpCAS, Key: "foo", Value: []byte("baz"), PrevIndex: &one, PrevValue: &bar}).(error); ok {
+		t.Fatalf("cas with matching preconditions failed: %v", err)
+	}
+	if _, ok := applyCommand(t, st, 4, command.Command{Op: command.OpCAS, Key: "foo", Value: []byte("y"), PrevIndex: &two}).(error); !ok {
+		t.Fatalf("cas with stale index succeeded")
+	}
+	if _, ok := applyCommand(t, st, 5, command.Command{Op: command.OpCAS, Key: "foo", Value: []byte("z"), PrevValue: &bar}).(error); !ok {
+		t.Fatalf("cas with stale value succeeded")
+	}
+	if err, ok := applyCommand(t, st, 6, command.Command{Op: command.OpCAS, Key: "foo", Value: []byte("qux"), PrevValue: &baz}).(error); ok {
+		t.Fatalf("cas with matching value failed: %v", err)
+	}
+	if v, rev, _ := st.GetRevision("foo"); string(v) != "qux" || rev != 6 {
+		t.Fatalf("wrong value after cas: %q at %d", v, rev)
+	}
+}
+
+// Test_Txn tests that the operations of a txn are applied all together, and
+// not at all when a compare fails.
+func Test_Txn(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	st, err := OpenStore(filepath.Join(tmpDir, "kv.db"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer st.Close()
+	applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "a", Value: []byte("1")})
+	applyCommand(t, st, 2, command.Command{Op: command.OpSet, Key: "b", Value: []byte("2")})
+
+	stale, one := uint64(0), uint64(1)
+	res := applyCommand(t, st, 3, command.Command{Op: command.OpTxn, Ops: []*command.Command{
+		{Op: command.OpCompare, Key: "a", PrevIndex: &stale},
+		{Op: command.OpSet, Key: "a", Value: []byte("x")},
+		{Op: command.OpDelete, Key: "b"},
+	}}).(*TxnResult)
+	if res.Succeeded || res.Results[0].Succeeded || res.Results[0].ModIndex != 1 || res.Results[1].Succeeded {
+		t.Fatalf("wrong result for failed txn: %+v", res)
+	}
+	if v, _ := st.Get("a"); string(v) != "1" {
+		t.Fatalf("failed txn was applied, a is %q", v)
+	}
+
+	res = applyCommand(t, st, 4, command.Command{Op: command.OpTxn, Ops: []*command.Command{
+		{Op: command.OpCompare, Key: "a", PrevIndex: &one},
+		{Op: command.OpSet, Key: "a", Value: []byte("x")},
+		{Op: command.OpSet, Key: "c", Value: []byte("3")},
+		{Op: command.OpDelete, Key: "b"},
+	}}).(*TxnResult)
+	if !res.Succeeded || res.Results[1].ModIndex != 4 || !res.Results[3].Succeeded {
+		t.Fatalf("wrong result for txn: %+v", res)
+	}
+	for k, want := range map[string]string{"a": "x", "b": "", "c": "3"} {
+		if v, _ := st.Get(k); string(v) != want {
+			t.Fatalf("wrong value for %s after txn: %q", k, v)
+		}
+	}
+
+	if _, ok := applyCommand(t, st, 5, command.Command{Op: command.OpTxn, Ops: []*command.Command{{Op: command.OpTxn, Key: "a"}}}).(error); !ok {
+		t.Fatalf("txn with unsupported op was accepted")
+	}
+}
+
+// Test_Batch tests that the commands of a batch are applied in order and
+// succeed or fail independently.
+func Test_Batch(t *testing.T) {
+	st := NewStore(true)
+	applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "a", Value: []byte("1")})
+
+	zero := uint64(0)
+	resps, ok := applyCommand(t, st, 2, command.Command{Op: command.OpBatch, Ops: []*command.Command{
+		{Op: command.OpCAS, Key: "a", Value: []byte("x"), PrevIndex: &zero},
+		{Op: command.OpCAS, Key: "b", Value: []byte("2"), PrevIndex: &zero},
+		{Op: command.OpCAS, Key: "b", Value: []byte("3"), PrevIndex: &zero},
+		{Op: command.OpDelete, Key: "a"},
+		{Op: command.OpBatch},
+	}}).([]interface{})
+	if !ok || len(resps) != 5 {
+		t.Fatalf("wrong response to batch: %v", resps)
+	}
+	if err, ok := resps[0].(*command.Error); !ok || !err.Conflict() || err.Revision != 1 {
+		t.Fatalf("wrong response to conflicting cas: %v", resps[0])
+	}
+	if _, ok := resps[1].(*command.Result); !ok {
+		t.Fatalf("batch command failed: %v", resps[1])
+	}
+	if res, ok := resps[3].(*command.Result); !ok || !res.Deleted() || string(res.PrevValue) != "1" {
+		t.Fatalf("batch commands failed: %v", resps)
+	}
+	if err, ok := resps[2].(*command.Error); !ok || !err.Conflict() || err.Revision != 2 {
+		t.Fatalf("cas did not see the previous command of the batch: %v", resps[2])
+	}
+	if _, ok := resps[4].(error); !ok {
+		t.Fatalf("nested batch was accepted")
+	}
+	for k, want := range map[string]string{"a": "", "b": "2"} {
+		if v, _ := st.Get(k); string(v) != want {
+			t.Fatalf("wrong value for %s after batch: %q", k, v)
+		}
+	}
+}
+
+// Test_Range tests ordered iteration with prefix, bounds and early stop.
+func Test_Range(t *testing.T) {
+	st := NewStore(true)
+	for i, k := range []string{"upstreams/c", "routes/a", "upstreams/a", "upstreams/b", "upstreamsx"} {
+		applyCommand(t, st, uint64(i+1), command.Command{Op: command.OpSet, Key: k, Value: []byte(k)})
+	}
+
+	var keys []string
+	collect := func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	}
+	st.Range("upstreams/", "", "", collect)
+	if len(keys) != 2 || keys[0] != "upstreams/a" || keys[1] != "upstreams/b" {
+		t.Fatalf("wrong keys for prefix listing: %v", keys)
+	}
+
+	keys = nil
+	st.Range("", "routes/", "upstreams/b", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 2 || keys[0] != "routes/a" || keys[1] != "upstreams/a" {
+		t.Fatalf("wrong keys for range listing: %v", keys)
+	}
+}
+
+// Test_WatchEvents tests that applied log entries publish their changes.
+func Test_WatchEvents(t *testing.T) {
+	st := NewStore(true)
+	w, err := st.Watch("a", false, 1)
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer w.Close()
+
+	applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "a", Value: []byte("1")})
+	applyCommand(t, st, 2, command.Command{Op: command.OpSet, Key: "b", Value: []byte("2")})
+	applyCommand(t, st, 3, command.Command{Op: command.OpDelete, Key: "a"})
+	applyCommand(t, st, 4, command.Command{Op: command.OpDelete, Key: "a"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	events, err := w.Next(ctx)
+	if err != nil {
+		t.Fatalf("failed to get events: %s", err)
+	}
+	if len(events) != 2 || events[0].Op != "set" || string(events[0].Value) != "1" || events[1].Op != "delete" || events[1].Index != 3 {
+		t.Fatalf("wrong events: %+v", events)
+	}
+}
+
+// Test_FsmApplyBatch tests that a batch is applied in order, skipping
+// entries already applied, and answers every entry at its position.
+func Test_FsmApplyBatch(t *testing.T) {
+	st := NewStore(true)
+	applyCommand(t, st, 2, command.Command{Op: command.OpSet, Key: "a", Value: []byte("1")})
+	w, err := st.Watch("a", false, 3)
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer w.Close()
+
+	var logs []*raft.Log
+	zero := uint64(0)
+	for i, c := range []command.Command{
+		{Op: command.OpSet, Key: "a", Value: []byte("old")},
+		{Op: command.OpSet, Key: "a", Value: []byte("2")},
+		{Op: command.OpCAS, Key: "b", Value: []byte("1"), PrevIndex: &zero},
+		{Op: command.OpCAS, Key: "b", Value: []byte("2"), PrevIndex: &zero},
+	} {
+		b, _ := command.Encode(&c)
+		logs = append(logs, &raft.Log{Index: uint64(i + 2), Term: 1, Data: b})
+	}
+	resps := st.FsmApplyBatch(logs)
+	if _, ok := resps[2].(*command.Result); len(resps) != 4 || !ok || !raftnode.IsConflict(resps[3]) {
+		t.Fatalf("wrong responses: %v", resps)
+	}
+	if v, rev, _ := st.GetRevision("a"); string(v) != "2" || rev != 3 {
+		t.Fatalf("wrong value after batch: %q at %d", v, rev)
+	}
+	if st.AppliedIndex() != 5 {
+		t.Fatalf("wrong applied index after batch: %d", st.AppliedIndex())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if events, err := w.Next(ctx); err != nil || len(events) != 1 || events[0].Index != 3 {
+		t.Fatalf("wrong events for batch: %v %v", events, err)
+	}
+}
+
+// Test_GetAt tests reads of keys as of past indexes.
+func Test_GetAt(t *testing.T) {
+	st := NewStore(true)
+	applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "a", Value: []byte("1")})
+	applyCommand(t, st, 2, command.Command{Op: command.OpSet, Key: "b", Value: []byte("x")})
+	applyCommand(t, st, 3, command.Command{Op: command.OpSet, Key: "a", Value: []byte("2")})
+	applyCommand(t, st, 4, command.Command{Op: command.OpDelete, Key: "a"})
+	applyCommand(t, st, 5, command.Command{Op: command.OpSet, Key: "a", Value: []byte("3")})
+
+	for _, tt := range []struct {
+		index          uint64
+		value          string
+		create, modify uint64
+	}{
+		{0, "3", 5, 5},
+		{1, "1", 1, 1},
+		{2, "1", 1, 1},
+		{3, "2", 1, 3},
+		{4, "", 0, 0},
+		{5, "3", 5, 5},
+	} {
+		v, create, modify, err := st.GetAt("a", tt.index)
+		if err != nil {
+			t.Fatalf("failed to read a at %d: %s", tt.index, err)
+		}
+		if string(v) != tt.value || create != tt.create || modify != tt.modify {
+			t.Fatalf("wrong version of a at %d: %q %d %d", tt.index, v, create, modify)
+		}
+	}
+	if v, _, _, _ := st.GetAt("b", 4); string(v) != "x" {
+		t.Fatalf("wrong version of b at 4: %q", v)
+	}
+	if _, _, _, err := st.GetAt("a", 6); err != raftnode.ErrNotApplied {
+		t.Fatalf("read of unapplied index returned %v", err)
+	}
+
+	// Move the window past the first versions of a.
+	for i := uint64(6); i < historyWindow+6; i++ {
+		applyCommand(t, st, i, command.Command{Op: command.OpSet, Key: "c", Value: []byte("c")})
+	}
+	if _, _, _, err := st.GetAt("a", 3); err != raftnode.ErrCompacted {
+		t.Fatalf("read before the window returned %v", err)
+	}
+	if v, _, _, _ := st.GetAt("a", 6); string(v) != "3" {
+		t.Fatalf("wrong version of a at 6: %q", v)
+	}
+	if n := len(st.history["c"]); n > historyWindow {
+		t.Fatalf("history of c not trimmed: %d versions", n)
+	}
+}
+
+// BenchmarkSnapshot1M reports the heap a 1M-key store needs, on top of its
+// own, to persist a snapshot and to restore it.
+// Test_Namespaces tests that namespaces are key spaces of their own, and
+// that deleting one deletes its keys.
+func Test_Namespaces(t *testing.T) {
+	st := NewStore(true)
+	if res := applyCommand(t, st, 1, command.Command{Op: command.OpSet, Namespace: "a", Key: "k", Value: []byte("v")}); command.ErrorCode(res.(error)) != command.CodeNotFound {
+		t.Fatalf("set in missing namespace returned %v", res)
+	}
+	applyCommand(t, st, 2, command.Command{Op: command.OpSetNamespace, Namespace: "a"})
+	applyCommand(t, st, 3, command.Command{Op: command.OpSetNamespace, Namespace: "b"})
+	applyCommand(t, st, 4, command.Command{Op: command.OpSet, Key: "k", Value: []byte("default")})
+	applyCommand(t, st, 5, command.Command{Op: command.OpSet, Namespace: "a", Key: "k", Value: []byte("a")})
+	res := applyCommand(t, st, 6, command.Command{Op: command.OpSet, Namespace: "b", Key: "k", Value: []byte("b")})
+	if r := res.(*command.Result); r.Namespace != "b" || r.Key != "k" || r.Revision != 6 {
+		t.Fatalf("wrong result for set in namespace: %+v", r)
+	}
+	if res := applyCommand(t, st, 7, command.Command{Op: command.OpSet, Key: "\x00a\x00k", Value: []byte("x")}); command.ErrorCode(res.(error)) != command.CodeInvalid {
+		t.Fatalf("set of key escaping the default namespace returned %v", res)
+	}
+	if res := applyCommand(t, st, 8, command.Command{Op: command.OpSetNamespace, Namespace: "a/b"}); command.ErrorCode(res.(error)) != command.CodeInvalid {
+		t.Fatalf("namespace with invalid name returned %v", res)
+	}
+
+	for _, ns := range []string{"", "a", "b"} {
+		rd, err := st.Namespace(ns)
+		if err != nil {
+			t.Fatalf("failed to get namespace %q: %s", ns, err)
+		}
+		want := ns
+		if ns == "" {
+			want = "default"
+		}
+		if v, _ := rd.Get("k"); string(v) != want {
+			t.Fatalf("wrong value in namespace %q: %q", ns, v)
+		}
+		var keys []string
+		rd.(raftnode.Ranger).Range("", "", "", func(key string, value []byte) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if len(keys) != 1 || keys[0] != "k" {
+			t.Fatalf("wrong keys in namespace %q: %q", ns, keys)
+		}
+	}
+	if infos := st.Namespaces(); len(infos) != 2 || infos[0].Name != "a" || infos[0].Keys != 1 || infos[0].Bytes != 2 {
+		t.Fatalf("wrong namespaces: %+v", infos)
+	}
+
+	rd, _ := st.Namespace("a")
+	w, err := rd.(raftnode.Watcher).Watch("", true, 0)
+	if err != nil {
+		t.Fatalf("failed to watch namespace: %s", err)
+	}
+	defer w.Close()
+	applyCommand(t, st, 9, command.Command{Op: command.OpDelete, Namespace: "b", Key: "k"})
+	applyCommand(t, st, 10, command.Command{Op: command.OpDeleteNamespace, Namespace: "a"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	events, err := w.Next(ctx)
+	if err != nil || len(events) != 1 || events[0].Index != 10 || events[0].Op != "delete" || events[0].Namespace != "a" || events[0].Key != "k" {
+		t.Fatalf("wrong events for namespace: %+v %v", events, err)
+	}
+	if _, err := st.Namespace("a"); err != raftnode.ErrNamespaceNotFound {
+		t.Fatalf("deleted namespace returned %v", err)
+	}
+	if res := applyCommand(t, st, 11, command.Command{Op: command.OpDeleteNamespace, Namespace: "a"}); command.ErrorCode(res.(error)) != command.CodeNotFound {
+		t.Fatalf("deleting missing namespace returned %v", res)
+	}
+	if n := st.state.Load().tree.Len(); n != 1 {
+		t.Fatalf("%d keys left after deleting namespace", n)
+	}
+}
+
+// Test_NamespaceQuota tests that writes taking a namespace over its quota are
+// rejected, transactions as a whole, and that writes freeing space are not.
+func Test_NamespaceQuota(t *testing.T) {
+	st := NewStore(true)
+	applyCommand(t, st, 1, command.Command{Op: command.OpSetNamespace, Namespace: "q", Quota: &command.Quota{MaxKeys: 2, MaxBytes: 10}})
+	applyCommand(t, st, 2, command.Command{Op: command.OpSet, Namespace: "q", Key: "a", Value: []byte("1")})
+	if res := applyCommand(t, st, 3, command.Command{Op: command.OpSet, Namespace: "q", Key: "b", Value: []byte("123456789")}); command.ErrorCode(res.(error)) != command.CodeQuota {
+		t.Fatalf("set over the byte quota returned %v", res)
+	}
+	applyCommand(t, st, 4, command.Command{Op: command.OpSet, Namespace: "q", Key: "b", Value: []byte("2")})
+	if res := applyCommand(t, st, 5, command.Command{Op: command.OpSet, Namespace: "q", Key: "c", Value: []byte("3")}); command.ErrorCode(res.(error)) != command.CodeQuota {
+		t.Fatalf("set over the key quota returned %v", res)
+	}
+	txn := command.Command{Op: command.OpTxn, Ops: []*command.Command{
+		{Op: command.OpSet, Namespace: "q", Key: "c", Value: []byte("3")},
+		{Op: command.OpSet, Namespace: "q", Key: "d", Value: []byte("4")},
+		{Op: command.OpDelete, Namespace: "q", Key: "a"},
+	}}
+	if res := applyCommand(t, st, 6, txn); command.ErrorCode(res.(error)) != command.CodeQuota {
+		t.Fatalf("txn over the key quota returned %v", res)
+	}
+	if st.state.Load().get(treeKey("q", "c")) != nil {
+		t.Fatalf("rejected txn was partly applied")
+	}
+	txn.Ops = []*command.Command{txn.Ops[2], txn.Ops[0]}
+	if res := applyCommand(t, st, 7, txn); !res.(*TxnResult).Succeeded {
+		t.Fatalf("txn within the quota failed: %+v", res)
+	}
+
+	// A lowered quota still lets the namespace shrink.
+	applyCommand(t, st, 8, command.Command{Op: command.OpSetNamespace, Namespace: "q", Quota: &command.Quota{MaxKeys: 1}})
+	if _, ok := applyCommand(t, st, 9, command.Command{Op: command.OpSet, Namespace: "q", Key: "b", Value: []byte("5")}).(*command.Result); !ok {
+		t.Fatalf("overwrite in namespace over its quota was rejected")
+	}
+	if _, ok := applyCommand(t, st, 10, command.Command{Op: command.OpDelete, Namespace: "q", Key: "b"}).(*command.Result); !ok {
+		t.Fatalf("delete in namespace over its quota was rejected")
+	}
+	if infos := st.Namespaces(); infos[0].Keys != 1 || infos[0].MaxKeys != 1 {
+		t.Fatalf("wrong namespace usage: %+v", infos[0])
+	}
+}
+
+// Test_NamespacePersistence tests that namespaces, their quota and their keys
+// survive a snapshot and a reopen of a disk-backed store.
+func Test_NamespacePersistence(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "kv.db")
+
+	st, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	applyCommand(t, st, 1, command.Command{Op: command.OpSetNamespace, Namespace: "full", Quota: &command.Quota{MaxKeys: 5}})
+	applyCommand(t, st, 2, command.Command{Op: command.OpSetNamespace, Namespace: "empty"})
+	applyCommand(t, st, 3, command.Command{Op: command.OpSet, Namespace: "full", Key: "k", Value: []byte("ns")})
+	applyCommand(t, st, 4, command.Command{Op: command.OpSet, Key: "k", Value: []byte("default")})
+
+	check := func(st *Store, what string) {
+		infos := st.Namespaces()
+		if len(infos) != 2 || infos[0].Name != "empty" || infos[1] != (raftnode.NamespaceInfo{Name: "full", MaxKeys: 5, Keys: 1, Bytes: 3}) {
+			t.Fatalf("wrong namespaces after %s: %+v", what, infos)
+		}
+		rd, _ := st.Namespace("full")
+		if v, _ := rd.Get("k"); string(v) != "ns" {
+			t.Fatalf("wrong value in namespace after %s: %q", what, v)
+		}
+		if v, _ := st.Get("k"); string(v) != "default" {
+			t.Fatalf("wrong value in default namespace after %s: %q", what, v)
+		}
+	}
+
+	snap, _ := st.FsmSnapshot()
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+	st, err = OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	check(st, "reopen")
+	applyCommand(t, st, 5, command.Command{Op: command.OpDeleteNamespace, Namespace: "full"})
+	st.Close()
+
+	st, err = OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	defer st.Close()
+	if len(st.Namespaces()) != 1 {
+		t.Fatalf("deleted namespace came back after reopen: %+v", st.Namespaces())
+	}
+	if err := st.FsmRestore(ioutil.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	check(st, "restore")
+}
+
+// Test_PatchLimits tests that repeated patches are rejected once the document
+// they leave, or the store, would exceed the limits they carry, and that
+// commands carrying none are not checked.
+func Test_PatchLimits(t *testing.T) {
+	st := NewStore(true)
+	limits := &command.Limits{MaxValueBytes: 64, MaxStoreBytes: 100}
+	var index uint64
+	grow := func(key string, limits *command.Limits) error {
+		index++
+		applyCommand(t, st, index, command.Command{Op: command.OpSet, Key: key, Value: []byte("{}")})
+		for i := 0; i < 100; i++ {
+			index++
+			p := fmt.Sprintf(`[{"op": "add", "path": "/k%d", "value": %d}]`, i, i)
+			res := applyCommand(t, st, index, command.Command{Op: command.OpJSONPatch, Key: key, Value: []byte(p), Limits: limits})
+			if err, ok := res.(error); ok {
+				return err
+			}
+		}
+		return nil
+	}
+	limit := func(err error) string {
+		var e *command.Error
+		if errors.As(err, &e) && e.Code == command.CodeQuota {
+			return e.Limit
+		}
+		return fmt.Sprint(err)
+	}
+
+	if err := grow("a", limits); limit(err) != command.LimitValueSize {
+		t.Fatalf("growing document was rejected with %v", err)
+	}
+	if v, _ := st.Get("a"); len(v) > 64 {
+		t.Fatalf("document grew to %d bytes", len(v))
+	}
+	if err := grow("b", limits); limit(err) != command.LimitStoreSize {
+		t.Fatalf("document growing the store was rejected with %v", err)
+	}
+	if _, bytes := st.Size(); bytes > 100 {
+		t.Fatalf("store grew to %d bytes", bytes)
+	}
+	if err := grow("c", nil); err != nil {
+		t.Fatalf("patch without limits was rejected: %s", err)
+	}
+}
+
+// Test_RejectedWrites tests that writes over the quota of their namespace are
+// counted by limit, and that the size of the store is tracked.
+func Test_RejectedWrites(t *testing.T) {
+	st := NewStore(true)
+	applyCommand(t, st, 1, command.Command{Op: command.OpSetNamespace, Namespace: "ns", Quota: &command.Quota{MaxBytes: 10}})
+	rejected := func() int64 {
+		if n, ok := command.RejectedWrites.Get(command.LimitNamespaceBytes).(*expvar.Int); ok {
+			return n.Value()
+		}
+		return 0
+	}
+	before := rejected()
+
+	applyCommand(t, st, 2, command.Command{Op: command.OpSet, Key: "a", Value: []byte("12345678")})
+	applyCommand(t, st, 3, command.Command{Op: command.OpSet, Namespace: "ns", Key: "b", Value: []byte("12345678")})
+	var e *command.Error
+	if res := applyCommand(t, st, 4, command.Command{Op: command.OpSet, Namespace: "ns", Key: "c", Value: []byte("12")}); !errors.As(res.(error), &e) || e.Limit != command.LimitNamespaceBytes {
+		t.Fatalf("set over the namespace quota returned %v", res)
+	}
+	// Overwrites that do not grow the namespace are accepted.
+	if _, ok := applyCommand(t, st, 5, command.Command{Op: command.OpSet, Namespace: "ns", Key: "b", Value: []byte("1")}).(*command.Result); !ok {
+		t.Fatalf("overwrite shrinking the namespace was rejected")
+	}
+	if keys, bytes := st.Size(); keys != 2 || bytes != 11 {
+		t.Fatalf("wrong store size: %d keys, %d bytes", keys, bytes)
+	}
+	if n := rejected() - before; n != 1 {
+		t.Fatalf("%d rejected writes counted", n)
+	}
+}
+
+// Test_Dump tests that a dump holds every namespace and key as of the index
+// dumped, and that applying its commands to an empty store recreates them.
+func Test_Dump(t *testing.T) {
+	st := NewStore(true)
+	applyCommand(t, st, 1, command.Command{Op: command.OpSetNamespace, Namespace: "b", Quota: &command.Quota{MaxKeys: 5}})
+	applyCommand(t, st, 2, command.Command{Op: command.OpSetNamespace, Namespace: "a"})
+	applyCommand(t, st, 3, command.Command{Op: command.OpSet, Key: "k", Value: []byte{0, 0xff}})
+	applyCommand(t, st, 4, command.Command{Op: command.OpSet, Namespace: "b", Key: "k", Value: []byte("b")})
+	expires := time.Now().Add(time.Hour).UnixNano()
+	applyCommand(t, st, 5, command.Command{Op: command.OpSet, Namespace: "a", Key: "k", Value: []byte("a"), Expires: expires})
+
+	var buf bytes.Buffer
+	index, err := st.Dump(&buf)
+	if err != nil {
+		t.Fatalf("failed to dump store: %s", err)
+	}
+	if index != 5 {
+		t.Fatalf("wrong index dumped: %d", index)
+	}
+
+	dr, err := command.NewDumpReader(&buf)
+	if err != nil {
+		t.Fatalf("failed to read dump: %s", err)
+	}
+	if dr.Index != 5 || dr.Term != 1 {
+		t.Fatalf("wrong dump header: %d %d", dr.Index, dr.Term)
+	}
+	st2 := NewStore(true)
+	var ops []string
+	for i := uint64(1); ; i++ {
+		c, err := dr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read dump: %s", err)
+		}
+		ops = append(ops, c.Op.String()+" "+c.Namespace+"/"+c.Key)
+		if res, ok := applyCommand(t, st2, i, *c).(error); ok {
+			t.Fatalf("failed to apply dumped command %+v: %s", c, res)
+		}
+	}
+	want := []string{"set_namespace a/", "set_namespace b/", "set a/k", "set b/k", "set /k"}
+	if fmt.Sprint(ops) != fmt.Sprint(want) {
+		t.Fatalf("wrong commands dumped: %q", ops)
+	}
+
+	if fmt.Sprint(st2.Namespaces()) != fmt.Sprint(st.Namespaces()) {
+		t.Fatalf("wrong namespaces restored: %+v", st2.Namespaces())
+	}
+	for _, ns := range []string{"", "a", "b"} {
+		rd, _ := st.Namespace(ns)
+		rd2, _ := st2.Namespace(ns)
+		v, _ := rd.Get("k")
+		v2, _ := rd2.Get("k")
+		if !bytes.Equal(v, v2) {
+			t.Fatalf("wrong value restored in namespace %q: %q", ns, v2)
+		}
+	}
+	if expired := st2.Expired(expires, 10); len(expired) != 1 || expired[0].Namespace != "a" || expired[0].Key != "k" {
+		t.Fatalf("expiry not restored: %+v", expired)
+	}
+}
+
+// Test_Locks tests that a lock is leased to one holder at a time, with the
+// index that acquired it as fencing token, until it is released or its
+// lease lapses.
+func Test_Locks(t *testing.T) {
+	st := NewStore(true)
+	now := time.Now()
+	apply := func(index uint64, at time.Time, c command.Command) interface{} {
+		b, err := command.Encode(&c)
+		if err != nil {
+			t.Fatalf("failed to encode command: %s", err)
+		}
+		return st.FsmApply(&raft.Log{Index: index, Term: 1, Data: b, AppendedAt: at})
+	}
+	lease := now.Add(10 * time.Second).UnixNano()
+	conflict := func(res interface{}, token uint64) bool {
+		var e *command.Error
+		return errors.As(res.(error), &e) && e.Code == command.CodeConflict && e.Revision == token
+	}
+
+	res := apply(1, now, command.Command{Op: command.OpAcquire, Key: "l", Holder: "a", Expires: lease})
+	if r := res.(*command.Result); r.Revision != 1 || r.Holder != "a" || r.Expires != lease {
+		t.Fatalf("wrong result for acquire: %+v", r)
+	}
+	if res := apply(2, now, command.Command{Op: command.OpAcquire, Key: "l", Holder: "b", Expires: lease}); !conflict(res, 1) {
+		t.Fatalf("acquire of held lock returned %v", res)
+	}
+	if res := apply(3, now, command.Command{Op: command.OpAcquire, Key: "l", Holder: "a", Expires: lease + 1}); res.(*command.Result).Revision != 1 {
+		t.Fatalf("acquire by holder changed token: %+v", res)
+	}
+	if res := apply(4, now, command.Command{Op: command.OpRenew, Key: "l", Token: 3, Expires: lease}); !conflict(res, 1) {
+		t.Fatalf("renew with wrong token returned %v", res)
+	}
+	if res := apply(5, now, command.Command{Op: command.OpAcquire, Namespace: "ns", Key: "l", Holder: "a", Expires: lease}); command.ErrorCode(res.(error)) != command.CodeInvalid {
+		t.Fatalf("acquire in namespace returned %v", res)
+	}
+	if res := apply(6, now, command.Command{Op: command.OpAcquire, Key: "m", Holder: "a"}); command.ErrorCode(res.(error)) != command.CodeInvalid {
+		t.Fatalf("acquire without lease returned %v", res)
+	}
+
+	// Once the lease lapsed, the lock goes to the next holder with a
+	// greater token, and the old one can no longer renew it.
+	later := now.Add(time.Minute)
+	res = apply(7, later, command.Command{Op: command.OpAcquire, Key: "l", Holder: "b", Expires: later.Add(time.Second).UnixNano()})
+	if r, ok := res.(*command.Result); !ok || r.Revision != 7 || r.PrevRevision != 1 || r.Holder != "b" {
+		t.Fatalf("acquire of lapsed lock returned %+v", res)
+	}
+	if res := apply(8, later, command.Command{Op: command.OpRenew, Key: "l", Token: 1, Expires: later.Add(time.Minute).UnixNano()}); !conflict(res, 7) {
+		t.Fatalf("renew of lost lock returned %v", res)
+	}
+	if l, ok := st.Lock("l"); !ok || l.Holder != "b" || l.Token != 7 {
+		t.Fatalf("wrong lease: %+v", l)
+	}
+
+	// The leader's release of a lapsed lease only applies to that lease.
+	expired := st.ExpiredLocks(later.Add(2*time.Second).UnixNano(), 10)
+	if len(expired) != 1 || expired[0].Token != 7 {
+		t.Fatalf("wrong expired locks: %+v", expired)
+	}
+	apply(9, later, command.Command{Op: command.OpRenew, Key: "l", Token: 7, Expires: later.Add(time.Hour).UnixNano()})
+	if res := apply(10, later, command.Command{Op: command.OpRelease, Key: "l", Token: 7, Expires: expired[0].Expires}); res.(*command.Result).Revision != 7 {
+		t.Fatalf("release of renewed lease freed the lock: %+v", res)
+	}
+	if res := apply(11, later, command.Command{Op: command.OpRelease, Key: "l", Token: 1}); !conflict(res, 7) {
+		t.Fatalf("release with old token returned %v", res)
+	}
+	if res := apply(12, later, command.Command{Op: command.OpRelease, Key: "l", Token: 7}); !res.(*command.Result).Deleted() {
+		t.Fatalf("release returned %+v", res)
+	}
+	if _, ok := st.Lock("l"); ok {
+		t.Fatalf("released lock is still held")
+	}
+}
+
+// Test_LockPersistence tests that leases survive a snapshot and a reopen of a
+// disk-backed store, and are left out of dumps.
+func Test_LockPersistence(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "kv.db")
+
+	st, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	expires := time.Now().Add(time.Hour).UnixNano()
+	applyCommand(t, st, 1, command.Command{Op: command.OpAcquire, Key: "a", Holder: "h1", Expires: expires})
+	applyCommand(t, st, 2, command.Command{Op: command.OpAcquire, Key: "b", Holder: "h2", Expires: expires})
+	applyCommand(t, st, 3, command.Command{Op: command.OpRelease, Key: "b", Token: 2})
+	applyCommand(t, st, 4, command.Command{Op: command.OpSet, Key: "k", Value: []byte("v")})
+
+	check := func(st *Store, what string) {
+		if l, ok := st.Lock("a"); !ok || l != (raftnode.Lease{Name: "a", Holder: "h1", Token: 1, Expires: expires}) {
+			t.Fatalf("wrong lease after %s: %+v", what, l)
+		}
+		if _, ok := st.Lock("b"); ok {
+			t.Fatalf("released lock held after %s", what)
+		}
+	}
+
+	snap, _ := st.FsmSnapshot()
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	var buf bytes.Buffer
+	if _, err := st.Dump(&buf); err != nil {
+		t.Fatalf("failed to dump store: %s", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("h1")) {
+		t.Fatalf("lock dumped: %s", buf.Bytes())
+	}
+	st.Close()
+
+	st, err = OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	defer st.Close()
+	check(st, "reopen")
+
+	restored := NewStore(true)
+	if err := restored.FsmRestore(ioutil.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	check(restored, "restore")
+}
+
+// Test_Counters tests that incr and decr add to the integer value of a key
+// within its bounds, keeping its TTL, and reject values that are not
+// integers.
+func Test_Counters(t *testing.T) {
+	st := NewStore(true)
+	max := int64(5)
+	zero := int64(0)
+	value := func(res interface{}) string {
+		r, ok := res.(*command.Result)
+		if !ok {
+			t.Fatalf("counter command failed: %v", res)
+		}
+		return string(r.Value)
+	}
+
+	if v := value(applyCommand(t, st, 1, command.Command{Op: command.OpIncr, Key: "c"})); v != "1" {
+		t.Fatalf("wrong value after incr of missing key: %s", v)
+	}
+	if v := value(applyCommand(t, st, 2, command.Command{Op: command.OpIncr, Key: "c", Delta: 4, Max: &max})); v != "5" {
+		t.Fatalf("wrong value after incr: %s", v)
+	}
+	res := applyCommand(t, st, 3, command.Command{Op: command.OpIncr, Key: "c", Max: &max})
+	if e, ok := res.(*command.Error); !ok || e.Code != command.CodeConflict || e.Revision != 2 {
+		t.Fatalf("incr over max returned %v", res)
+	}
+	if v := value(applyCommand(t, st, 4, command.Command{Op: command.OpDecr, Key: "c", Delta: 5, Min: &zero})); v != "0" {
+		t.Fatalf("wrong value after decr: %s", v)
+	}
+	if res := applyCommand(t, st, 5, command.Command{Op: command.OpDecr, Key: "c", Min: &zero}); !raftnode.IsConflict(res) {
+		t.Fatalf("decr under min returned %v", res)
+	}
+	if v, _ := st.Get("c"); string(v) != "0" {
+		t.Fatalf("wrong value read: %q", v)
+	}
+
+	applyCommand(t, st, 6, command.Command{Op: command.OpSet, Key: "s", Value: []byte("x")})
+	if res := applyCommand(t, st, 7, command.Command{Op: command.OpIncr, Key: "s"}); command.ErrorCode(res.(error)) != command.CodeInvalid {
+		t.Fatalf("incr of non-integer returned %v", res)
+	}
+	applyCommand(t, st, 8, command.Command{Op: command.OpSet, Key: "big", Value: []byte("9223372036854775807")})
+	if res := applyCommand(t, st, 9, command.Command{Op: command.OpIncr, Key: "big"}); command.ErrorCode(res.(error)) != command.CodeInvalid {
+		t.Fatalf("overflowing incr returned %v", res)
+	}
+
+	expires := time.Now().Add(time.Hour).UnixNano()
+	applyCommand(t, st, 10, command.Command{Op: command.OpIncr, Key: "w", Expires: expires})
+	applyCommand(t, st, 11, command.Command{Op: command.OpIncr, Key: "w", Expires: expires + 1})
+	if e := st.state.Load().get("w"); string(e.Value) != "2" || e.Expires != expires || e.CreateIndex != 10 {
+		t.Fatalf("wrong counter entry: %+v", e)
+	}
+
+	if res := applyCommand(t, st, 12, command.Command{Op: command.OpIncr, Key: "u", Session: 9}); command.ErrorCode(res.(error)) != command.CodeNotFound {
+		t.Fatalf("incr with unknown session returned %v", res)
+	}
+	if v, _ := st.Get("u"); v != nil {
+		t.Fatal("incr with unknown session created the key")
+	}
+}
+
+// Test_Patches tests that merge and JSON patches change the document of a
+// key as a whole or not at all, keeping its TTL.
+func Test_Patches(t *testing.T) {
+	st := NewStore(true)
+	patch := func(index uint64, op command.Op, key, p string) interface{} {
+		return applyCommand(t, st, index, command.Command{Op: op, Key: key, Value: []byte(p)})
+	}
+	value := func(key string) string {
+		v, err := st.Get(key)
+		if err != nil {
+			t.Fatalf("failed to get %s: %s", key, err)
+		}
+		return string(v)
+	}
+
+	expires := time.Now().Add(time.Hour).UnixNano()
+	applyCommand(t, st, 1, command.Command{Op: command.OpSet, Key: "up", Value: []byte(`{"servers": [{"addr": "a", "weight": 1}]}`), Expires: expires})
+	res := patch(2, command.OpMergePatch, "up", `{"keepalive": 16}`)
+	if r, ok := res.(*command.Result); !ok || string(r.Value) != `{"keepalive":16,"servers":[{"addr":"a","weight":1}]}` || r.PrevRevision != 1 {
+		t.Fatalf("wrong result for merge patch: %+v", res)
+	}
+	patch(3, command.OpJSONPatch, "up", `[{"op": "replace", "path": "servers.0.weight", "value": 5}, {"op": "add", "path": "/servers/-", "value": {"addr": "b"}}]`)
+	if v := value("up"); v != `{"keepalive":16,"servers":[{"addr":"a","weight":5},{"addr":"b"}]}` {
+		t.Fatalf("wrong document after JSON patch: %s", v)
+	}
+	if e := st.state.Load().get("up"); e.Expires != expires || e.CreateIndex != 1 {
+		t.Fatalf("patch changed TTL or create index: %+v", e)
+	}
+
+	// A JSON patch applies all of its operations or none.
+	res = patch(4, command.OpJSONPatch, "up", `[{"op": "remove", "path": "/keepalive"}, {"op": "test", "path": "/servers/0/weight", "value": 1}]`)
+	if e, ok := res.(*command.Error); !ok || e.Code != command.CodeConflict || e.Revision != 3 {
+		t.Fatalf("failed test operation returned %v", res)
+	}
+	if res := patch(5, command.OpJSONPatch, "up", `[{"op": "remove", "path": "/missing"}]`); command.ErrorCode(res.(error)) != command.CodeInvalid {
+		t.Fatalf("remove of missing member returned %v", res)
+	}
+	if v := value("up"); !strings.Contains(v, "keepalive") {
+		t.Fatalf("failed patch changed the document: %s", v)
+	}
+	prev := uint64(1)
+	res = applyCommand(t, st, 6, command.Command{Op: command.OpMergePatch, Key: "up", Value: []byte(`{"keepalive": null}`), PrevIndex: &prev})
+	if !raftnode.IsConflict(res) {
+		t.Fatalf("patch with stale precondition returned %v", res)
+	}
+
+	patch(7, command.OpMergePatch, "new", `{"a": 1}`)
+	if v := value("new"); v != `{"a":1}` {
+		t.Fatalf("wrong document created by patch: %s", v)
+	}
+	applyCommand(t, st, 8, command.Command{Op: command.OpSet, Key: "text", Value: []byte("plain")})
+	if res := patch(9, command.OpMergePatch, "text", `{"a": 1}`); command.ErrorCode(res.(error)) != command.CodeInvalid {
+		t.Fatalf("patch of non-JSON value returned %v", res)
+	}
+}
+
+// Test_Sessions tests that keys attached to a session are deleted when it is
+// destroyed, and that the leader's destruction of a lapsed session only
+// applies if it was not renewed.
+func Test_Sessions(t *testing.T) {
+	st := NewStore(true)
+	now := time.Now()
+	apply := func(index uint64, at time.Time, c command.Command) interface{} {
+		b, err := command.Encode(&c)
+		if err != nil {
+			t.Fatalf("failed to encode command: %s", err)
+		}
+		return st.FsmApply(&raft.Log{Index: index, Term: 1, Data: b, AppendedAt: at})
+	}
+	notFound := func(res interface{}) bool {
+		err, ok := res.(error)
+		return ok && command.ErrorCode(err) == command.CodeNotFound
+	}
+
+	res := apply(1, now, command.Command{Op: command.OpCreateSession, TTL: 10, Node: "node0"})
+	if r := res.(*command.Result); r.Session != 1 || r.Expires != now.Add(10*time.Second).UnixNano() {
+		t.Fatalf("wrong result for create: %+v", r)
+	}
+	if res := apply(2, now, command.Command{Op: command.OpCreateSession}); command.ErrorCode(res.(error)) != command.CodeInvalid {
+		t.Fatalf("create without ttl returned %v", res)
+	}
+	apply(3, now, command.Command{Op: command.OpSet, Key: "a", Value: []byte("1"), Session: 1})
+	apply(4, now, command.Command{Op: command.OpSet, Key: "b", Value: []byte("2"), Session: 1})
+	apply(5, now, command.Command{Op: command.OpSet, Key: "c", Value: []byte("3")})
+	if res := apply(6, now, command.Command{Op: command.OpSet, Key: "d", Value: []byte("4"), Session: 9}); !notFound(res) {
+		t.Fatalf("set with unknown session returned %v", res)
+	}
+	// Set again without session, b outlives it.
+	apply(7, now, command.Command{Op: command.OpSet, Key: "b", Value: []byte("2")})
+	apply(8, now, command.Command{Op: command.OpIncr, Key: "a", Delta: 1})
+	if s, ok := st.Session(1); !ok || s.Keys != 1 || s.Node != "node0" || s.TTL != 10 {
+		t.Fatalf("wrong session: %+v", s)
+	}
+
+	// The leader's destruction of a lapsed session only applies to that
+	// lease.
+	later := now.Add(time.Minute)
+	expired := st.ExpiredSessions(later.UnixNano(), 10)
+	if len(expired) != 1 || expired[0].ID != 1 {
+		t.Fatalf("wrong expired sessions: %+v", expired)
+	}
+	if res := apply(9, later, command.Command{Op: command.OpRenewSession, Session: 1}); !notFound(res) {
+		t.Fatalf("renew of lapsed session returned %v", res)
+	}
+	apply(10, now, command.Command{Op: command.OpRenewSession, Session: 1, TTL: 120})
+	if res := apply(11, later, command.Command{Op: command.OpDestroySession, Session: 1, Expires: expired[0].Expires}); res.(*command.Result).Expires == 0 {
+		t.Fatalf("destroy of renewed session ended it: %+v", res)
+	}
+	if s, _ := st.Session(1); s.TTL != 120 || s.Expires != now.Add(2*time.Minute).UnixNano() {
+		t.Fatalf("wrong renewed session: %+v", s)
+	}
+
+	w, err := st.Watch("a", false, 12)
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer w.Close()
+	apply(12, later, command.Command{Op: command.OpDestroySession, Session: 1})
+	for _, k := range []string{"a", "b", "c"} {
+		v, err := st.Get(k)
+		if err != nil {
+			t.Fatalf("failed to get %s: %s", k, err)
+		}
+		if (v == nil) != (k == "a") {
+			t.Fatalf("wrong value of %s after destroy: %q", k, v)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if events, err := w.Next(ctx); err != nil || len(events) != 1 || events[0].Op != "delete" || events[0].Index != 12 {
+		t.Fatalf("wrong events: %+v, %v", events, err)
+	}
+	if _, ok := st.Session(1); ok || len(st.Sessions()) != 0 {
+		t.Fatalf("session still exists after destroy")
+	}
+	if res := apply(13, later, command.Command{Op: command.OpDestroySession, Session: 1}); !notFound(res) {
+		t.Fatalf("destroy of ended session returned %v", res)
+	}
+}
+
+// Test_SessionPersistence tests that sessions and the keys attached to them
+// survive a reopen and a snapshot, and are left out of dumps.
+func Test_SessionPersistence(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "kv.db")
+
+	st, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	expires := time.Now().Add(time.Hour).UnixNano()
+	applyCommand(t, st, 1, command.Command{Op: command.OpCreateSession, TTL: 10, Expires: expires})
+	applyCommand(t, st, 2, command.Command{Op: command.OpCreateSession, TTL: 10, Expires: expires})
+	applyCommand(t, st, 3, command.Command{Op: command.OpDestroySession, Session: 2})
+	applyCommand(t, st, 4, command.Command{Op: command.OpSet, Key: "e", Value: []byte("v"), Session: 1})
+	applyCommand(t, st, 5, command.Command{Op: command.OpSet, Key: "k", Value: []byte("v")})
+
+	check := func(st *Store, what string) {
+		want := []raftnode.SessionInfo{{ID: 1, TTL: 10, Expires: expires, Keys: 1}}
+		if got := st.Sessions(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("wrong sessions after %s: %+v", what, got)
+		}
+		// The attachment of the key is restored with it.
+		applyCommand(t, st, 6, command.Command{Op: command.OpDestroySession, Session: 1})
+		if v, _ := st.Get("e"); v != nil {
+			t.Fatalf("key of destroyed session exists after %s", what)
+		}
+	}
+
+	snap, _ := st.FsmSnapshot()
+	sink := &testSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	var buf bytes.Buffer
+	if _, err := st.Dump(&buf); err != nil {
+		t.Fatalf("failed to dump store: %s", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte(`"e"`)) {
+		t.Fatalf("key of session dumped: %s", buf.Bytes())
+	}
+	st.Close()
+
+	st, err = OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	defer st.Close()
+	check(st, "reopen")
+
+	restored := NewStore(true)
+	if err := restored.FsmRestore(ioutil.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	check(restored, "restore")
+}
+
+// Test_SnapshotMemory tests that persisting a snapshot holds a bounded amount
+// of memory, whatever the number of keys: the live heap sampled while it is
+// written grows by about as much for ten times the keys.
+func Test_SnapshotMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a store of half a million keys")
+	}
+	growth := func(keys int) uint64 {
+		st := newSizedStore(keys)
+		sink := &heapSink{every: keys * 8}
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		sink.peak = ms.HeapAlloc
+		base := ms.HeapAlloc
+
+		snap, err := st.FsmSnapshot()
+		if err != nil {
+			t.Fatalf("failed to take snapshot: %s", err)
+		}
+		if err := snap.Persist(sink); err != nil {
+			t.Fatalf("failed to persist snapshot: %s", err)
+		}
+		if sink.samples < 8 {
+			t.Fatalf("live heap sampled %d times only", sink.samples)
+		}
+		runtime.KeepAlive(st)
+		return sink.peak - base
+	}
+
+	small, large := growth(50000), growth(500000)
+	t.Logf("live heap growth: %d bytes for 50k keys, %d bytes for 500k keys", small, large)
+	if large > 8<<20 || large > 2*small+(1<<20) {
+		t.Fatalf("persisting grows the live heap by %d bytes for 50k keys, %d bytes for 500k keys", small, large)
+	}
+}
+
+// BenchmarkSnapshot1M times persisting and restoring a snapshot of a million
+// keys. Its peak-heap-MB includes garbage not collected yet, which grows with
+// the heap; Test_SnapshotMemory checks the live heap persisting holds.
+func BenchmarkSnapshot1M(b *testing.B) {
+	const keys = 1000000
+	path := filepath.Join(b.TempDir(), "snapshot")
+
+	b.Run("persist", func(b *testing.B) {
+		st := newSizedStore(keys)
+		var peak uint64
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			peak = peakHeap(func() {
+				snap, _ := st.FsmSnapshot()
+				f, err := os.Create(path)
+				if err != nil {
+					b.Fatalf("failed to create snapshot file: %s", err)
+				}
+				if err := snap.Persist(&fileSink{f}); err != nil {
+					b.Fatalf("failed to persist snapshot: %s", err)
+				}
+			})
+		}
+		b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+	})
+
+	b.Run("restore", func(b *testing.B) {
+		var peak uint64
+		for i := 0; i < b.N; i++ {
+			st := NewStore(true)
+			peak = peakHeap(func() {
+				f, err := os.Open(path)
+				if err != nil {
+					b.Fatalf("failed to open snapshot file: %s", err)
+				}
+				if err := st.FsmRestore(f); err != nil {
+					b.Fatalf("failed to restore snapshot: %s", err)
+				}
+			})
+			if n := st.state.Load().tree.Len(); n != keys {
+				b.Fatalf("restored %d keys", n)
+			}
+		}
+		b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+	})
+}
+
+// BenchmarkApply compares the write throughput of applying log entries one by
+// one, as raft did before batching, with applying them in batches. b.N counts
+// log entries whatever the batch size, and the cost is reported per entry,
+// so that batch sizes compare directly.
+func BenchmarkApply(b *testing.B) {
+	// Per-entry debug logging would dominate the measurement.
+	level := helper.Logger.GetLevel()
+	helper.Logger.SetLevel(hclog.Warn)
+	defer helper.Logger.SetLevel(level)
+
+	for _, backend := range []string{"inmem", "bolt"} {
+		for _, batch := range []int{1, 64} {
+			b.Run(fmt.Sprintf("%s/batch=%d", backend, batch), func(b *testing.B) {
+				st := NewStore(true)
+				if backend == "bolt" {
+					var err error
+					if st, err = OpenStore(filepath.Join(b.TempDir(), "kv.db")); err != nil {
+						b.Fatalf("failed to open store: %s", err)
+					}
+					defer st.Close()
+				}
+				logs := make([]*raft.Log, b.N)
+				for i := range logs {
+					data, _ := command.Encode(&command.Command{Op: command.OpSet, Key: fmt.Sprintf("upstreams/%d", i%10000), Value: []byte("10.0.0.1:80")})
+					logs[i] = &raft.Log{Index: uint64(i + 1), Term: 1, Type: raft.LogCommand, Data: data}
+				}
+				b.ResetTimer()
+				for i := 0; i < len(logs); i += batch {
+					end := i + batch
+					if end > len(logs) {
+						end = len(logs)
+					}
+					if batch == 1 {
+						st.FsmApply(logs[i])
+					} else {
+						st.FsmApplyBatch(logs[i:end])
+					}
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N), "ns/entry")
+				b.ReportMetric(0, "ns/op")
+			})
+		}
+	}
+}
+
+// newSizedStore returns an in-memory store of keys keys with 64-byte values.
+func newSizedStore(keys int) *Store {
+	st := NewStore(true)
+	value := bytes.Repeat([]byte("v"), 64)
+	txn := iradix.New().Txn()
+	for i := 0; i < keys; i++ {
+		txn.Insert([]byte(fmt.Sprintf("upstreams/%08d", i)), &entry{Value: value, ModIndex: uint64(i + 1), CreateIndex: uint64(i + 1)})
+	}
+	st.reset(&state{tree: txn.Commit(), index: uint64(keys), term: 1})
+	return st
+}
+
+// heapSink is a raft.SnapshotSink discarding what is written to it, which
+// collects garbage and samples the live heap every so many bytes, keeping the
+// highest.
+type heapSink struct {
+	every   int
+	written int
+	samples int
+	peak    uint64
+}
+
+func (s *heapSink) Write(p []byte) (int, error) {
+	s.written += len(p)
+	if s.written >= s.every {
+		s.written = 0
+		s.samples++
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		if ms.HeapAlloc > s.peak {
+			s.peak = ms.HeapAlloc
+		}
+	}
+	return len(p), nil
+}
+
+func (s *heapSink) ID() string    { return "heap" }
+func (s *heapSink) Cancel() error { return nil }
+func (s *heapSink) Close() error  { return nil }
+
+// peakHeap runs f and returns the highest heap in use sampled while it ran,
+// above the heap in use before it.
+func peakHeap(f func()) uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	base, peak := ms.HeapInuse, ms.HeapInuse
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var ms runtime.MemStats
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			runtime.ReadMemStats(&ms)
+			if ms.HeapInuse > peak {
+				peak = ms.HeapInuse
+			}
+		}
+	}()
+	f()
+	close(done)
+	<-stopped
+
+	runtime.ReadMemStats(&ms)
+	if ms.HeapInuse > peak {
+		peak = ms.HeapInuse
+	}
+	return peak - base
+}
+
+// fileSink is a raft.SnapshotSink writing to a file.
+type fileSink struct {
+	*os.File
+}
+
+func (s *fileSink) ID() string    { return s.Name() }
+func (s *fileSink) Cancel() error { return s.File.Close() }
+
+type testSink struct {
+	bytes.Buffer
+	cancelled bool
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Cancel() error { s.cancelled = true; return nil }
+func (s *testSink) Close() error  { return nil }
+
+func applyCommand(t *testing.T, st *Store, index uint64, c command.Command) interface{} {
+	b, err := command.Encode(&c)
+	if err != nil {
+		t.Fatalf("failed to encode command: %s", err)
+	}
+	return st.FsmApply(&raft.Log{Index: index, Term: 1, Data: b})
+}